@@ -22,21 +22,30 @@ type Partition struct {
 }
 
 type CommonContext struct {
-	Scratchdir      string
-	Rootdir         string
-	Artifactdir     string
-	Downloaddir     string
-	Image           string
-	ImagePartitions []Partition
-	ImageMntDir     string
-	ImageFSTab      bytes.Buffer // Fstab as per partitioning
-	ImageKernelRoot string       // Kernel cmdline root= snippet for the / of the image
-	DebugShell      string
-	Origins         map[string]string
-	State           DebosState
-	EnvironVars     map[string]string
-	PrintRecipe     bool
-	Verbose         bool
+	Scratchdir       string
+	Rootdir          string
+	Artifactdir      string
+	Downloaddir      string
+	Image            string
+	ImagePartitions  []Partition
+	ImageMntDir      string
+	ImageFSTab       bytes.Buffer // Fstab as per partitioning
+	ImageCryptTab    bytes.Buffer // Crypttab as per partitioning
+	ImageKernelRoot  string       // Kernel cmdline root= snippet for the / of the image
+	ImageRootDevice  string       // Device holding the / filesystem of the image
+	AptCacheDir      string       // Directory caching the downloaded packages across builds
+	BootstrapMirrors []string     // Mirrors of the bootstrapped suite, the one in sources.list first
+	AllowDeviceWrite bool         // Whether actions may overwrite block devices of the host
+	LoopDevices      []string     // Loop devices attached by the actions, see AttachLoopDevice
+	DebugShell       string
+	ShellOnError     string // Shell started in the rootfs when an action fails to run
+	Origins          map[string]string
+	State            DebosState
+	EnvironVars      map[string]string
+	PrintRecipe      bool
+	Verbose          bool
+	DryRun           bool
+	StrictTemplates  bool // Fail on references to undefined template variables
 }
 
 type DebosContext struct {
@@ -58,12 +67,16 @@ type Action interface {
 	// PostMachineCleanup() gets called for all actions if Pre*Machine() method
 	// has run for Action. This method is always executed on the host with user's permissions.
 	PostMachineCleanup(context *DebosContext) error
+	// Summary() describes what the action is going to do, it's printed in
+	// dry-run mode after the Verify() stage. Empty if nothing to add.
+	Summary() string
 	String() string
 }
 
 type BaseAction struct {
 	Action      string
 	Description string
+	If          string // Condition to run the action, the recipe parser drops disabled actions
 }
 
 func (b *BaseAction) LogStart() {
@@ -81,6 +94,7 @@ func (b *BaseAction) Run(context *DebosContext) error                { return ni
 func (b *BaseAction) Cleanup(context *DebosContext) error            { return nil }
 func (b *BaseAction) PostMachine(context *DebosContext) error        { return nil }
 func (b *BaseAction) PostMachineCleanup(context *DebosContext) error { return nil }
+func (b *BaseAction) Summary() string                                { return "" }
 func (b *BaseAction) String() string {
 	if b.Description == "" {
 		return b.Action
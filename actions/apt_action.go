@@ -6,36 +6,220 @@ Install packages and their dependencies to the target rootfs with 'apt'.
 Yaml syntax:
  - action: apt
    recommends: bool
+   suggests: bool
    unauthenticated: bool
    update: bool
+   clean: bool
    packages:
      - package1
      - package2
+   debfiles:
+     - path/to/package.deb
+   sources:
+     - uri: http://deb.debian.org/debian
+       suite: bookworm-backports
+       components:
+         - main
+   keys:
+     - path/to/key.asc
+     - https://example.org/key.gpg
+   pins:
+     - package: linux-image-*
+       pin: release a=bookworm-backports
+       priority: 500
+   cleanup-pins: bool
+   shuffle-mirrors: bool
+   retries: 0
+   retry-delay: 5s
 
 Mandatory properties:
 
-- packages -- list of packages to install
+- packages -- list of packages to install, unless the action is only used to
+clean up with 'clean'.
 
 Optional properties:
 
-- recommends -- boolean indicating if suggested packages will be installed
+- debfiles -- list of local package files to install, relative to the recipe
+directory. The packages are copied into the target rootfs for the installation
+and their dependencies are resolved by 'apt'.
+
+- recommends -- boolean indicating if recommended packages will be installed. Default 'false'.
+
+- suggests -- boolean indicating if suggested packages will be installed. Default 'false'.
 
 - unauthenticated -- boolean indicating if unauthenticated packages can be installed
 
 - update -- boolean indicating if `apt update` will be run. Default 'true'.
+It's always run when 'sources' or 'keys' are given.
+
+- clean -- boolean indicating if the package lists downloaded by `apt update`
+are removed once the packages are installed, to reduce the size of the image.
+Default 'false', as following apt actions need them. The downloaded packages
+themselves are always removed. An apt action without any package only cleans up,
+e.g. to do it once as the last apt action of the recipe:
+ - action: apt
+   clean: true
+
+When debos is run with '--apt-cache', the given directory is used as the apt
+archive cache instead of the one of the target filesystem, so the downloaded
+packages are reused by the following builds and not removed. Builds sharing the
+cache directory on the same host wait for each other, the cache being locked on
+the host for the whole build as the virtual machine can't lock it.
+
+- sources -- list of additional repositories to install the packages from,
+each written to '/etc/apt/sources.list.d/<name>.list' and left in place.
+
+- keys -- list of keys the additional repositories are signed with, either
+files relative to the recipe directory or http(s) URLs. The keys are installed
+in '/etc/apt/trusted.gpg.d', so they need to be ASCII armored with a '.asc'
+extension or binary with a '.gpg' extension.
+
+- pins -- list of apt preferences, e.g. to hold packages at a given version or
+to prefer a given release, written to '/etc/apt/preferences.d' before
+installing the packages.
+
+- cleanup-pins -- boolean indicating if the preferences are removed once the
+packages are installed. Default 'false', so they keep applying on the target.
+
+- retries -- number of times the package lists update and the download of the
+packages are retried after a failure, e.g. because of a transient network
+error. Default 0. The installation itself isn't retried.
+
+When the update or the download still fails, the repositories with several
+mirrors, i.e. the ones of 'sources' with a list of URIs and the one of
+'/etc/apt/sources.list' when the 'debootstrap' action got a list of mirrors,
+are switched to their next mirror and the update and download are done again.
+
+- shuffle-mirrors -- if set to `true` the URIs of the sources are tried in a
+random order rather than in the listed one. Default 'false'.
+
+- retry-delay -- delay before retrying, doubled after each failed attempt, as
+a duration like '30s' or '1m'. Default '5s'.
+
+Properties for the sources:
+
+- uri -- mandatory base URI of the repository, or a list of URIs of mirrors of
+the repository which are tried in order.
+
+- suite -- mandatory suite of the repository, or exact path when ending with
+a '/'.
+
+- components -- components of the repository to use, mandatory unless the
+suite is an exact path.
+
+- name -- optional name of the sources file, derived from the URI and suite by
+default.
+
+Properties for the pins, see apt_preferences(5):
+
+- package -- mandatory package name or pattern the pin applies to.
+
+- pin -- mandatory pin, starting with 'version', 'release' or 'origin'.
+
+- priority -- mandatory priority of the pin, an integer.
 */
 package actions
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
 	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
 )
 
 type AptAction struct {
 	debos.BaseAction `yaml:",inline"`
 	Recommends       bool
+	Suggests         bool
 	Unauthenticated  bool
 	Update           bool
+	Clean            bool
 	Packages         []string
+	DebFiles         []string
+	Sources          []AptSource
+	Keys             []string
+	Pins             []AptPin
+	CleanupPins      bool `yaml:"cleanup-pins"`
+	ShuffleMirrors   bool `yaml:"shuffle-mirrors"`
+	Retries          int
+	RetryDelay       string `yaml:"retry-delay"`
+	retryDelay       time.Duration
+	unlockCache      func() // Releases the shared apt cache, nil if not locked
+}
+
+type AptPin struct {
+	Package  string
+	Pin      string
+	Priority string
+}
+
+// fileName returns the name of the preferences file of the pin
+func (p AptPin) fileName() string {
+	name := strings.Replace(p.Package+"-"+p.Pin, "*", "all", -1)
+	return "debos-" + strings.Trim(aptSourceNameRe.ReplaceAllString(name, "-"), "-")
+}
+
+func (p AptPin) String() string {
+	return fmt.Sprintf("Package: %s\nPin: %s\nPin-Priority: %s\n", p.Package, p.Pin, p.Priority)
+}
+
+type AptSource struct {
+	Name       string
+	Uri        string `yaml:"-"` // URI in use, set from 'uri'
+	Suite      string
+	Components []string
+	uris       []string
+}
+
+func (s *AptSource) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawAptSource AptSource
+	raw := struct {
+		rawAptSource `yaml:",inline"`
+		Uris         mirrorList `yaml:"uri"`
+	}{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*s = AptSource(raw.rawAptSource)
+	if len(raw.Uris) > 0 {
+		s.Uri = raw.Uris[0]
+		s.uris = raw.Uris
+	}
+	return nil
+}
+
+var aptSourceNameRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// fileName returns the name of the sources file of the repository
+func (s AptSource) fileName() string {
+	name := s.Name
+	if name == "" {
+		name = s.Uri + "-" + s.Suite
+		if u, err := url.Parse(s.Uri); err == nil && u.Host != "" {
+			name = u.Host + u.Path + "-" + s.Suite
+		}
+	}
+	return strings.Trim(aptSourceNameRe.ReplaceAllString(name, "-"), "-") + ".list"
+}
+
+func (s AptSource) String() string {
+	return strings.Join(append([]string{"deb", s.Uri, s.Suite}, s.Components...), " ")
+}
+
+// isRemoteKey returns true for keys to be downloaded
+func isRemoteKey(key string) bool {
+	return strings.HasPrefix(key, "http://") || strings.HasPrefix(key, "https://")
 }
 
 func NewAptAction() *AptAction {
@@ -43,6 +227,229 @@ func NewAptAction() *AptAction {
 	return a
 }
 
+func (apt *AptAction) Verify(context *debos.DebosContext) error {
+	if apt.cleanOnly() && !apt.Clean {
+		return fmt.Errorf("No packages to install")
+	}
+
+	for idx, f := range apt.DebFiles {
+		apt.DebFiles[idx] = debos.CleanPathAt(f, context.RecipeDir)
+		if _, err := os.Stat(apt.DebFiles[idx]); err != nil {
+			return err
+		}
+	}
+
+	for idx := range apt.Sources {
+		s := &apt.Sources[idx]
+		if len(s.uris) == 0 {
+			s.uris = []string{s.Uri}
+		}
+		if apt.ShuffleMirrors {
+			shuffleMirrors(s.uris)
+			s.Uri = s.uris[0]
+		}
+		if s.Uri == "" || s.Suite == "" {
+			return fmt.Errorf("Both 'uri' and 'suite' are needed for apt sources")
+		}
+		if len(s.Components) == 0 && !strings.HasSuffix(s.Suite, "/") {
+			return fmt.Errorf("Apt source %s needs components unless its suite is an exact path", s.Uri)
+		}
+	}
+
+	for _, p := range apt.Pins {
+		if p.Package == "" || p.Pin == "" {
+			return fmt.Errorf("Both 'package' and 'pin' are needed for apt pins")
+		}
+		kind := strings.SplitN(p.Pin, " ", 2)[0]
+		if kind != "version" && kind != "release" && kind != "origin" {
+			return fmt.Errorf("Invalid apt pin '%s' for %s: must start with 'version', 'release' or 'origin'", p.Pin, p.Package)
+		}
+		if _, err := strconv.Atoi(p.Priority); err != nil {
+			return fmt.Errorf("Invalid apt pin priority '%s' for %s", p.Priority, p.Package)
+		}
+	}
+
+	if apt.Retries < 0 {
+		return fmt.Errorf("Invalid number of retries %d", apt.Retries)
+	}
+	var err error
+	if apt.retryDelay, err = debos.ParseRetryDelay(apt.RetryDelay); err != nil {
+		return err
+	}
+
+	for idx, k := range apt.Keys {
+		ext := path.Ext(k)
+		if ext != ".asc" && ext != ".gpg" {
+			return fmt.Errorf("Apt key %s must have a '.asc' or '.gpg' extension", k)
+		}
+		if isRemoteKey(k) {
+			continue
+		}
+		apt.Keys[idx] = debos.CleanPathAt(k, context.RecipeDir)
+		if _, err := os.Stat(apt.Keys[idx]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (apt *AptAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	// Mount package files located outside of recipes directory
+	for _, f := range apt.DebFiles {
+		m.AddVolume(path.Dir(f))
+	}
+	for _, k := range apt.Keys {
+		if !isRemoteKey(k) {
+			m.AddVolume(path.Dir(k))
+		}
+	}
+
+	return apt.lockCache(context)
+}
+
+func (apt *AptAction) PreNoMachine(context *debos.DebosContext) error {
+	return apt.lockCache(context)
+}
+
+func (apt *AptAction) PostMachineCleanup(context *debos.DebosContext) error {
+	if apt.unlockCache != nil {
+		apt.unlockCache()
+		apt.unlockCache = nil
+	}
+	return nil
+}
+
+/* lockCache locks the shared apt cache on the host until PostMachineCleanup,
+ * as the locks taken in the fakemachine aren't seen by the other builds */
+func (apt *AptAction) lockCache(context *debos.DebosContext) error {
+	if context.AptCacheDir == "" || apt.unlockCache != nil {
+		return nil
+	}
+	unlock, err := lockAptCache(context.AptCacheDir)
+	if err != nil {
+		return err
+	}
+	apt.unlockCache = unlock
+	return nil
+}
+
+// cleanOnly returns true for actions used to clean up without any package
+func (apt *AptAction) cleanOnly() bool {
+	return len(apt.Packages) == 0 && len(apt.DebFiles) == 0
+}
+
+func (apt *AptAction) Summary() string {
+	packages := apt.Packages
+	for _, f := range apt.DebFiles {
+		packages = append(packages, path.Base(f))
+	}
+	if apt.cleanOnly() {
+		return "Clean up apt"
+	}
+	return fmt.Sprintf("Install packages: %s", strings.Join(packages, ", "))
+}
+
+// setupSources installs the additional repositories and their keys
+func (apt *AptAction) setupSources(context *debos.DebosContext) error {
+	keydir := path.Join(context.Rootdir, "etc/apt/trusted.gpg.d")
+	if len(apt.Keys) > 0 {
+		if err := os.MkdirAll(keydir, 0755); err != nil {
+			return err
+		}
+	}
+	for _, k := range apt.Keys {
+		target := path.Join(keydir, path.Base(k))
+		var err error
+		if isRemoteKey(k) {
+			err = debos.DownloadHttpUrl(k, target)
+		} else {
+			err = debos.CopyFile(k, target, 0644)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to install apt key %s: %v", k, err)
+		}
+	}
+
+	listdir := path.Join(context.Rootdir, "etc/apt/sources.list.d")
+	if len(apt.Sources) > 0 {
+		if err := os.MkdirAll(listdir, 0755); err != nil {
+			return err
+		}
+	}
+	for _, s := range apt.Sources {
+		err := ioutil.WriteFile(path.Join(listdir, s.fileName()), []byte(s.String()+"\n"), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/* nextMirrors switches the repositories having several mirrors to their next
+ * one, returning false if there is none left */
+func (apt *AptAction) nextMirrors(context *debos.DebosContext) (bool, error) {
+	switched := false
+
+	listdir := path.Join(context.Rootdir, "etc/apt/sources.list.d")
+	for idx := range apt.Sources {
+		s := &apt.Sources[idx]
+		if len(s.uris) < 2 {
+			continue
+		}
+		os.Remove(path.Join(listdir, s.fileName()))
+		s.uris = s.uris[1:]
+		s.Uri = s.uris[0]
+		debos.Warnf("Switching apt source to %s\n", s.Uri)
+		err := ioutil.WriteFile(path.Join(listdir, s.fileName()), []byte(s.String()+"\n"), 0644)
+		if err != nil {
+			return false, err
+		}
+		switched = true
+	}
+
+	if mirrors := context.BootstrapMirrors; len(mirrors) > 1 {
+		srclist := path.Join(context.Rootdir, "etc/apt/sources.list")
+		content, err := ioutil.ReadFile(srclist)
+		if err != nil {
+			return false, err
+		}
+		debos.Warnf("Switching the mirror of sources.list to %s\n", mirrors[1])
+		content = []byte(strings.Replace(string(content), " "+mirrors[0]+" ", " "+mirrors[1]+" ", -1))
+		if err := ioutil.WriteFile(srclist, content, 0644); err != nil {
+			return false, err
+		}
+		context.BootstrapMirrors = mirrors[1:]
+		switched = true
+	}
+
+	return switched, nil
+}
+
+// setupPins writes the preferences, returning the files written
+func (apt *AptAction) setupPins(context *debos.DebosContext) ([]string, error) {
+	var files []string
+
+	if len(apt.Pins) == 0 {
+		return files, nil
+	}
+
+	prefdir := path.Join(context.Rootdir, "etc/apt/preferences.d")
+	if err := os.MkdirAll(prefdir, 0755); err != nil {
+		return files, err
+	}
+	for _, p := range apt.Pins {
+		file := path.Join(prefdir, p.fileName())
+		if err := ioutil.WriteFile(file, []byte(p.String()), 0644); err != nil {
+			return files, err
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
 func (apt *AptAction) Run(context *debos.DebosContext) error {
 	apt.LogStart()
 	aptOptions := []string{"apt-get", "-y"}
@@ -51,6 +458,10 @@ func (apt *AptAction) Run(context *debos.DebosContext) error {
 		aptOptions = append(aptOptions, "--no-install-recommends")
 	}
 
+	if apt.Suggests {
+		aptOptions = append(aptOptions, "--install-suggests")
+	}
+
 	if apt.Unauthenticated {
 		aptOptions = append(aptOptions, "--allow-unauthenticated")
 	}
@@ -58,24 +469,192 @@ func (apt *AptAction) Run(context *debos.DebosContext) error {
 	aptOptions = append(aptOptions, "install")
 	aptOptions = append(aptOptions, apt.Packages...)
 
+	if len(apt.DebFiles) > 0 {
+		/* Make the package files available in the chroot */
+		debdir := "/var/cache/debos-debs"
+		err := os.MkdirAll(path.Join(context.Rootdir, debdir), 0755)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(path.Join(context.Rootdir, debdir))
+
+		for _, f := range apt.DebFiles {
+			target := path.Join(debdir, path.Base(f))
+			err = debos.CopyFile(f, path.Join(context.Rootdir, target), 0644)
+			if err != nil {
+				return err
+			}
+			aptOptions = append(aptOptions, target)
+		}
+	}
+
+	if err := apt.setupSources(context); err != nil {
+		return err
+	}
+
+	pins, err := apt.setupPins(context)
+	if apt.CleanupPins {
+		defer func() {
+			for _, p := range pins {
+				os.Remove(p)
+			}
+		}()
+	}
+	if err != nil {
+		return err
+	}
+
 	c := debos.NewChrootCommandForContext(*context)
 	c.AddEnv("DEBIAN_FRONTEND=noninteractive")
 
-	if apt.Update {
-		err := c.Run("apt", "apt-get", "update")
+	// Locked by the Pre*Machine stage on the host
+	if context.AptCacheDir != "" {
+		c.AddBindMount(context.AptCacheDir, "/var/cache/apt/archives")
+	}
+
+	if !apt.cleanOnly() {
+		if err := apt.fetch(c, context, aptOptions); err != nil {
+			return err
+		}
+
+		err = c.Run("apt", aptOptions...)
 		if err != nil {
 			return err
 		}
 	}
 
-	err := c.Run("apt", aptOptions...)
-	if err != nil {
-		return err
+	// Keep the shared cache, which isn't part of the target filesystem
+	if context.AptCacheDir == "" {
+		err = c.Run("apt", "apt-get", "clean")
+		if err != nil {
+			return err
+		}
+	}
+
+	if apt.Clean {
+		return apt.cleanLists(context)
 	}
-	err = c.Run("apt", "apt-get", "clean")
+
+	return nil
+}
+
+// hasMirrors tells whether some repositories have mirrors to fall back to
+func (apt *AptAction) hasMirrors(context *debos.DebosContext) bool {
+	for _, s := range apt.Sources {
+		if len(s.uris) > 1 {
+			return true
+		}
+	}
+	return len(context.BootstrapMirrors) > 1
+}
+
+/* fetch updates the package lists and downloads the packages, retrying and
+ * falling back to the next mirrors on failure */
+func (apt *AptAction) fetch(c debos.Command, context *debos.DebosContext, aptOptions []string) error {
+	update := apt.Update || len(apt.Sources) > 0 || len(apt.Keys) > 0
+
+	for {
+		var err error
+		if update {
+			err = debos.Retry("apt-get update", apt.Retries, apt.retryDelay, func() error {
+				return c.Run("apt", "apt-get", "update")
+			})
+		}
+
+		/* Download the packages first, which can be retried safely, so only
+		 * the network errors get retried */
+		if err == nil && (apt.Retries > 0 || apt.hasMirrors(context)) {
+			download := append(append([]string{}, aptOptions[:2]...), "--download-only")
+			download = append(download, aptOptions[2:]...)
+			err = debos.Retry("apt download", apt.Retries, apt.retryDelay, func() error {
+				return c.Run("apt", download...)
+			})
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		switched, serr := apt.nextMirrors(context)
+		if serr != nil {
+			return serr
+		}
+		if !switched {
+			return err
+		}
+		// The package lists of the new mirrors are needed
+		update = true
+	}
+}
+
+/* The apt cache lock of this process, shared by its apt actions as the locks
+ * taken on different files descriptors of a process exclude each other */
+var aptCacheLock = struct {
+	sync.Mutex
+	users int
+	file  *os.File
+}{}
+
+/* lockAptCache prevents builds sharing the apt cache from using it at the same
+ * time, returning a function to release it */
+func lockAptCache(cachedir string) (func(), error) {
+	aptCacheLock.Lock()
+	defer aptCacheLock.Unlock()
+
+	if aptCacheLock.users == 0 {
+		if err := os.MkdirAll(path.Join(cachedir, "partial"), 0755); err != nil {
+			return nil, err
+		}
+
+		lock, err := os.OpenFile(path.Join(cachedir, "debos.lock"), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == syscall.EWOULDBLOCK {
+			debos.Infof("Waiting for another build to release the apt cache %s\n", cachedir)
+			err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+		}
+		if err != nil {
+			lock.Close()
+			return nil, fmt.Errorf("Failed to lock apt cache %s: %v", cachedir, err)
+		}
+		aptCacheLock.file = lock
+	}
+	aptCacheLock.users++
+
+	return func() {
+		aptCacheLock.Lock()
+		defer aptCacheLock.Unlock()
+
+		if aptCacheLock.users--; aptCacheLock.users == 0 {
+			syscall.Flock(int(aptCacheLock.file.Fd()), syscall.LOCK_UN)
+			aptCacheLock.file.Close()
+			aptCacheLock.file = nil
+		}
+	}, nil
+}
+
+// cleanLists removes the package lists, keeping the lock and directories
+func (apt *AptAction) cleanLists(context *debos.DebosContext) error {
+	listsdir := path.Join(context.Rootdir, "var/lib/apt/lists")
+	files, err := ioutil.ReadDir(listsdir)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
 
+	for _, f := range files {
+		if f.IsDir() || f.Name() == "lock" {
+			continue
+		}
+		if err := os.Remove(path.Join(listsdir, f.Name())); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
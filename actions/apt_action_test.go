@@ -0,0 +1,61 @@
+package actions
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Locks the apt cache given in the environment, as another build would
+func TestLockAptCacheHelper(t *testing.T) {
+	cachedir := os.Getenv("DEBOS_TEST_APT_CACHE")
+	if cachedir == "" {
+		t.Skip("Only run by TestLockAptCache")
+	}
+	unlock, err := lockAptCache(cachedir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("locked")
+	unlock()
+	os.Exit(0)
+}
+
+func TestLockAptCache(t *testing.T) {
+	cachedir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(cachedir)
+
+	// The apt actions of a build share the lock
+	unlock, err := lockAptCache(cachedir)
+	assert.Empty(t, err)
+	unlockOther, err := lockAptCache(cachedir)
+	assert.Empty(t, err)
+	unlockOther()
+
+	var out bytes.Buffer
+	other := exec.Command(os.Args[0], "-test.run=^TestLockAptCacheHelper$")
+	other.Env = append(os.Environ(), "DEBOS_TEST_APT_CACHE="+cachedir)
+	other.Stdout = &out
+	assert.Empty(t, other.Start())
+	done := make(chan error)
+	go func() { done <- other.Wait() }()
+
+	// Another build waits for the cache to be released
+	select {
+	case err := <-done:
+		t.Fatalf("Apt cache locked by another build: %v: %s", err, out.String())
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	unlock()
+	assert.Empty(t, <-done)
+	assert.Contains(t, out.String(), "locked")
+}
@@ -0,0 +1,163 @@
+/*
+Compress Action
+
+Compress an artifact, typically the image created by 'image-partition'. The
+compression runs on the host after all other actions are done. Multiple
+threads can be used to speed up the compression of big images, using 'pigz'
+and 'pbzip2' for 'gz' and 'bzip2' respectively.
+
+Yaml syntax:
+ - action: compress
+   input: image.img
+   output: image.img.zst
+   algorithm: zstd
+   level: 19
+   threads: 0
+
+Mandatory properties:
+
+- input -- name of the file to compress, relative to the artifact directory.
+The file is kept after compression.
+
+Optional properties:
+
+- output -- name of the compressed file, relative to the artifact directory.
+Defaults to the input name with the usual suffix of the algorithm appended:
+'.gz', '.bz2', '.xz' or '.zst'.
+
+- algorithm -- compression algorithm, one of 'gz', 'bzip2', 'xz' or 'zstd'.
+Defaults to 'gz'.
+
+- level -- compression level, from 1 to 9 (19 for 'zstd'). By default the
+default level of the compressor is used.
+
+- threads -- number of threads used for compression, '0' meaning one per
+available CPU. Defaults to 1.
+*/
+package actions
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+
+	"github.com/go-debos/debos"
+)
+
+type compressor struct {
+	command         string // Single threaded compressor
+	parallelCommand string // Multi threaded compressor
+	suffix          string
+	maxLevel        int
+}
+
+var compressors = map[string]compressor{
+	"gz":    {"gzip", "pigz", ".gz", 9},
+	"bzip2": {"bzip2", "pbzip2", ".bz2", 9},
+	"xz":    {"xz", "xz", ".xz", 9},
+	"zstd":  {"zstd", "zstd", ".zst", 19},
+}
+
+type CompressAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Input            string
+	Output           string
+	Algorithm        string
+	Level            int
+	Threads          int
+}
+
+func NewCompressAction() *CompressAction {
+	return &CompressAction{Algorithm: "gz", Threads: 1}
+}
+
+func (c *CompressAction) command() string {
+	if c.Threads == 1 {
+		return compressors[c.Algorithm].command
+	}
+	return compressors[c.Algorithm].parallelCommand
+}
+
+func (c *CompressAction) Verify(context *debos.DebosContext) error {
+	if len(c.Input) == 0 {
+		return fmt.Errorf("'input' property can't be empty")
+	}
+
+	compressor, found := compressors[c.Algorithm]
+	if !found {
+		return fmt.Errorf("Unsupported compression algorithm %s", c.Algorithm)
+	}
+	if c.Level < 0 || c.Level > compressor.maxLevel {
+		return fmt.Errorf("Compression level for %s should be between 1 and %d",
+			c.Algorithm, compressor.maxLevel)
+	}
+	if c.Threads < 0 {
+		return fmt.Errorf("Number of threads can't be negative")
+	}
+
+	if len(c.Output) == 0 {
+		c.Output = c.Input + compressor.suffix
+	}
+
+	if err := debos.CheckBinaries(c.command()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *CompressAction) Summary() string {
+	return fmt.Sprintf("Compress %s to %s (%s)", c.Input, c.Output, c.Algorithm)
+}
+
+func (c *CompressAction) PostMachine(context *debos.DebosContext) error {
+	c.LogStart()
+
+	input := path.Join(context.Artifactdir, c.Input)
+	output := path.Join(context.Artifactdir, c.Output)
+
+	threads := c.Threads
+	if threads == 0 {
+		threads = runtime.NumCPU()
+	}
+
+	// Keep the input and overwrite an existing compressed file
+	cmdline := []string{c.command(), "-k", "-f"}
+	if c.Level > 0 {
+		cmdline = append(cmdline, "-"+strconv.Itoa(c.Level))
+	}
+	if threads > 1 {
+		switch c.Algorithm {
+		case "gz":
+			cmdline = append(cmdline, "-p", strconv.Itoa(threads))
+		case "bzip2":
+			cmdline = append(cmdline, "-p"+strconv.Itoa(threads))
+		case "xz", "zstd":
+			cmdline = append(cmdline, "-T"+strconv.Itoa(threads))
+		}
+	}
+
+	// gzip stores the name and timestamp of the input otherwise
+	_, reproducible, err := debos.SourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	if reproducible && c.Algorithm == "gz" {
+		cmdline = append(cmdline, "-n")
+	}
+	cmdline = append(cmdline, input)
+
+	err = debos.Command{}.Run("Compressing", cmdline...)
+	if err != nil {
+		return err
+	}
+
+	compressed := input + compressors[c.Algorithm].suffix
+	if compressed != output {
+		return os.Rename(compressed, output)
+	}
+
+	return nil
+}
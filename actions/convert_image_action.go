@@ -0,0 +1,77 @@
+/*
+ConvertImage Action
+
+Convert a raw image to a format suitable for virtual machines or cloud
+platforms with qemu-img(1). The conversion runs on the host after all other
+actions are done, so it can be used on images created by 'image-partition'.
+Requires 'qemu-img' to be installed on the host.
+
+Yaml syntax:
+ - action: convert-image
+   input: image.img
+   output: image.qcow2
+   format: qcow2
+
+Mandatory properties:
+
+- input -- name of the image to convert, relative to the artifact directory.
+
+- output -- name of the converted image, relative to the artifact directory.
+
+- format -- format of the converted image, one of 'qcow2', 'vmdk', 'vdi' or
+'vhdx'.
+*/
+package actions
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/go-debos/debos"
+)
+
+var convertImageFormats = []string{"qcow2", "vmdk", "vdi", "vhdx"}
+
+type ConvertImageAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Input            string
+	Output           string
+	Format           string
+}
+
+func (c *ConvertImageAction) Verify(context *debos.DebosContext) error {
+	if len(c.Input) == 0 || len(c.Output) == 0 {
+		return fmt.Errorf("'input' and 'output' properties can't be empty")
+	}
+
+	supported := false
+	for _, f := range convertImageFormats {
+		if c.Format == f {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return fmt.Errorf("Unsupported image format '%s'", c.Format)
+	}
+
+	if err := debos.CheckBinaries("qemu-img"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *ConvertImageAction) Summary() string {
+	return fmt.Sprintf("Convert %s to %s image %s", c.Input, c.Format, c.Output)
+}
+
+func (c *ConvertImageAction) PostMachine(context *debos.DebosContext) error {
+	c.LogStart()
+
+	input := path.Join(context.Artifactdir, c.Input)
+	output := path.Join(context.Artifactdir, c.Output)
+
+	return debos.Command{}.Run("qemu-img", "qemu-img", "convert", "-f", "raw",
+		"-O", c.Format, input, output)
+}
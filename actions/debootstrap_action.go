@@ -1,7 +1,8 @@
 /*
 Debootstrap Action
 
-Construct the target rootfs with debootstrap tool.
+Construct the target rootfs with debootstrap tool, or alternatively with
+mmdebstrap or cdebootstrap.
 
 Please keep in mind -- file `/etc/resolv.conf` will be removed after execution.
 Most of the OS scripts used by `debootstrap` copy `resolv.conf` from the host,
@@ -10,6 +11,7 @@ and this may lead to incorrect configuration when becoming part of the created r
 Yaml syntax:
  - action: debootstrap
    mirror: URL
+   shuffle-mirrors: bool
    suite: "name"
    components: <list of components>
    variant: "name"
@@ -17,6 +19,11 @@ Yaml syntax:
    keyring-file:
    certificate:
    private-key:
+   qemu-static:
+   proxy: URL
+   tool: debootstrap
+   retries: 0
+   retry-delay: 5s
 
 Mandatory properties:
 
@@ -26,10 +33,48 @@ Optional properties:
 
 - check-gpg -- verify GPG signatures on Release files, true by default
 
-- mirror -- URL with Debian-compatible repository
+- mirror -- URL with Debian-compatible repository, or a list of such URLs.
  If no mirror is specified debos will use http://deb.debian.org/debian as default.
+ A local mirror can be used with a 'file://' URL or an absolute path, which is
+ then made available in the fakemachine. The mirror is checked to provide the
+ suite before running the recipe.
+ With a list of mirrors the ones not providing the suite are skipped, at least
+ one of them has to. When the bootstrap fails, including its retries, it starts
+ over with the next mirror. The mirror used is written to '/etc/apt/sources.list',
+ and the following 'apt' actions fall back to the other mirrors as well.
 
-- variant -- name of the bootstrap script variant to use
+Example:
+ mirror:
+   - http://deb.debian.org/debian
+   - http://ftp.de.debian.org/debian
+
+- shuffle-mirrors -- if set to `true` the mirrors are tried in a random order
+rather than in the listed one, to spread the load of builds between them.
+Default 'false'.
+
+- proxy -- URL of the HTTP proxy to download the packages with, e.g. an
+apt-cacher-ng instance to speed up repeated builds. It overrides the proxy
+environment variables for debootstrap.
+
+- variant -- name of the bootstrap script variant to use, one of 'minbase',
+'buildd' or 'fakechroot'. The default variant is used if not set. With
+mmdebstrap, the variants 'essential', 'apt', 'required', 'important' and
+'standard' can be used as well but not 'fakechroot'. With cdebootstrap only
+'minbase' and 'buildd' are supported, mapped to its 'minimal' and 'build'
+flavours.
+
+- tool -- bootstrap tool to use: 'debootstrap' (default), 'mmdebstrap' or
+'cdebootstrap'. mmdebstrap is considerably faster. Neither mmdebstrap nor
+cdebootstrap support the 'certificate' and 'private-key' properties, and
+cdebootstrap doesn't support other components than 'main' nor foreign
+architectures.
+
+- retries -- number of times the bootstrap is retried after a failure, e.g.
+because of a transient network error. Default 0. The target rootfs is emptied
+before each new attempt, so it must be empty before the action.
+
+- retry-delay -- delay before retrying, doubled after each failed attempt, as
+a duration like '30s' or '1m'. Default '5s'.
 
 - components -- list of components to use for packages selection.
  If no components are specified debos will use main as default.
@@ -46,15 +91,28 @@ Example:
 - certificate -- client certificate stored in file to be used for downloading packages from the server.
 
 - private-key -- provide the client's private key in a file separate from the certificate.
+
+- qemu-static -- path on the host to the static qemu user binary used to run the
+second stage of debootstrap when the recipe architecture differs from the host
+architecture. By default it's guessed from the architecture, e.g.
+'/usr/bin/qemu-aarch64-static' for arm64. The binary is installed at that
+canonical path in the target filesystem. Hosts without binfmt support for the
+architecture get the qemu binary registered with binfmt_misc while the commands
+run in the target filesystem, which needs debos to run as root.
 */
 package actions
 
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/go-debos/debos"
 	"github.com/go-debos/fakemachine"
@@ -63,15 +121,77 @@ import (
 type DebootstrapAction struct {
 	debos.BaseAction `yaml:",inline"`
 	Suite            string
-	Mirror           string
+	Mirror           string `yaml:"-"` // Mirror in use, set from 'mirror'
+	ShuffleMirrors   bool   `yaml:"shuffle-mirrors"`
 	Variant          string
 	KeyringPackage   string `yaml:"keyring-package"`
 	KeyringFile      string `yaml:"keyring-file"`
 	Certificate      string
 	PrivateKey       string `yaml:"private-key"`
 	Components       []string
-	MergedUsr        bool `yaml:"merged-usr"`
-	CheckGpg         bool `yaml:"check-gpg"`
+	MergedUsr        bool   `yaml:"merged-usr"`
+	CheckGpg         bool   `yaml:"check-gpg"`
+	QemuStatic       string `yaml:"qemu-static"`
+	Proxy            string
+	Tool             string
+	Retries          int
+	RetryDelay       string `yaml:"retry-delay"`
+	retryDelay       time.Duration
+	mirrors          []string
+}
+
+// mirrorList is a list of mirrors, a single mirror being accepted as well
+type mirrorList []string
+
+func (m *mirrorList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var mirror string
+	if err := unmarshal(&mirror); err == nil {
+		*m = mirrorList{mirror}
+		return nil
+	}
+
+	var mirrors []string
+	if err := unmarshal(&mirrors); err != nil {
+		return err
+	}
+	*m = mirrors
+	return nil
+}
+
+// shuffleMirrors randomizes the order of the mirrors in place
+func shuffleMirrors(mirrors []string) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	r.Shuffle(len(mirrors), func(i, j int) {
+		mirrors[i], mirrors[j] = mirrors[j], mirrors[i]
+	})
+}
+
+func (d *DebootstrapAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawDebootstrapAction DebootstrapAction
+	raw := struct {
+		rawDebootstrapAction `yaml:",inline"`
+		Mirrors              mirrorList `yaml:"mirror"`
+	}{rawDebootstrapAction: rawDebootstrapAction(*d)}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*d = DebootstrapAction(raw.rawDebootstrapAction)
+	if len(raw.Mirrors) > 0 {
+		d.Mirror = raw.Mirrors[0]
+		d.mirrors = raw.Mirrors
+	}
+	return nil
+}
+
+// Variants known by debootstrap
+var debootstrapVariants = []string{"minbase", "buildd", "fakechroot"}
+
+// Variants known by the other bootstrap tools
+var bootstrapToolVariants = map[string][]string{
+	"debootstrap":  debootstrapVariants,
+	"mmdebstrap":   {"minbase", "buildd", "essential", "apt", "required", "important", "standard"},
+	"cdebootstrap": {"minbase", "buildd"},
 }
 
 func NewDebootstrapAction() *DebootstrapAction {
@@ -84,6 +204,8 @@ func NewDebootstrapAction() *DebootstrapAction {
 	d.Components = []string{"main"}
 	// Set generic default mirror
 	d.Mirror = "http://deb.debian.org/debian"
+	d.mirrors = []string{d.Mirror}
+	d.Tool = "debootstrap"
 
 	return &d
 }
@@ -108,7 +230,86 @@ func (d *DebootstrapAction) listOptionFiles(context *debos.DebosContext) []strin
 	return files
 }
 
+// localMirror returns the directory of a local mirror, empty for remote ones
+func localMirror(mirror string) string {
+	if strings.HasPrefix(mirror, "file://") {
+		return strings.TrimPrefix(mirror, "file://")
+	}
+	if path.IsAbs(mirror) {
+		return mirror
+	}
+	return ""
+}
+
+// checkMirror makes sure the mirror provides the suite
+func (d *DebootstrapAction) checkMirror(mirror string) error {
+	if dir := localMirror(mirror); dir != "" {
+		release := path.Join(dir, "dists", d.Suite)
+		if _, err := os.Stat(release); err != nil {
+			return fmt.Errorf("Suite %s not found in mirror: %v", d.Suite, err)
+		}
+		return nil
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if d.Proxy != "" {
+		proxy, err := url.Parse(d.Proxy)
+		if err != nil {
+			return fmt.Errorf("Invalid proxy %s: %v", d.Proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	client := &http.Client{Transport: transport, Timeout: 30 * time.Second}
+
+	release := fmt.Sprintf("%s/dists/%s/Release", strings.TrimSuffix(mirror, "/"), d.Suite)
+	resp, err := client.Head(release)
+	if err != nil {
+		return fmt.Errorf("Mirror %s is not reachable: %v", mirror, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Suite %s not found in mirror %s: %s", d.Suite, mirror, resp.Status)
+	}
+
+	return nil
+}
+
 func (d *DebootstrapAction) Verify(context *debos.DebosContext) error {
+	variants, found := bootstrapToolVariants[d.Tool]
+	if !found {
+		return fmt.Errorf("Unknown bootstrap tool '%s', use one of debootstrap, mmdebstrap or cdebootstrap", d.Tool)
+	}
+	if err := debos.CheckBinaries(d.Tool); err != nil {
+		return err
+	}
+
+	if d.Variant != "" {
+		known := false
+		for _, v := range variants {
+			if d.Variant == v {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("Unknown %s variant '%s'. Possible variants are %s.",
+				d.Tool, d.Variant, strings.Join(variants, ", "))
+		}
+	}
+
+	if d.Tool != "debootstrap" && (d.Certificate != "" || d.PrivateKey != "") {
+		return fmt.Errorf("'certificate' and 'private-key' are only supported by debootstrap")
+	}
+
+	if d.Tool == "cdebootstrap" {
+		if len(d.Components) != 1 || d.Components[0] != "main" {
+			return fmt.Errorf("cdebootstrap only supports the 'main' component")
+		}
+		if debos.ForeignArchitecture(context.Architecture) {
+			return fmt.Errorf("cdebootstrap doesn't support foreign architectures")
+		}
+	}
+
 	files := d.listOptionFiles(context)
 
 	// Check if all needed files exists
@@ -117,9 +318,71 @@ func (d *DebootstrapAction) Verify(context *debos.DebosContext) error {
 			return err
 		}
 	}
+
+	if d.QemuStatic != "" {
+		d.QemuStatic = debos.CleanPathAt(d.QemuStatic, context.RecipeDir)
+		if _, err := os.Stat(d.QemuStatic); os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if d.Proxy != "" {
+		if u, err := url.Parse(d.Proxy); err != nil || u.Host == "" {
+			return fmt.Errorf("Invalid proxy URL '%s'", d.Proxy)
+		}
+	}
+
+	if d.Retries < 0 {
+		return fmt.Errorf("Invalid number of retries %d", d.Retries)
+	}
+	var err error
+	if d.retryDelay, err = debos.ParseRetryDelay(d.RetryDelay); err != nil {
+		return err
+	}
+
+	if len(d.mirrors) == 0 {
+		d.mirrors = []string{d.Mirror}
+	}
+	if d.ShuffleMirrors {
+		shuffleMirrors(d.mirrors)
+	}
+
+	// Only keep the mirrors providing the suite, but at least one is needed
+	var mirrors []string
+	var mirrorErr error
+	for _, mirror := range d.mirrors {
+		if dir := localMirror(mirror); dir != "" {
+			mirror = "file://" + path.Clean(dir)
+		}
+		if err := d.checkMirror(mirror); err != nil {
+			if len(d.mirrors) > 1 {
+				debos.Warnf("Skipping mirror %s: %v\n", mirror, err)
+			}
+			if mirrorErr == nil {
+				mirrorErr = err
+			}
+			continue
+		}
+		mirrors = append(mirrors, mirror)
+	}
+	if len(mirrors) == 0 {
+		return mirrorErr
+	}
+	d.mirrors = mirrors
+	d.Mirror = mirrors[0]
+
 	return nil
 }
 
+func (d *DebootstrapAction) Summary() string {
+	summary := fmt.Sprintf("Bootstrap %s (%s) from %s", d.Suite,
+		strings.Join(d.Components, ", "), d.Mirror)
+	if len(d.mirrors) > 1 {
+		summary += fmt.Sprintf(" (%d fallback mirrors)", len(d.mirrors)-1)
+	}
+	return summary
+}
+
 func (d *DebootstrapAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
 
 	mounts := d.listOptionFiles(context)
@@ -129,6 +392,17 @@ func (d *DebootstrapAction) PreMachine(context *debos.DebosContext, m *fakemachi
 		m.AddVolume(path.Dir(mount))
 	}
 
+	for _, mirror := range d.mirrors {
+		if dir := localMirror(mirror); dir != "" {
+			m.AddVolume(dir)
+		}
+	}
+
+	// /usr is always available in the fakemachine
+	if d.QemuStatic != "" && !strings.HasPrefix(d.QemuStatic, "/usr/") {
+		m.AddVolume(path.Dir(d.QemuStatic))
+	}
+
 	return nil
 }
 
@@ -146,6 +420,7 @@ func (d *DebootstrapAction) RunSecondStage(context debos.DebosContext) error {
 	c := debos.NewChrootCommandForContext(context)
 	// Can't use nspawn for debootstrap as it wants to create device nodes
 	c.ChrootMethod = debos.CHROOT_METHOD_CHROOT
+	c.QemuStatic = d.QemuStatic
 
 	err := c.Run("Debootstrap (stage 2)", cmdline...)
 
@@ -157,8 +432,8 @@ func (d *DebootstrapAction) RunSecondStage(context debos.DebosContext) error {
 	return err
 }
 
-func (d *DebootstrapAction) Run(context *debos.DebosContext) error {
-	d.LogStart()
+// debootstrapCmdline returns the debootstrap command line, and whether a second stage is needed
+func (d *DebootstrapAction) debootstrapCmdline(context *debos.DebosContext) ([]string, bool) {
 	cmdline := []string{"debootstrap"}
 
 	if d.MergedUsr {
@@ -190,13 +465,15 @@ func (d *DebootstrapAction) Run(context *debos.DebosContext) error {
 		cmdline = append(cmdline, fmt.Sprintf("--components=%s", s))
 	}
 
-	/* FIXME drop the hardcoded amd64 assumption" */
-	foreign := context.Architecture != "amd64"
+	foreign := debos.ForeignArchitecture(context.Architecture)
 
 	if foreign {
 		cmdline = append(cmdline, "--foreign")
-		cmdline = append(cmdline, fmt.Sprintf("--arch=%s", context.Architecture))
+	}
 
+	// Compatible architectures, e.g. i386 on amd64, are bootstrapped natively
+	if context.Architecture != debos.HostArchitecture() {
+		cmdline = append(cmdline, fmt.Sprintf("--arch=%s", context.Architecture))
 	}
 
 	if d.Variant != "" {
@@ -208,15 +485,164 @@ func (d *DebootstrapAction) Run(context *debos.DebosContext) error {
 	cmdline = append(cmdline, d.Mirror)
 	cmdline = append(cmdline, "/usr/share/debootstrap/scripts/unstable")
 
-	err := debos.Command{}.Run("Debootstrap", cmdline...)
+	return cmdline, foreign
+}
+
+/* mmdebstrapCmdline returns the mmdebstrap command line, foreign architectures
+ * being handled by mmdebstrap itself */
+func (d *DebootstrapAction) mmdebstrapCmdline(context *debos.DebosContext) []string {
+	cmdline := []string{"mmdebstrap", "--mode=root"}
+
+	hooks := "/usr/share/mmdebstrap/hooks/no-merged-usr"
+	if d.MergedUsr {
+		hooks = "/usr/share/mmdebstrap/hooks/merged-usr"
+	}
+	cmdline = append(cmdline, fmt.Sprintf("--hook-dir=%s", hooks))
+
+	if !d.CheckGpg {
+		cmdline = append(cmdline, `--aptopt=Acquire::AllowInsecureRepositories "true"`)
+		cmdline = append(cmdline, `--aptopt=APT::Get::AllowUnauthenticated "true"`)
+	} else if d.KeyringFile != "" {
+		cmdline = append(cmdline, fmt.Sprintf("--keyring=%s", d.KeyringFile))
+	}
+
+	if d.KeyringPackage != "" {
+		cmdline = append(cmdline, fmt.Sprintf("--include=%s", d.KeyringPackage))
+	}
+
+	if d.Components != nil {
+		cmdline = append(cmdline, fmt.Sprintf("--components=%s", strings.Join(d.Components, ",")))
+	}
+
+	cmdline = append(cmdline, fmt.Sprintf("--architectures=%s", context.Architecture))
+
+	if d.Variant != "" {
+		cmdline = append(cmdline, fmt.Sprintf("--variant=%s", d.Variant))
+	}
+
+	return append(cmdline, d.Suite, context.Rootdir, d.Mirror)
+}
+
+// cdebootstrapCmdline returns the cdebootstrap command line
+func (d *DebootstrapAction) cdebootstrapCmdline(context *debos.DebosContext) []string {
+	cmdline := []string{"cdebootstrap", fmt.Sprintf("--arch=%s", context.Architecture)}
+
+	if !d.CheckGpg {
+		cmdline = append(cmdline, "--allow-unauthenticated")
+	} else if d.KeyringFile != "" {
+		cmdline = append(cmdline, fmt.Sprintf("--keyring=%s", d.KeyringFile))
+	}
 
+	if d.KeyringPackage != "" {
+		cmdline = append(cmdline, fmt.Sprintf("--include=%s", d.KeyringPackage))
+	}
+
+	switch d.Variant {
+	case "minbase":
+		cmdline = append(cmdline, "--flavour=minimal")
+	case "buildd":
+		cmdline = append(cmdline, "--flavour=build")
+	}
+
+	return append(cmdline, d.Suite, context.Rootdir, d.Mirror)
+}
+
+// isEmptyDir tells whether dir has no entries, a missing dir being empty
+func isEmptyDir(dir string) (bool, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	return len(entries) == 0, err
+}
+
+// removeDirContent removes all the entries of dir, keeping dir itself
+func removeDirContent(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
 	if err != nil {
-		log := path.Join(context.Rootdir, "debootstrap/debootstrap.log")
-		_ = debos.Command{}.Run("debootstrap.log", "cat", log)
 		return err
 	}
+	for _, e := range entries {
+		if err := os.RemoveAll(path.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if foreign {
+// cmdline returns the command line of the tool, and whether a second stage is needed
+func (d *DebootstrapAction) cmdline(context *debos.DebosContext) ([]string, bool) {
+	switch d.Tool {
+	case "mmdebstrap":
+		return d.mmdebstrapCmdline(context), false
+	case "cdebootstrap":
+		return d.cdebootstrapCmdline(context), false
+	default:
+		return d.debootstrapCmdline(context)
+	}
+}
+
+func (d *DebootstrapAction) Run(context *debos.DebosContext) error {
+	d.LogStart()
+
+	cmd := debos.Command{}
+	if d.Proxy != "" {
+		cmd.AddEnvKey("http_proxy", d.Proxy)
+		cmd.AddEnvKey("https_proxy", d.Proxy)
+	}
+
+	mirrors := d.mirrors
+	if len(mirrors) == 0 {
+		mirrors = []string{d.Mirror}
+	}
+
+	// Starting over, with the same mirror or the next one, needs an empty rootfs
+	retries := d.Retries
+	if retries > 0 || len(mirrors) > 1 {
+		if empty, err := isEmptyDir(context.Rootdir); err != nil || !empty {
+			debos.Warnf("Not retrying the bootstrap as %s isn't empty\n", context.Rootdir)
+			retries = 0
+			mirrors = mirrors[:1]
+		}
+	}
+
+	var err error
+	var secondStage bool
+	attempt := 0
+	for idx, mirror := range mirrors {
+		if idx > 0 {
+			debos.Warnf("Bootstrap from %s failed, falling back to %s\n", d.Mirror, mirror)
+		}
+		d.Mirror = mirror
+
+		var cmdline []string
+		cmdline, secondStage = d.cmdline(context)
+		err = debos.Retry("Debootstrap", retries, d.retryDelay, func() error {
+			if attempt++; attempt > 1 {
+				// Start over from an empty rootfs
+				if err := removeDirContent(context.Rootdir); err != nil {
+					return err
+				}
+			}
+
+			err := cmd.Run("Debootstrap", cmdline...)
+			if err != nil && d.Tool == "debootstrap" {
+				log := path.Join(context.Rootdir, "debootstrap/debootstrap.log")
+				_ = debos.Command{}.Run("debootstrap.log", "cat", log)
+			}
+			return err
+		})
+		if err == nil {
+			// The apt actions fall back to the other mirrors, the failed ones last
+			context.BootstrapMirrors = append(append([]string{}, mirrors[idx:]...), mirrors[:idx]...)
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if secondStage {
 		err = d.RunSecondStage(*context)
 		if err != nil {
 			return err
@@ -2,6 +2,7 @@
 Download Action
 
 Download a single file from Internet and unpack it in place if needed.
+Files can also be fetched from the local filesystem using 'file://' URLs.
 
 Yaml syntax:
  - action: download
@@ -10,10 +11,14 @@ Yaml syntax:
    filename: output_name
    unpack: bool
    compression: gz
+   sha256: checksum
 
 Mandatory properties:
 
-- url -- URL to an object for download
+- url -- URL to an object for download. The 'http', 'https' and 'file'
+schemes are supported. Paths of 'file' URLs are relative to the recipe
+directory unless absolute, e.g. 'file:///srv/firmware.bin' or
+'file:firmware.bin'.
 
 - name -- string which allow to use downloaded object in other actions
 via 'origin' property. If 'unpack' property is set to 'true' name will
@@ -29,14 +34,23 @@ See the 'Unpack' action for more information.
 
 - compression -- optional hint for unpack allowing to use proper compression method.
 See the 'Unpack' action for more information.
+
+- sha256 -- expected SHA256 checksum of the downloaded file in hexadecimal form.
+The action fails if the checksum of the downloaded file doesn't match.
 */
 package actions
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+	"io"
 	"net/url"
+	"os"
 	"path"
+	"strings"
 )
 
 type DownloadAction struct {
@@ -46,6 +60,7 @@ type DownloadAction struct {
 	Unpack           bool   // Unpack downloaded file to directory dedicated for download
 	Compression      string // compression type
 	Name             string // exporting path to file or directory(in case of unpack)
+	Sha256           string // expected checksum of the downloaded file
 }
 
 // validateUrl checks if supported URL is passed from recipe
@@ -60,7 +75,7 @@ func (d *DownloadAction) validateUrl() (*url.URL, error) {
 	}
 
 	switch url.Scheme {
-	case "http", "https":
+	case "http", "https", "file":
 		// Supported scheme
 	default:
 		return url, fmt.Errorf("Unsupported URL is provided: '%s'", url.String())
@@ -69,6 +84,15 @@ func (d *DownloadAction) validateUrl() (*url.URL, error) {
 	return url, nil
 }
 
+// localPath returns the path of the file referenced by a 'file' URL
+func (d *DownloadAction) localPath(context *debos.DebosContext, url *url.URL) string {
+	p := url.Path
+	if len(url.Opaque) > 0 {
+		p = url.Opaque
+	}
+	return debos.CleanPathAt(p, context.RecipeDir)
+}
+
 func (d *DownloadAction) validateFilename(context *debos.DebosContext, url *url.URL) (filename string, err error) {
 	if len(d.Filename) == 0 {
 		// Trying to guess the name from URL Path
@@ -76,7 +100,7 @@ func (d *DownloadAction) validateFilename(context *debos.DebosContext, url *url.
 	} else {
 		filename = path.Base(d.Filename)
 	}
-	if len(filename) == 0 {
+	if len(filename) == 0 || filename == "." || filename == "/" {
 		return "", fmt.Errorf("Incorrect filename is provided for '%s'", d.Url)
 	}
 	filename = path.Join(context.Scratchdir, filename)
@@ -100,6 +124,26 @@ func (d *DownloadAction) archive(filename string) (debos.Archive, error) {
 	return archive, nil
 }
 
+func (d *DownloadAction) checkSha256(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if sum != strings.ToLower(d.Sha256) {
+		return fmt.Errorf("Checksum mismatch for '%s': expected %s, got %s", d.Url, d.Sha256, sum)
+	}
+
+	return nil
+}
+
 func (d *DownloadAction) Verify(context *debos.DebosContext) error {
 	var filename string
 
@@ -111,6 +155,16 @@ func (d *DownloadAction) Verify(context *debos.DebosContext) error {
 	if err != nil {
 		return err
 	}
+	if url.Scheme == "file" {
+		if _, err := os.Stat(d.localPath(context, url)); err != nil {
+			return err
+		}
+	}
+	if len(d.Sha256) > 0 {
+		if _, err := hex.DecodeString(d.Sha256); err != nil || len(d.Sha256) != 2*sha256.Size {
+			return fmt.Errorf("Incorrect sha256 checksum '%s'", d.Sha256)
+		}
+	}
 	filename, err = d.validateFilename(context, url)
 	if err != nil {
 		return err
@@ -123,6 +177,24 @@ func (d *DownloadAction) Verify(context *debos.DebosContext) error {
 	return nil
 }
 
+func (d *DownloadAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	url, err := d.validateUrl()
+	if err != nil {
+		return err
+	}
+
+	// Local files outside of the recipe directory need to be mounted
+	if url.Scheme == "file" {
+		m.AddVolume(path.Dir(d.localPath(context, url)))
+	}
+
+	return nil
+}
+
+func (d *DownloadAction) Summary() string {
+	return fmt.Sprintf("Download %s as '%s'", d.Url, d.Name)
+}
+
 func (d *DownloadAction) Run(context *debos.DebosContext) error {
 	var filename string
 	d.LogStart()
@@ -144,10 +216,22 @@ func (d *DownloadAction) Run(context *debos.DebosContext) error {
 		if err != nil {
 			return err
 		}
+	case "file":
+		err := debos.CopyFile(d.localPath(context, url), filename, 0644)
+		if err != nil {
+			return err
+		}
 	default:
 		return fmt.Errorf("Unsupported URL is provided: '%s'", url.String())
 	}
 
+	if len(d.Sha256) > 0 {
+		if err := d.checkSha256(filename); err != nil {
+			os.Remove(filename)
+			return err
+		}
+	}
+
 	if d.Unpack == true {
 		archive, err := d.archive(filename)
 		if err != nil {
@@ -164,5 +248,14 @@ func (d *DownloadAction) Run(context *debos.DebosContext) error {
 
 	context.Origins[d.Name] = originPath
 
-	return nil
+	kind := "file"
+	if d.Unpack {
+		kind = "archive"
+	}
+	return debos.RecordFile(debos.FileRecord{
+		Action:      "download",
+		Source:      url.String(),
+		Destination: originPath,
+		Type:        kind,
+	})
 }
@@ -14,16 +14,66 @@ Yaml syntax:
    setup-fstab: bool
    setup-kernel-cmdline: bool
    append-kernel-cmdline: arguments
+   kernel-root: uuid
+   kernel-root-device: device
+   kernel-root-file: path
+   fstab:
+     - fstab entry
+   mountoptions:
+     mountpoint or filesystem: options
+   passno:
+     mountpoint: number
 
 Optional properties:
 
 - setup-fstab -- generate '/etc/fstab' file according to information provided
-by 'image-partition' action. By default is 'true'.
+by 'image-partition' action, as well as '/etc/crypttab' if any partition is
+encrypted. Encrypted partitions and LVM logical volumes are referenced by their
+device mapper path, other partitions by filesystem UUID. By default is 'true'.
 
 - setup-kernel-cmdline -- add location of root partition to '/etc/kernel/cmdline'
 file on target image. By default is 'true'.
 
 - append-kernel-cmdline -- additional kernel command line arguments passed to kernel.
+
+- kernel-root -- how the root partition is referenced in the 'root=' kernel
+argument, one of:
+ uuid -- by filesystem UUID, i.e. 'root=UUID=...' (default)
+ partuuid -- by partition UUID, i.e. 'root=PARTUUID=...', which doesn't need an
+ initramfs to be resolved
+ label -- by filesystem label, i.e. 'root=LABEL=...'
+ dev -- by device path given by 'kernel-root-device'
+The 'root=' argument is also used by the 'ostree-deploy' action.
+
+- kernel-root-device -- device path of the root partition on the target, e.g.
+'/dev/mmcblk0p2'. Mandatory if 'kernel-root' is 'dev'.
+
+- kernel-root-file -- path of a file in the image, e.g. '/boot/cmdline.txt' or
+'/boot/extlinux/extlinux.conf', in which each occurrence of '@KERNEL_ROOT@' is
+replaced by the 'root=' kernel argument(s). Useful for bootloaders not using
+'/etc/kernel/cmdline'.
+
+- fstab -- list of additional entries, in fstab(5) format, appended to the
+'/etc/fstab' file generated from the 'image-partition' action. Useful for
+entries not related to the partitions of the image, for example:
+ fstab:
+   - tmpfs /tmp tmpfs defaults,nosuid,nodev 0 0
+   - LABEL=data /data ext4 defaults,nofail 0 2
+Each mountpoint can only be used once, including the mountpoints of the
+'image-partition' action.
+
+- mountoptions -- mount options replacing 'defaults' in the '/etc/fstab'
+entries generated from the 'image-partition' action, keyed by mountpoint or by
+filesystem type. An entry for the mountpoint takes precedence over the one for
+its filesystem type. The options of the mountpoints given to 'image-partition'
+are kept. For instance, for SD cards:
+ mountoptions:
+   /: noatime,commit=600
+   vfat: noatime,umask=0077
+
+- passno -- fsck order (sixth fstab field) of the generated entries, keyed by
+mountpoint, overriding the one derived from the 'fsck' property of the
+partitions. 0 disables the check at boot.
 */
 package actions
 
@@ -32,9 +82,10 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"os/exec"
 	"path"
+	"strconv"
 	"strings"
 
 	"github.com/go-debos/debos"
@@ -42,24 +93,133 @@ import (
 
 type FilesystemDeployAction struct {
 	debos.BaseAction    `yaml:",inline"`
-	SetupFSTab          bool   `yaml:"setup-fstab"`
-	SetupKernelCmdline  bool   `yaml:"setup-kernel-cmdline"`
-	AppendKernelCmdline string `yaml:"append-kernel-cmdline"`
+	SetupFSTab          bool     `yaml:"setup-fstab"`
+	SetupKernelCmdline  bool     `yaml:"setup-kernel-cmdline"`
+	AppendKernelCmdline string   `yaml:"append-kernel-cmdline"`
+	FSTab               []string `yaml:"fstab"`
+	KernelRoot          string   `yaml:"kernel-root"`
+	KernelRootDevice    string   `yaml:"kernel-root-device"`
+	KernelRootFile      string   `yaml:"kernel-root-file"`
+	MountOptions        map[string]string
+	PassNo              map[string]int
 }
 
 func NewFilesystemDeployAction() *FilesystemDeployAction {
-	fd := &FilesystemDeployAction{SetupFSTab: true, SetupKernelCmdline: true}
+	fd := &FilesystemDeployAction{SetupFSTab: true, SetupKernelCmdline: true, KernelRoot: "uuid"}
 	fd.Description = "Deploying filesystem"
 
 	return fd
 }
 
+// fstabMountpoint returns the mountpoint (second field) of an fstab entry
+func fstabMountpoint(entry string) string {
+	fields := strings.Fields(entry)
+	if len(fields) < 2 {
+		return ""
+	}
+	return fields[1]
+}
+
+func (fd *FilesystemDeployAction) Verify(context *debos.DebosContext) error {
+	mountpoints := make(map[string]bool)
+	for _, entry := range fd.FSTab {
+		fields := strings.Fields(entry)
+		if len(fields) < 4 || len(fields) > 6 {
+			return fmt.Errorf("Invalid fstab entry '%s'", entry)
+		}
+		if fields[1] != "none" && fields[1] != "swap" {
+			if mountpoints[fields[1]] {
+				return fmt.Errorf("Mountpoint %s already exists in fstab", fields[1])
+			}
+			mountpoints[fields[1]] = true
+		}
+	}
+
+	if len(fd.FSTab) > 0 && !fd.SetupFSTab {
+		return errors.New("'fstab' entries require 'setup-fstab' to be enabled")
+	}
+
+	for key, options := range fd.MountOptions {
+		if key == "" || strings.TrimSpace(options) == "" || strings.ContainsAny(options, " \t") {
+			return fmt.Errorf("Invalid mount options '%s' for '%s'", options, key)
+		}
+	}
+	for mountpoint, passno := range fd.PassNo {
+		if !path.IsAbs(mountpoint) || passno < 0 {
+			return fmt.Errorf("Invalid passno %d for '%s'", passno, mountpoint)
+		}
+	}
+	if (len(fd.MountOptions) > 0 || len(fd.PassNo) > 0) && !fd.SetupFSTab {
+		return errors.New("'mountoptions' and 'passno' require 'setup-fstab' to be enabled")
+	}
+
+	switch fd.KernelRoot {
+	case "uuid", "partuuid", "label":
+		if fd.KernelRootDevice != "" {
+			return errors.New("'kernel-root-device' requires 'kernel-root' to be 'dev'")
+		}
+	case "dev":
+		if !path.IsAbs(fd.KernelRootDevice) {
+			return errors.New("'kernel-root' dev requires an absolute 'kernel-root-device'")
+		}
+	default:
+		return fmt.Errorf("Unsupported kernel-root '%s'", fd.KernelRoot)
+	}
+
+	return nil
+}
+
+/* customizeFSTab applies the mount options and passno overrides to the
+ * generated fstab entries */
+func (fd *FilesystemDeployAction) customizeFSTab(fstab string) string {
+	var out strings.Builder
+
+	for _, line := range strings.SplitAfter(fstab, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 6 {
+			out.WriteString(line)
+			continue
+		}
+		mountpoint, fstype := fields[1], fields[2]
+
+		options, found := fd.MountOptions[mountpoint]
+		if !found {
+			options, found = fd.MountOptions[fstype]
+		}
+		if found {
+			opts := strings.Split(fields[3], ",")
+			if opts[0] == "defaults" {
+				opts = opts[1:]
+			}
+			fields[3] = strings.Join(append([]string{options}, opts...), ",")
+		}
+
+		if passno, found := fd.PassNo[mountpoint]; found {
+			fields[5] = strconv.Itoa(passno)
+		}
+
+		out.WriteString(strings.Join(fields, "\t") + "\n")
+	}
+
+	return out.String()
+}
+
 func (fd *FilesystemDeployAction) setupFSTab(context *debos.DebosContext) error {
 	if context.ImageFSTab.Len() == 0 {
 		return errors.New("Fstab not generated, missing image-partition action?")
 	}
 
-	log.Print("Setting up fstab")
+	// Check the additional entries don't clash with the generated ones
+	for _, line := range strings.Split(context.ImageFSTab.String(), "\n") {
+		mountpoint := fstabMountpoint(line)
+		for _, entry := range fd.FSTab {
+			if mountpoint != "" && mountpoint == fstabMountpoint(entry) {
+				return fmt.Errorf("Mountpoint %s already exists in fstab", mountpoint)
+			}
+		}
+	}
+
+	debos.Infof("Setting up fstab")
 
 	err := os.MkdirAll(path.Join(context.Rootdir, "etc"), 0755)
 	if err != nil {
@@ -73,20 +233,93 @@ func (fd *FilesystemDeployAction) setupFSTab(context *debos.DebosContext) error
 		return fmt.Errorf("Couldn't open fstab: %v", err)
 	}
 
-	_, err = io.Copy(f, &context.ImageFSTab)
+	_, err = io.WriteString(f, fd.customizeFSTab(context.ImageFSTab.String()))
 
 	if err != nil {
 		return fmt.Errorf("Couldn't write fstab: %v", err)
 	}
+
+	for _, entry := range fd.FSTab {
+		_, err = f.WriteString(entry + "\n")
+		if err != nil {
+			return fmt.Errorf("Couldn't write fstab: %v", err)
+		}
+	}
 	f.Close()
 
+	if context.ImageCryptTab.Len() > 0 {
+		debos.Infof("Setting up crypttab")
+
+		crypttab := path.Join(context.Rootdir, "etc/crypttab")
+		err = ioutil.WriteFile(crypttab, context.ImageCryptTab.Bytes(), 0644)
+		if err != nil {
+			return fmt.Errorf("Couldn't write crypttab: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// setupKernelRoot references the root partition in the kernel root= argument
+// as requested, keeping any other argument like rootflags
+func (fd *FilesystemDeployAction) setupKernelRoot(context *debos.DebosContext) error {
+	// The image-partition action references the root by UUID already
+	if fd.KernelRoot == "uuid" {
+		return nil
+	}
+
+	args := strings.Fields(context.ImageKernelRoot)
+	if len(args) == 0 {
+		return errors.New("Kernel root not generated, missing image-partition action?")
+	}
+
+	var tag string
+	switch fd.KernelRoot {
+	case "dev":
+		args[0] = "root=" + fd.KernelRootDevice
+	case "partuuid":
+		tag = "PARTUUID"
+	case "label":
+		tag = "LABEL"
+	}
+
+	if tag != "" {
+		value, err := exec.Command("blkid", "-o", "value", "-s", tag, "-p", "-c", "none",
+			context.ImageRootDevice).Output()
+		if err != nil || len(strings.TrimSpace(string(value))) == 0 {
+			return fmt.Errorf("Failed to get %s of root device %s", tag, context.ImageRootDevice)
+		}
+		args[0] = fmt.Sprintf("root=%s=%s", tag, strings.TrimSpace(string(value)))
+	}
+
+	context.ImageKernelRoot = strings.Join(args, " ")
+	debos.Infof("Kernel root: %s", context.ImageKernelRoot)
+
+	return nil
+}
+
+func (fd *FilesystemDeployAction) setupKernelRootFile(context *debos.DebosContext) error {
+	file := path.Join(context.Rootdir, fd.KernelRootFile)
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Couldn't read %s: %v", fd.KernelRootFile, err)
+	}
+
+	content = []byte(strings.Replace(string(content), "@KERNEL_ROOT@", context.ImageKernelRoot, -1))
+
+	err = ioutil.WriteFile(file, content, 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't write %s: %v", fd.KernelRootFile, err)
+	}
+
 	return nil
 }
 
 func (fd *FilesystemDeployAction) setupKernelCmdline(context *debos.DebosContext) error {
 	var cmdline []string
 
-	log.Print("Setting up /etc/kernel/cmdline")
+	debos.Infof("Setting up /etc/kernel/cmdline")
 
 	err := os.MkdirAll(path.Join(context.Rootdir, "etc", "kernel"), 0755)
 	if err != nil {
@@ -97,7 +330,7 @@ func (fd *FilesystemDeployAction) setupKernelCmdline(context *debos.DebosContext
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0755)
 
 	if err != nil {
-		log.Fatalf("Couldn't open kernel cmdline: %v", err)
+		return fmt.Errorf("Couldn't open kernel cmdline: %v", err)
 	}
 
 	cmdline = append(cmdline, strings.TrimSpace(string(current)))
@@ -116,6 +349,11 @@ func (fd *FilesystemDeployAction) setupKernelCmdline(context *debos.DebosContext
 	return nil
 }
 
+func (fd *FilesystemDeployAction) Summary() string {
+	return fmt.Sprintf("Deploy rootfs to image (fstab: %t, kernel cmdline: %t, kernel root: %s)",
+		fd.SetupFSTab, fd.SetupKernelCmdline, fd.KernelRoot)
+}
+
 func (fd *FilesystemDeployAction) Run(context *debos.DebosContext) error {
 	fd.LogStart()
 	/* Copying files is actually silly hafd, one has to keep permissions, ACL's
@@ -125,6 +363,12 @@ func (fd *FilesystemDeployAction) Run(context *debos.DebosContext) error {
 	if err != nil {
 		return fmt.Errorf("rootfs deploy failed: %v", err)
 	}
+
+	// Write back the deployed files right away, so a failure shows up here
+	debos.Debugf("Syncing %s\n", context.ImageMntDir)
+	if err := debos.SyncFilesystem(context.ImageMntDir); err != nil {
+		return fmt.Errorf("rootfs deploy failed: %v", err)
+	}
 	context.Rootdir = context.ImageMntDir
 	context.Origins["filesystem"] = context.ImageMntDir
 
@@ -134,6 +378,16 @@ func (fd *FilesystemDeployAction) Run(context *debos.DebosContext) error {
 			return err
 		}
 	}
+	err = fd.setupKernelRoot(context)
+	if err != nil {
+		return err
+	}
+	if fd.KernelRootFile != "" {
+		err = fd.setupKernelRootFile(context)
+		if err != nil {
+			return err
+		}
+	}
 	if fd.SetupKernelCmdline {
 		err = fd.setupKernelCmdline(context)
 		if err != nil {
@@ -0,0 +1,185 @@
+/*
+Grub Action
+
+Install the GRUB bootloader into the image, making it directly bootable. This
+action has to run after the 'filesystem-deploy' action, and the GRUB packages
+for the target platform (e.g. 'grub-efi-amd64-bin' or 'grub-pc-bin') need to be
+installed in the image beforehand.
+
+Yaml syntax:
+ - action: grub
+   target: x86_64-efi
+   partition: EFI
+   efi-directory: /boot/efi
+   config: bool
+
+Mandatory properties:
+
+- target -- GRUB platform to install, one of 'x86_64-efi', 'i386-efi',
+'arm64-efi' or 'i386-pc'.
+
+- partition -- name of the EFI system partition, as defined in the
+'image-partition' action. Mandatory for EFI targets, the partition is mounted on
+'efi-directory' during the installation if it isn't mounted there already.
+For the 'i386-pc' target, GRUB is installed in the boot sector of the image.
+
+Optional properties:
+
+- efi-directory -- mount point of the EFI system partition in the image.
+Defaults to '/boot/efi'.
+
+- config -- if set to `true` '/boot/grub/grub.cfg' is generated using
+grub-mkconfig. By default is 'true'.
+
+EFI targets are installed at the removable media path (e.g.
+'EFI/BOOT/BOOTX64.EFI') without touching the EFI variables of the build host,
+as the image is meant to boot on another machine.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/go-debos/debos"
+)
+
+var grubTargets = []string{"x86_64-efi", "i386-efi", "arm64-efi", "i386-pc"}
+
+type GrubAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Target           string
+	Partition        string
+	EfiDirectory     string `yaml:"efi-directory"`
+	Config           bool
+}
+
+func NewGrubAction() *GrubAction {
+	return &GrubAction{EfiDirectory: "/boot/efi", Config: true}
+}
+
+func (g *GrubAction) isEfi() bool {
+	return strings.HasSuffix(g.Target, "-efi")
+}
+
+func (g *GrubAction) Verify(context *debos.DebosContext) error {
+	supported := false
+	for _, t := range grubTargets {
+		if g.Target == t {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return fmt.Errorf("Unsupported grub target '%s'", g.Target)
+	}
+
+	if g.isEfi() {
+		if len(g.Partition) == 0 {
+			return errors.New("'partition' property is mandatory for EFI targets")
+		}
+		if !path.IsAbs(g.EfiDirectory) {
+			return errors.New("'efi-directory' property must be an absolute path")
+		}
+	}
+
+	return nil
+}
+
+func (g *GrubAction) Summary() string {
+	if g.isEfi() {
+		return fmt.Sprintf("Install grub %s on partition %s", g.Target, g.Partition)
+	}
+	return fmt.Sprintf("Install grub %s on image", g.Target)
+}
+
+// isMountpoint checks if dir is on a different filesystem than its parent
+func isMountpoint(dir string) bool {
+	var st, parent syscall.Stat_t
+
+	if err := syscall.Stat(dir, &st); err != nil {
+		return false
+	}
+	if err := syscall.Stat(path.Dir(dir), &parent); err != nil {
+		return false
+	}
+
+	return st.Dev != parent.Dev
+}
+
+// mountEsp mounts the EFI system partition in the image unless already
+// mounted, returning the path to unmount afterwards
+func (g *GrubAction) mountEsp(context *debos.DebosContext) (string, error) {
+	efidir := path.Join(context.Rootdir, g.EfiDirectory)
+	if isMountpoint(efidir) {
+		return "", nil
+	}
+
+	var devicePath string
+	for _, p := range context.ImagePartitions {
+		if p.Name == g.Partition {
+			devicePath = p.DevicePath
+			break
+		}
+	}
+	if devicePath == "" {
+		return "", fmt.Errorf("Failed to find partition named %s", g.Partition)
+	}
+
+	if err := os.MkdirAll(efidir, 0755); err != nil {
+		return "", err
+	}
+	if err := syscall.Mount(devicePath, efidir, "vfat", 0, ""); err != nil {
+		return "", fmt.Errorf("%s mount failed: %v", g.Partition, err)
+	}
+
+	return efidir, nil
+}
+
+func (g *GrubAction) Run(context *debos.DebosContext) error {
+	g.LogStart()
+
+	if context.Image == "" {
+		return errors.New("No image to install grub to, missing image-partition action?")
+	}
+
+	modules := path.Join(context.Rootdir, "usr/lib/grub", g.Target)
+	if _, err := os.Stat(modules); err != nil {
+		return fmt.Errorf("Grub for %s isn't installed in the image", g.Target)
+	}
+
+	cmdline := []string{"grub-install", "--target=" + g.Target}
+	if g.isEfi() {
+		mounted, err := g.mountEsp(context)
+		if err != nil {
+			return err
+		}
+		if mounted != "" {
+			defer syscall.Unmount(mounted, 0)
+		}
+		cmdline = append(cmdline, "--efi-directory="+g.EfiDirectory,
+			"--removable", "--no-nvram")
+	} else {
+		cmdline = append(cmdline, context.Image)
+	}
+
+	c := debos.NewChrootCommandForContext(*context)
+
+	err := c.Run("grub-install", cmdline...)
+	if err != nil {
+		return err
+	}
+
+	if g.Config {
+		err = c.Run("grub-mkconfig", "grub-mkconfig", "-o", "/boot/grub/grub.cfg")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+Hash Action
+
+Compute checksums of artifacts and write them to a file compatible with the
+'-c' option of sha256sum(1) and friends. The checksums are computed on the
+host after all other actions are done, so any artifact produced by the recipe
+can be listed.
+
+Yaml syntax:
+ - action: hash
+   files:
+     - debian.img
+     - debian.tar.gz
+   output: SHA256SUMS
+   algorithm: sha256
+
+Mandatory properties:
+
+- files -- list of files to compute the checksum of, relative to the artifact
+directory.
+
+- output -- name of the file the checksums are written to, relative to the
+artifact directory.
+
+Optional properties:
+
+- algorithm -- hash algorithm to use, one of 'sha256', 'sha512' or 'md5'.
+Defaults to 'sha256'.
+*/
+package actions
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"md5":    md5.New,
+}
+
+type HashAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Files            []string
+	Output           string
+	Algorithm        string
+}
+
+func NewHashAction() *HashAction {
+	return &HashAction{Algorithm: "sha256"}
+}
+
+func (h *HashAction) Verify(context *debos.DebosContext) error {
+	if len(h.Files) == 0 {
+		return fmt.Errorf("'files' property can't be empty")
+	}
+	if len(h.Output) == 0 {
+		return fmt.Errorf("'output' property can't be empty")
+	}
+	if _, found := hashAlgorithms[h.Algorithm]; !found {
+		return fmt.Errorf("Unsupported hash algorithm %s", h.Algorithm)
+	}
+	return nil
+}
+
+func (h *HashAction) Summary() string {
+	return fmt.Sprintf("Write %s checksums of %s to %s", h.Algorithm,
+		strings.Join(h.Files, ", "), h.Output)
+}
+
+func (h *HashAction) hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := hashAlgorithms[h.Algorithm]()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (h *HashAction) PostMachine(context *debos.DebosContext) error {
+	h.LogStart()
+
+	output, err := os.Create(path.Join(context.Artifactdir, h.Output))
+	if err != nil {
+		return fmt.Errorf("Couldn't open checksum file: %v", err)
+	}
+	defer output.Close()
+
+	for _, file := range h.Files {
+		debos.Infof("Computing %s checksum of %s\n", h.Algorithm, file)
+		sum, err := h.hashFile(path.Join(context.Artifactdir, file))
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(output, "%s  %s\n", sum, file)
+		if err != nil {
+			return fmt.Errorf("Couldn't write checksum file: %v", err)
+		}
+	}
+
+	return nil
+}
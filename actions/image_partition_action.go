@@ -13,16 +13,23 @@ Yaml syntax:
    imagesize: size
    partitiontype: gpt
    gpt_gap: offset
+   alignment: MiB
+   manifest: manifest_name
+   sparse: bool
    partitions:
      <list of partitions>
    mountpoints:
      <list of mount points>
+   volumegroups:
+     <list of LVM volume groups>
 
 Mandatory properties:
 
 - imagename -- the name of the image file, relative to the artifact directory.
 
 - imagesize -- generated image size in human-readable form, examples: 100MB, 1GB, etc.
+The image can be larger than its partitions to leave free space, e.g. for the
+'expand' property or the 'resize' action.
 
 - partitiontype -- partition table type. Currently only 'gpt' and 'msdos'
 partition tables are supported.
@@ -31,12 +38,31 @@ partition tables are supported.
 U-Boot intersects with original GPT placement.
 Only works if parted supports an extra argument to mklabel to specify the gpt offset.
 
+- sparse -- if set to `false` the space of the whole image is allocated on
+disk upfront, failing early when the disk is too small. By default the image is
+a sparse file, only taking the space actually written, which the mkfs tools
+keep as small as possible by discarding the partitions instead of writing zeros.
+
+- manifest -- optional name of a JSON file describing the partitions of the
+image, relative to the artifact directory. It gives the size and sector size of
+the image, and the offset, size, type, UUID, filesystem and filesystem UUID of
+each partition, offsets and sizes being in bytes, e.g. for flashing tools.
+
+- alignment -- optional alignment of the partitions start, in MiB. The start
+of each partition is rounded up to the next multiple of the alignment, for
+instance to match the erase block size of eMMC or SD cards. By default the
+partitions start exactly at the given offsets.
+
 - partitions -- list of partitions, at least one partition is needed.
 Partition properties are described below.
 
 - mountpoints -- list of mount points for partitions.
 Properties for mount points are described below.
 
+- volumegroups -- optional list of LVM volume groups created on the partitions
+with the 'lvm' fs type, holding logical volumes. Properties for volume groups
+are described below.
+
 Yaml syntax for partitions:
 
    partitions:
@@ -45,10 +71,20 @@ Yaml syntax for partitions:
 	   fs: filesystem
 	   start: offset
 	   end: offset
+	   expand: bool
 	   features: list of filesystem features
+	   mkfsoptions: list of options
+	   reserved: percentage
+	   inoderatio: bytes
 	   flags: list of flags
 	   fsck: bool
 	   fsuuid: string
+	   partuuid: string
+	   encrypt: bool
+	   keyfile: path
+	   passphrase: string
+	   subvolumes:
+	     <list of subvolumes>
 
 Mandatory properties:
 
@@ -58,17 +94,29 @@ unique.
 
 - fs -- filesystem type used for formatting.
 
-'none' fs type should be used for partition without filesystem.
+'none' fs type should be used for partition without filesystem, e.g. for raw
+data like a bootloader environment, vendor blobs or A/B slots. Such partitions
+are created in the partition table with their size and 'parttype' but left
+unformatted. They can't be mounted, so they get no entry in '/etc/fstab', and
+can be filled with the 'content' property or the 'raw' action.
+
+'lvm' fs type should be used for a partition initialized as an LVM physical
+volume, which must be part of one of the 'volumegroups'. Its partition type is
+set to the LVM one unless 'parttype' is given.
 
 - start -- offset from beginning of the disk there the partition starts.
 
-- end -- offset from beginning of the disk there the partition ends.
+- end -- offset from beginning of the disk there the partition ends. Not needed
+when 'expand' is set.
 
 For 'start' and 'end' properties offset can be written in human readable
 form -- '32MB', '1GB' or as disk percentage -- '100%'.
 
 Optional properties:
 
+- expand -- if set to `true` the partition grows to fill the remaining space
+of the image. Only allowed for the last partition.
+
 - partlabel -- label for the partition in the GPT partition table. Defaults
 to the `name` property of the partition. May only be used for GPT partitions.
 
@@ -80,9 +128,29 @@ GPT sets the partition type to Linux Swap.
 For msdos partition types hex codes see: https://en.wikipedia.org/wiki/Partition_type
 For gpt partition type GUIDs see: https://systemd.io/DISCOVERABLE_PARTITIONS/
 
+Instead of a code the following well-known types can be used:
+'esp', 'linux', 'lvm' and 'swap' for both partition table types, as well as
+'xbootldr', 'bios-boot', 'home', 'srv', 'var', 'tmp' and 'linux-root' for gpt.
+'linux-root' is the root partition type of the recipe architecture as per the
+Discoverable Partitions Specification, which allows systemd to find the root
+partition automatically.
+
 - features -- list of additional filesystem features which need to be enabled
 for partition.
 
+- mkfsoptions -- list of additional arguments passed as is to the mkfs
+command, which are specific to each filesystem. For instance '[ "-O", "^64bit" ]'
+for ext4 compatibility with older bootloaders.
+
+- reserved -- percentage of the blocks of an ext2, ext3 or ext4 filesystem
+reserved to root, between 0 and 50. mkfs reserves 5% by default, which is a lot
+of wasted space on large read-mostly filesystems, e.g. '0' for an appliance.
+
+- inoderatio -- bytes per inode of an ext2, ext3 or ext4 filesystem, i.e. the
+filesystem gets one inode for this many bytes of its size. Larger values, e.g.
+'65536', waste less space on filesystems holding few large files but limit the
+number of files.
+
 - flags -- list of additional flags for partition compatible with parted(8)
 'set' command.
 
@@ -92,6 +160,87 @@ checks in boot time. By default is set to `true` allowing checks on boot.
 - fsuuid -- file system UUID string. This option is only supported for btrfs,
 ext2, ext3, ext4 and xfs.
 
+- partuuid -- partition UUID string, i.e. the unique partition GUID in the
+partition table. Only supported for GPT partition tables. Together with 'fsuuid'
+this allows reproducible identifiers, which otherwise are randomly generated on
+each build.
+
+- encrypt -- if set to `true` the partition is encrypted with LUKS, and the
+filesystem is created in the encrypted device. Either 'keyfile' or 'passphrase'
+has to be provided to unlock the partition. An entry in '/etc/crypttab' is
+generated by the 'filesystem-deploy' action, the partition being unlocked on
+boot as '/dev/mapper/<name>' which is also used in '/etc/fstab'.
+
+- keyfile -- path to the key file used for an encrypted partition, relative to
+the recipe directory. The key file isn't copied into the image.
+
+- passphrase -- passphrase used for an encrypted partition.
+
+- subvolumes -- list of subvolumes to create in a partition with 'btrfs'
+filesystem, see below.
+
+- content -- file written as is to a partition without filesystem when it is
+created, e.g. a bootloader environment or a firmware image, relative to the
+recipe directory. The file must fit in the partition; if it's smaller the rest
+of the partition is left zeroed.
+
+Yaml syntax for btrfs subvolumes:
+
+   subvolumes:
+     - name: subvolume name
+	   mountpoint: path
+
+Mandatory properties:
+
+- name -- name of the subvolume, created at the top level of the filesystem.
+Must be unique within the partition.
+
+Optional properties:
+
+- mountpoint -- path in the target root filesystem where the subvolume should
+be mounted. A mount point with the 'subvol=' option is added for it, in the same
+way as the ones listed under `mountpoints`. Subvolumes without mountpoint are
+only created.
+
+Yaml syntax for LVM volume groups:
+
+   volumegroups:
+     - name: volume group name
+	   partitions: list of partition names
+	   volumes:
+	     - name: logical volume name
+	       fs: filesystem
+	       size: size
+	       expand: bool
+
+Mandatory properties:
+
+- name -- name of the volume group, which is also the name of the volume group
+in the final system. It must not clash with a volume group of the build host
+when running without fakemachine.
+
+- partitions -- list of the names of the partitions, with the 'lvm' fs type,
+used as physical volumes of the volume group.
+
+- volumes -- list of the logical volumes of the volume group, created in order.
+
+Logical volumes take the same properties as partitions, except the ones
+related to the partition table or encryption: 'start', 'end', 'partlabel',
+'parttype', 'partuuid', 'flags', 'encrypt', 'keyfile', 'passphrase' and
+'content'. Instead of 'start' and 'end' their size is given by:
+
+- size -- size of the logical volume in human-readable form, e.g. '2GB'. It's
+rounded up to the extent size of the volume group.
+
+- expand -- if set to `true` the logical volume fills the remaining space of
+the volume group. Only allowed for the last volume of the group.
+
+The names of the logical volumes share the namespace of the partitions, so they
+can be used as 'partition' of mount points. Logical volumes are referenced in
+'/etc/fstab' and the kernel 'root=' argument by their device mapper path, e.g.
+'/dev/mapper/vg0-root', which needs an initramfs activating the volume group
+for the root filesystem.
+
 Yaml syntax for mount points:
 
    mountpoints:
@@ -141,41 +290,131 @@ Layout example for Raspberry PI 3:
        start: 64MB
        end: 100%
        flags: [ boot ]
+
+Btrfs layout example with subvolumes:
+
+ - action: image-partition
+   imagename: "debian-btrfs.img"
+   imagesize: 4GB
+   partitiontype: gpt
+   mountpoints:
+     - mountpoint: /boot/efi
+       partition: EFI
+   partitions:
+     - name: EFI
+       fs: vfat
+       start: 0%
+       end: 256MB
+       parttype: esp
+     - name: root
+       fs: btrfs
+       start: 256MB
+       end: 100%
+       subvolumes:
+         - name: "@"
+           mountpoint: /
+         - name: "@home"
+           mountpoint: /home
+         - name: "@var"
+           mountpoint: /var
+
+LVM layout example:
+
+ - action: image-partition
+   imagename: "debian-lvm.img"
+   imagesize: 8GB
+   partitiontype: gpt
+   mountpoints:
+     - mountpoint: /
+       partition: root
+     - mountpoint: /boot
+       partition: boot
+     - mountpoint: /var
+       partition: var
+   partitions:
+     - name: boot
+       fs: ext4
+       start: 1MiB
+       end: 512MiB
+     - name: lvm
+       fs: lvm
+       start: 512MiB
+       expand: true
+   volumegroups:
+     - name: vg0
+       partitions: [ lvm ]
+       volumes:
+         - name: root
+           fs: ext4
+           size: 4GB
+         - name: var
+           fs: ext4
+           expand: true
 */
 package actions
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/docker/go-units"
 	"github.com/go-debos/fakemachine"
 	"github.com/google/uuid"
-	"gopkg.in/freddierice/go-losetup.v1"
-	"log"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
-	"time"
 
 	"github.com/go-debos/debos"
 )
 
 type Partition struct {
-	number    int
-	Name      string
-	PartLabel string
-	PartType  string
-	Start     string
-	End       string
-	FS        string
-	Flags     []string
-	Features  []string
-	Fsck      bool "fsck"
-	FSUUID    string
+	number      int
+	Name        string
+	PartLabel   string
+	PartType    string
+	Start       string
+	End         string
+	Size        string // Size of a logical volume instead of start and end
+	Expand      bool
+	FS          string
+	Flags       []string
+	Features    []string
+	MKFSOptions []string
+	Reserved    *int // Percentage of blocks reserved to root, the mkfs default if nil
+	InodeRatio  int  // Bytes per inode, the mkfs default if 0
+	Fsck        bool "fsck"
+	FSUUID      string
+	PartUUID    string
+	Encrypt     bool
+	Keyfile     string
+	Passphrase  string
+	Subvolumes  []Subvolume
+	Content     string
+	cryptName   string // Device mapper name while the partition is opened
+	cryptUUID   string // UUID of the LUKS header
+	size        int64  // Size of a logical volume in bytes
+	volumeGroup string // Volume group of a logical volume
+}
+
+type VolumeGroup struct {
+	Name       string
+	Partitions []string
+	Volumes    []Partition
+	pvs        []*Partition // Physical volumes
+	active     bool         // Whether the volume group is activated
+}
+
+type Subvolume struct {
+	Name       string
+	Mountpoint string
 }
 
 type Mountpoint struct {
@@ -184,6 +423,8 @@ type Mountpoint struct {
 	Options    []string
 	Buildtime  bool
 	part       *Partition
+	subvolume  string
+	mounted    bool
 }
 
 type ImagePartitionAction struct {
@@ -192,11 +433,100 @@ type ImagePartitionAction struct {
 	ImageSize        string
 	PartitionType    string
 	GptGap           string "gpt_gap"
+	Alignment        int
+	Manifest         string
+	Sparse           bool
 	Partitions       []Partition
 	Mountpoints      []Mountpoint
+	VolumeGroups     []VolumeGroup
 	size             int64
-	loopDev          losetup.Device
-	usingLoop        bool
+	loopDev          string // Loop device of the image when not using fakemachine
+}
+
+func NewImagePartitionAction() *ImagePartitionAction {
+	return &ImagePartitionAction{Sparse: true}
+}
+
+// preallocate allocates the space of the whole image file
+func (i ImagePartitionAction) preallocate(imagePath string) error {
+	img, err := os.OpenFile(imagePath, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("Couldn't open image file: %v", err)
+	}
+	defer img.Close()
+
+	if err := syscall.Fallocate(int(img.Fd()), 0, 0, i.size); err != nil {
+		return fmt.Errorf("Couldn't allocate image file: %v", err)
+	}
+
+	return nil
+}
+
+// Well-known partition types per partition table type
+var partitionTypes = map[string]map[string]string{
+	"gpt": {
+		"esp":       "c12a7328-f81f-11d2-ba4b-00a0c93ec93b",
+		"xbootldr":  "bc13c2ff-59e6-4262-a352-b275fd6f7172",
+		"bios-boot": "21686148-6449-6e6f-744e-656564454649",
+		"linux":     "0fc63daf-8483-4772-8e79-3d69d8477de4",
+		"lvm":       "e6d6d379-f507-44c2-a23c-238f2a3df928",
+		"swap":      "0657fd6d-a4ab-43c4-84e5-0933c84b4f4f",
+		"home":      "933ac7e1-2eb4-4f13-b844-0e14e2aef915",
+		"srv":       "3b8f8425-20e0-4f3b-907f-1a25a76f98e8",
+		"var":       "4d21b016-b534-45c2-a9fb-5c16e091fd2d",
+		"tmp":       "7ec6f557-3bc5-4aca-b293-16ef5df639d1",
+	},
+	"msdos": {
+		"esp":   "ef",
+		"linux": "83",
+		"lvm":   "8e",
+		"swap":  "82",
+	},
+}
+
+// GPT root partition types by architecture
+var rootPartitionTypes = map[string]string{
+	"amd64":   "4f68bce3-e8cd-4db1-96e7-fbcaf984b709",
+	"i386":    "44479540-f297-41b2-9af7-d131d5f0458a",
+	"arm64":   "b921b045-1df0-41c3-af44-4c6f280d3fae",
+	"armhf":   "69dad710-2ce4-4e3c-b16c-21a1d49abed3",
+	"armel":   "69dad710-2ce4-4e3c-b16c-21a1d49abed3",
+	"riscv64": "72ec70a6-cf74-40e6-bd49-4bda08e8f224",
+}
+
+/* Parse a partition offset as understood by parted into bytes. Returns -1 for
+ * offsets relative to the end of the disk */
+func parseOffset(offset string, size int64) (int64, error) {
+	if strings.HasPrefix(offset, "-") {
+		return -1, nil
+	}
+
+	if strings.HasSuffix(offset, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(offset, "%"), 64)
+		if err != nil {
+			return 0, err
+		}
+		return int64(float64(size) * percent / 100), nil
+	}
+
+	if strings.HasSuffix(offset, "s") {
+		sectors, err := strconv.ParseInt(strings.TrimSuffix(offset, "s"), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return sectors * 512, nil
+	}
+
+	// Plain numbers are in megabytes for parted
+	if n, err := strconv.ParseFloat(offset, 64); err == nil {
+		return int64(n * 1000 * 1000), nil
+	}
+
+	// Binary units (MiB, GiB), otherwise decimal ones as parted does
+	if strings.Contains(strings.ToLower(offset), "i") {
+		return units.RAMInBytes(offset)
+	}
+	return units.FromHumanSize(offset)
 }
 
 func (p *Partition) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -215,6 +545,9 @@ func (i *ImagePartitionAction) generateFSTab(context *debos.DebosContext) error
 	for _, m := range i.Mountpoints {
 		options := []string{"defaults"}
 		options = append(options, m.Options...)
+		if m.subvolume != "" {
+			options = append(options, "subvol="+m.subvolume)
+		}
 		if m.Buildtime == true {
 			/* Do not need to add mount point into fstab */
 			continue
@@ -223,6 +556,14 @@ func (i *ImagePartitionAction) generateFSTab(context *debos.DebosContext) error
 			return fmt.Errorf("Missing fs UUID for partition %s!?!", m.part.Name)
 		}
 
+		device := fmt.Sprintf("UUID=%s", m.part.FSUUID)
+		switch {
+		case m.part.Encrypt:
+			device = path.Join("/dev/mapper", m.part.Name)
+		case m.part.volumeGroup != "":
+			device = lvmDevice(m.part.volumeGroup, m.part.Name)
+		}
+
 		fs_passno := 0
 
 		if m.part.Fsck {
@@ -232,21 +573,49 @@ func (i *ImagePartitionAction) generateFSTab(context *debos.DebosContext) error
 				fs_passno = 2
 			}
 		}
-		context.ImageFSTab.WriteString(fmt.Sprintf("UUID=%s\t%s\t%s\t%s\t0\t%d\n",
-			m.part.FSUUID, m.Mountpoint, m.part.FS,
+		context.ImageFSTab.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s\t0\t%d\n",
+			device, m.Mountpoint, m.part.FS,
 			strings.Join(options, ","), fs_passno))
 	}
 
 	return nil
 }
 
+func (i *ImagePartitionAction) generateCryptTab(context *debos.DebosContext) error {
+	context.ImageCryptTab.Reset()
+
+	for _, p := range i.Partitions {
+		if !p.Encrypt {
+			continue
+		}
+		if p.cryptUUID == "" {
+			return fmt.Errorf("Missing LUKS UUID for partition %s!?!", p.Name)
+		}
+		context.ImageCryptTab.WriteString(fmt.Sprintf("%s\tUUID=%s\tnone\tluks\n",
+			p.Name, p.cryptUUID))
+	}
+
+	return nil
+}
+
 func (i *ImagePartitionAction) generateKernelRoot(context *debos.DebosContext) error {
 	for _, m := range i.Mountpoints {
 		if m.Mountpoint == "/" {
 			if m.part.FSUUID == "" {
 				return errors.New("No fs UUID for root partition !?!")
 			}
-			context.ImageKernelRoot = fmt.Sprintf("root=UUID=%s", m.part.FSUUID)
+			switch {
+			case m.part.Encrypt:
+				context.ImageKernelRoot = fmt.Sprintf("root=/dev/mapper/%s", m.part.Name)
+			case m.part.volumeGroup != "":
+				context.ImageKernelRoot = "root=" + lvmDevice(m.part.volumeGroup, m.part.Name)
+			default:
+				context.ImageKernelRoot = fmt.Sprintf("root=UUID=%s", m.part.FSUUID)
+			}
+			if m.subvolume != "" {
+				context.ImageKernelRoot += " rootflags=subvol=" + m.subvolume
+			}
+			context.ImageRootDevice = i.partitionDevice(m.part, *context)
 			break
 		}
 	}
@@ -254,6 +623,86 @@ func (i *ImagePartitionAction) generateKernelRoot(context *debos.DebosContext) e
 	return nil
 }
 
+type partitionManifest struct {
+	Name      string `json:"name"`
+	Number    int    `json:"number"`
+	Offset    int64  `json:"offset"`
+	Size      int64  `json:"size"`
+	Type      string `json:"type"`
+	UUID      string `json:"uuid,omitempty"`
+	FS        string `json:"fs"`
+	FSUUID    string `json:"fsuuid,omitempty"`
+	Encrypted bool   `json:"encrypted,omitempty"`
+}
+
+type imageManifest struct {
+	Image         string              `json:"image"`
+	Size          int64               `json:"size"`
+	SectorSize    int64               `json:"sectorsize"`
+	PartitionType string              `json:"partitiontype"`
+	Partitions    []partitionManifest `json:"partitions"`
+}
+
+// generateManifest describes the partitions as found in the partition table
+func (i *ImagePartitionAction) generateManifest(context *debos.DebosContext) error {
+	out, err := exec.Command("sfdisk", "--json", context.Image).Output()
+	if err != nil {
+		return fmt.Errorf("Failed to read the partition table: %v", err)
+	}
+
+	var table struct {
+		PartitionTable struct {
+			SectorSize int64 `json:"sectorsize"`
+			Partitions []struct {
+				Start int64
+				Size  int64
+				Type  string
+				UUID  string
+			}
+		}
+	}
+	if err := json.Unmarshal(out, &table); err != nil {
+		return fmt.Errorf("Failed to parse the partition table: %v", err)
+	}
+
+	// Older sfdisk don't report the sector size
+	sectorSize := table.PartitionTable.SectorSize
+	if sectorSize == 0 {
+		sectorSize = 512
+	}
+
+	manifest := imageManifest{
+		Image:         i.ImageName,
+		Size:          i.size,
+		SectorSize:    sectorSize,
+		PartitionType: i.PartitionType,
+	}
+	for _, p := range i.Partitions {
+		if p.number > len(table.PartitionTable.Partitions) {
+			return fmt.Errorf("Partition %s not found in the partition table", p.Name)
+		}
+		entry := table.PartitionTable.Partitions[p.number-1]
+		manifest.Partitions = append(manifest.Partitions, partitionManifest{
+			Name:      p.Name,
+			Number:    p.number,
+			Offset:    entry.Start * sectorSize,
+			Size:      entry.Size * sectorSize,
+			Type:      strings.ToLower(entry.Type),
+			UUID:      strings.ToLower(entry.UUID),
+			FS:        p.FS,
+			FSUUID:    p.FSUUID,
+			Encrypted: p.Encrypt,
+		})
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(context.Artifactdir, i.Manifest), append(data, '\n'), 0644)
+}
+
 func (i ImagePartitionAction) getPartitionDevice(number int, context debos.DebosContext) string {
 	/* Always look up canonical device as udev might not generate the by-id
 	 * symlinks while there is an flock on /dev/vda */
@@ -275,10 +724,70 @@ func (i ImagePartitionAction) getPartitionDevice(number int, context debos.Debos
 	}
 }
 
+// lvmDevice returns the device mapper path of a logical volume
+func lvmDevice(vg, lv string) string {
+	escape := func(name string) string {
+		return strings.Replace(name, "-", "--", -1)
+	}
+	return path.Join("/dev/mapper", escape(vg)+"-"+escape(lv))
+}
+
+/* Device containing the filesystem of the partition; for an encrypted
+ * partition it's the device mapper device of the opened partition, and for a
+ * logical volume the one of the volume */
+func (i ImagePartitionAction) partitionDevice(p *Partition, context debos.DebosContext) string {
+	if p.cryptName != "" {
+		return path.Join("/dev/mapper", p.cryptName)
+	}
+	if p.volumeGroup != "" {
+		return lvmDevice(p.volumeGroup, p.Name)
+	}
+	return i.getPartitionDevice(p.number, context)
+}
+
+func (i ImagePartitionAction) encryptPartition(p *Partition, context debos.DebosContext) error {
+	label := fmt.Sprintf("Encrypting partition %d", p.number)
+	device := i.getPartitionDevice(p.number, context)
+
+	keyfile := p.Keyfile
+	if keyfile == "" {
+		/* Commands don't get any input, so pass the passphrase as key file
+		 * without trailing newline */
+		keyfile = path.Join(context.Scratchdir, fmt.Sprintf("%s.key", p.Name))
+		err := ioutil.WriteFile(keyfile, []byte(p.Passphrase), 0600)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(keyfile)
+	}
+
+	err := debos.Command{}.Run(label, "cryptsetup", "luksFormat", "--batch-mode",
+		"--key-file", keyfile, device)
+	if err != nil {
+		return err
+	}
+
+	uuid, err := exec.Command("cryptsetup", "luksUUID", device).Output()
+	if err != nil {
+		return fmt.Errorf("Failed to get LUKS uuid: %s", err)
+	}
+	p.cryptUUID = strings.TrimSpace(string(uuid[:]))
+
+	/* Avoid clashing with device mapper names used on the host */
+	name := "debos-" + p.Name
+	err = debos.Command{}.Run(label, "cryptsetup", "open", "--key-file", keyfile, device, name)
+	if err != nil {
+		return err
+	}
+	p.cryptName = name
+
+	return nil
+}
+
 func (i *ImagePartitionAction) triggerDeviceNodes(context *debos.DebosContext) error {
 	err := debos.Command{}.Run("udevadm", "udevadm", "trigger", "--settle", context.Image)
 	if err != nil {
-		log.Printf("Failed to trigger device nodes")
+		debos.Warnf("Failed to trigger device nodes")
 		return err
 	}
 
@@ -293,60 +802,164 @@ func (i ImagePartitionAction) PreMachine(context *debos.DebosContext, m *fakemac
 		return err
 	}
 
+	if !i.Sparse {
+		if err := i.preallocate(imagePath); err != nil {
+			return err
+		}
+	}
+
 	context.Image = image
 	*args = append(*args, "--internal-image", image)
+
+	// Mount key files outside of recipes directory
+	for _, p := range i.Partitions {
+		if p.Keyfile != "" {
+			m.AddVolume(path.Dir(p.Keyfile))
+		}
+	}
+
 	return nil
 }
 
-func (i ImagePartitionAction) formatPartition(p *Partition, context debos.DebosContext) error {
-	label := fmt.Sprintf("Formatting partition %d", p.number)
-	path := i.getPartitionDevice(p.number, context)
+/* mkfsCommand returns the command line creating a filesystem, without the
+ * device, or nil for the 'none' filesystem. The label is optional. */
+func mkfsCommand(fs, label string, features []string, fsuuid string) []string {
+	// Option setting the label, which differs between the mkfs tools
+	labelled := func(cmd string, option string, args ...string) []string {
+		cmdline := append([]string{cmd}, args...)
+		if label != "" {
+			cmdline = append(cmdline, option, label)
+		}
+		return cmdline
+	}
 
 	cmdline := []string{}
-	switch p.FS {
+	switch fs {
 	case "vfat":
-		cmdline = append(cmdline, "mkfs.vfat", "-F32", "-n", p.Name)
+		cmdline = labelled("mkfs.vfat", "-n", "-F32")
 	case "btrfs":
 		// Force formatting to prevent failure in case if partition was formatted already
-		cmdline = append(cmdline, "mkfs.btrfs", "-L", p.Name, "-f")
-		if len(p.Features) > 0 {
-			cmdline = append(cmdline, "-O", strings.Join(p.Features, ","))
+		cmdline = append(labelled("mkfs.btrfs", "-L"), "-f")
+		if len(features) > 0 {
+			cmdline = append(cmdline, "-O", strings.Join(features, ","))
 		}
-		if len(p.FSUUID) > 0 {
-			cmdline = append(cmdline, "-U", p.FSUUID)
+		if len(fsuuid) > 0 {
+			cmdline = append(cmdline, "-U", fsuuid)
 		}
 	case "f2fs":
-		cmdline = append(cmdline, "mkfs.f2fs", "-l", p.Name)
-		if len(p.Features) > 0 {
-			cmdline = append(cmdline, "-O", strings.Join(p.Features, ","))
+		cmdline = labelled("mkfs.f2fs", "-l")
+		if len(features) > 0 {
+			cmdline = append(cmdline, "-O", strings.Join(features, ","))
 		}
 	case "hfs":
-		cmdline = append(cmdline, "mkfs.hfs", "-h", "-v", p.Name)
+		cmdline = labelled("mkfs.hfs", "-v", "-h")
 	case "hfsplus":
-		cmdline = append(cmdline, "mkfs.hfsplus", "-v", p.Name)
+		cmdline = labelled("mkfs.hfsplus", "-v")
 	case "hfsx":
-		cmdline = append(cmdline, "mkfs.hfsplus", "-s", "-v", p.Name)
-		// hfsx is case-insensitive hfs+, should be treated as "normal" hfs+ from now on
-		p.FS = "hfsplus"
+		cmdline = labelled("mkfs.hfsplus", "-v", "-s")
 	case "xfs":
-		cmdline = append(cmdline, "mkfs.xfs", "-L", p.Name)
-		if len(p.FSUUID) > 0 {
-			cmdline = append(cmdline, "-m", "uuid="+p.FSUUID)
+		cmdline = labelled("mkfs.xfs", "-L")
+		if len(fsuuid) > 0 {
+			cmdline = append(cmdline, "-m", "uuid="+fsuuid)
 		}
-	case "none":
+	case "none", "lvm":
+		return nil
 	default:
-		cmdline = append(cmdline, fmt.Sprintf("mkfs.%s", p.FS), "-L", p.Name)
-		if len(p.Features) > 0 {
-			cmdline = append(cmdline, "-O", strings.Join(p.Features, ","))
+		cmdline = labelled(fmt.Sprintf("mkfs.%s", fs), "-L")
+		if len(features) > 0 {
+			cmdline = append(cmdline, "-O", strings.Join(features, ","))
 		}
-		if len(p.FSUUID) > 0 {
-			if p.FS == "ext2" || p.FS == "ext3" || p.FS == "ext4" {
-				cmdline = append(cmdline, "-U", p.FSUUID)
+		if len(fsuuid) > 0 {
+			if fs == "ext2" || fs == "ext3" || fs == "ext4" {
+				cmdline = append(cmdline, "-U", fsuuid)
 			}
 		}
 	}
 
+	return cmdline
+}
+
+// writeContent writes the content file of the partition to its device
+func (i ImagePartitionAction) writeContent(p *Partition, context debos.DebosContext) error {
+	in, err := os.Open(p.Content)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	device := i.partitionDevice(p, context)
+	debos.Infof("Writing %s to partition %s\n", p.Content, p.Name)
+	out, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("Failed to write %s to partition %s: %v", p.Content, p.Name, err)
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// checkContent ensures the content file of the partition fits in it
+func (i *ImagePartitionAction) checkContent(p *Partition, context *debos.DebosContext) error {
+	if p.FS != "none" || p.Encrypt {
+		return fmt.Errorf("Content can only be written to partition %s without filesystem nor encryption", p.Name)
+	}
+
+	p.Content = debos.CleanPathAt(p.Content, context.RecipeDir)
+	fi, err := os.Stat(p.Content)
+	if err != nil {
+		return err
+	}
+
+	start, err := parseOffset(p.Start, i.size)
+	if err != nil || start < 0 {
+		return nil
+	}
+	end := i.size
+	if !p.Expand {
+		if end, err = parseOffset(p.End, i.size); err != nil || end < 0 {
+			return nil
+		}
+	}
+
+	switch size := end - start; {
+	case fi.Size() > size:
+		return fmt.Errorf("Content %s (%d bytes) doesn't fit in partition %s (%d bytes)",
+			p.Content, fi.Size(), p.Name, size)
+	case fi.Size() < size:
+		debos.Warnf("Content %s only fills %d of the %d bytes of partition %s, the rest is zeroed\n",
+			p.Content, fi.Size(), size, p.Name)
+	}
+
+	return nil
+}
+
+func (i ImagePartitionAction) formatPartition(p *Partition, context debos.DebosContext) error {
+	label := fmt.Sprintf("Formatting partition %d", p.number)
+	if p.volumeGroup != "" {
+		label = fmt.Sprintf("Formatting volume %s", p.Name)
+	}
+	path := i.partitionDevice(p, context)
+
+	cmdline := mkfsCommand(p.FS, p.Name, p.Features, p.FSUUID)
+	if p.FS == "hfsx" {
+		// hfsx is case-insensitive hfs+, should be treated as "normal" hfs+ from now on
+		p.FS = "hfsplus"
+	}
+
 	if len(cmdline) != 0 {
+		if p.Reserved != nil {
+			cmdline = append(cmdline, "-m", strconv.Itoa(*p.Reserved))
+		}
+		if p.InodeRatio > 0 {
+			cmdline = append(cmdline, "-i", strconv.Itoa(p.InodeRatio))
+		}
+		cmdline = append(cmdline, p.MKFSOptions...)
 		cmdline = append(cmdline, path)
 
 		cmd := debos.Command{}
@@ -366,6 +979,82 @@ func (i ImagePartitionAction) formatPartition(p *Partition, context debos.DebosC
 	return nil
 }
 
+/* createVolumeGroup creates the volume group on its physical volumes, then
+ * creates and formats its logical volumes */
+func (i ImagePartitionAction) createVolumeGroup(vg *VolumeGroup, context *debos.DebosContext) error {
+	label := fmt.Sprintf("Creating volume group %s", vg.Name)
+
+	command := []string{"vgcreate", vg.Name}
+	for _, pv := range vg.pvs {
+		command = append(command, i.partitionDevice(pv, *context))
+	}
+	if err := (debos.Command{}).Run(label, command...); err != nil {
+		return err
+	}
+	vg.active = true
+
+	for idx := range vg.Volumes {
+		lv := &vg.Volumes[idx]
+
+		command := []string{"lvcreate", "--yes", "--name", lv.Name}
+		if lv.Expand {
+			command = append(command, "--extents", "100%FREE")
+		} else {
+			command = append(command, "--size", fmt.Sprintf("%db", lv.size))
+		}
+		command = append(command, vg.Name)
+		if err := (debos.Command{}).Run(label, command...); err != nil {
+			return err
+		}
+
+		if err := i.formatPartition(lv, *context); err != nil {
+			return err
+		}
+
+		if len(lv.Subvolumes) > 0 {
+			if err := i.createSubvolumes(lv, *context); err != nil {
+				return err
+			}
+		}
+
+		context.ImagePartitions = append(context.ImagePartitions,
+			debos.Partition{lv.Name, i.partitionDevice(lv, *context)})
+	}
+
+	return nil
+}
+
+func (i ImagePartitionAction) createSubvolumes(p *Partition, context debos.DebosContext) error {
+	label := fmt.Sprintf("Creating subvolumes on %s", p.Name)
+
+	mntpath, err := ioutil.TempDir(context.Scratchdir, "btrfs")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mntpath)
+
+	err = syscall.Mount(i.partitionDevice(p, context), mntpath, p.FS, 0, "")
+	if err != nil {
+		return fmt.Errorf("%s mount failed: %v", p.Name, err)
+	}
+
+	for _, s := range p.Subvolumes {
+		err = debos.Command{}.Run(label, "btrfs", "subvolume", "create", path.Join(mntpath, s.Name))
+		if err != nil {
+			break
+		}
+	}
+
+	if uerr := syscall.Unmount(mntpath, 0); uerr != nil {
+		debos.Warnf("Failed to unmount %s: %v", mntpath, uerr)
+		if err == nil {
+			err = uerr
+		}
+	}
+
+	return err
+}
+
 func (i *ImagePartitionAction) PreNoMachine(context *debos.DebosContext) error {
 	imagePath := path.Join(context.Artifactdir, i.ImageName)
 	img, err := os.OpenFile(imagePath, os.O_WRONLY|os.O_CREATE, 0666)
@@ -380,12 +1069,17 @@ func (i *ImagePartitionAction) PreNoMachine(context *debos.DebosContext) error {
 
 	img.Close()
 
-	i.loopDev, err = losetup.Attach(imagePath, 0, false)
+	if !i.Sparse {
+		if err := i.preallocate(imagePath); err != nil {
+			return err
+		}
+	}
+
+	i.loopDev, err = debos.AttachLoopDevice(context, imagePath)
 	if err != nil {
-		return fmt.Errorf("Failed to setup loop device")
+		return err
 	}
-	context.Image = i.loopDev.Path()
-	i.usingLoop = true
+	context.Image = i.loopDev
 
 	return nil
 }
@@ -441,7 +1135,7 @@ func (i ImagePartitionAction) Run(context *debos.DebosContext) error {
 		case "hfsplus":
 			command = append(command, "hfs+")
 		case "f2fs":
-		case "none":
+		case "none", "lvm":
 		default:
 			command = append(command, p.FS)
 		}
@@ -469,18 +1163,57 @@ func (i ImagePartitionAction) Run(context *debos.DebosContext) error {
 			}
 		}
 
+		if p.PartUUID != "" {
+			err = debos.Command{}.Run("sfdisk", "sfdisk", "--part-uuid", context.Image, fmt.Sprintf("%d", p.number), p.PartUUID)
+			if err != nil {
+				return err
+			}
+		}
 
-		devicePath := i.getPartitionDevice(p.number, *context)
+		if p.Encrypt {
+			err = i.encryptPartition(p, *context)
+			if err != nil {
+				return err
+			}
+		}
+
+		devicePath := i.partitionDevice(p, *context)
 
-		err = i.formatPartition(p, *context)
+		if p.FS == "lvm" {
+			err = debos.Command{}.Run(fmt.Sprintf("Creating physical volume %d", p.number),
+				"pvcreate", "--yes", devicePath)
+		} else {
+			err = i.formatPartition(p, *context)
+		}
 		if err != nil {
 			return err
 		}
 
+		if len(p.Subvolumes) > 0 {
+			err = i.createSubvolumes(p, *context)
+			if err != nil {
+				return err
+			}
+		}
+
+		if p.Content != "" {
+			err = i.writeContent(p, *context)
+			if err != nil {
+				return err
+			}
+		}
+
 		context.ImagePartitions = append(context.ImagePartitions,
 			debos.Partition{p.Name, devicePath})
 	}
 
+	for idx := range i.VolumeGroups {
+		err = i.createVolumeGroup(&i.VolumeGroups[idx], context)
+		if err != nil {
+			return err
+		}
+	}
+
 	context.ImageMntDir = path.Join(context.Scratchdir, "mnt")
 	os.MkdirAll(context.ImageMntDir, 0755)
 
@@ -500,14 +1233,20 @@ func (i ImagePartitionAction) Run(context *debos.DebosContext) error {
 		return strings.Count(mntA, "/") < strings.Count(mntB, "/")
 	})
 
-	for _, m := range i.Mountpoints {
-		dev := i.getPartitionDevice(m.part.number, *context)
+	for idx := range i.Mountpoints {
+		m := &i.Mountpoints[idx]
+		dev := i.partitionDevice(m.part, *context)
 		mntpath := path.Join(context.ImageMntDir, m.Mountpoint)
 		os.MkdirAll(mntpath, 0755)
-		err := syscall.Mount(dev, mntpath, m.part.FS, 0, "")
+		data := ""
+		if m.subvolume != "" {
+			data = "subvol=" + m.subvolume
+		}
+		err := syscall.Mount(dev, mntpath, m.part.FS, 0, data)
 		if err != nil {
 			return fmt.Errorf("%s mount failed: %v", m.part.Name, err)
 		}
+		m.mounted = true
 	}
 
 	err = i.generateFSTab(context)
@@ -515,27 +1254,71 @@ func (i ImagePartitionAction) Run(context *debos.DebosContext) error {
 		return err
 	}
 
+	err = i.generateCryptTab(context)
+	if err != nil {
+		return err
+	}
+
 	err = i.generateKernelRoot(context)
 	if err != nil {
 		return err
 	}
 
+	if i.Manifest != "" {
+		err = i.generateManifest(context)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (i ImagePartitionAction) Cleanup(context *debos.DebosContext) error {
+	/* Keep going on failures which still allow to release the image, so the
+	 * loop device gets detached, reporting the first failure. The loop device
+	 * is only detached once everything got flushed, as detaching it drops the
+	 * data not written back yet */
+	var cleanupErr error
+	synced := true
+
 	for idx := len(i.Mountpoints) - 1; idx >= 0; idx-- {
-		m := i.Mountpoints[idx]
+		m := &i.Mountpoints[idx]
+		// Nothing to unmount if the action failed before mounting it
+		if !m.mounted {
+			continue
+		}
 		mntpath := path.Join(context.ImageMntDir, m.Mountpoint)
+
+		// Unmounting flushes as well, but a failure to write back would go unnoticed
+		debos.Debugf("Syncing %s\n", m.Mountpoint)
+		if err := debos.SyncFilesystem(mntpath); err != nil {
+			debos.Warnf("Failed to sync %s: %s", m.Mountpoint, err)
+			if cleanupErr == nil {
+				cleanupErr = err
+			}
+			synced = false
+		}
+
 		err := syscall.Unmount(mntpath, 0)
 		if err != nil {
-			log.Printf("Warning: Failed to get unmount %s: %s", m.Mountpoint, err)
-			log.Printf("Unmount failure can cause images being incomplete!")
-			return err
+			debos.Warnf("Failed to get unmount %s: %s", m.Mountpoint, err)
+			debos.Warnf("Unmount failure can cause images being incomplete!")
+			// Detach the filesystem anyway so it doesn't keep the image busy
+			if lerr := syscall.Unmount(mntpath, syscall.MNT_DETACH); lerr != nil {
+				return err
+			}
+			debos.Warnf("Lazily unmounted %s", m.Mountpoint)
+			if cleanupErr == nil {
+				cleanupErr = err
+			}
+			m.mounted = false
+			continue
 		}
+		m.mounted = false
 		if m.Buildtime == true {
 			if err = os.Remove(mntpath); err != nil {
-				log.Printf("Failed to remove temporary mount point %s: %s", m.Mountpoint, err)
+				debos.Warnf("Failed to remove temporary mount point %s: %s", m.Mountpoint, err)
 
 				if err.(*os.PathError).Err.Error() == "read-only file system" {
 					continue
@@ -546,28 +1329,83 @@ func (i ImagePartitionAction) Cleanup(context *debos.DebosContext) error {
 		}
 	}
 
-	if i.usingLoop {
-		err := i.loopDev.Detach()
+	for idx := range i.VolumeGroups {
+		vg := &i.VolumeGroups[idx]
+		if !vg.active {
+			continue
+		}
+		err := debos.Command{}.Run("vgchange", "vgchange", "--activate", "n", vg.Name)
 		if err != nil {
-			log.Printf("WARNING: Failed to detach loop device: %s", err)
-			return err
+			debos.Warnf("Failed to deactivate volume group %s: %s", vg.Name, err)
+			if cleanupErr == nil {
+				cleanupErr = err
+			}
+			continue
 		}
+		vg.active = false
+	}
 
-		for t := 0; t < 60; t++ {
-			err = i.loopDev.Remove()
-			if err == nil {
-				break
+	for idx := range i.Partitions {
+		p := &i.Partitions[idx]
+		if p.cryptName == "" {
+			continue
+		}
+		err := debos.Command{}.Run("cryptsetup", "cryptsetup", "close", p.cryptName)
+		if err != nil {
+			debos.Warnf("Failed to close encrypted partition %s: %s", p.Name, err)
+			if cleanupErr == nil {
+				cleanupErr = err
 			}
-			log.Printf("Loop dev couldn't remove %s, waiting", err)
-			time.Sleep(time.Second)
+			continue
 		}
+		p.cryptName = ""
+	}
 
-		if err != nil {
-			log.Printf("WARNING: Failed to remove loop device: %s", err)
+	/* Flush the image before detaching the loop device, as the kernel drops
+	 * the buffers of the device not written back yet when detaching it */
+	if context.Image != "" {
+		debos.Debugf("Syncing image device %s\n", context.Image)
+		if err := debos.SyncFile(context.Image); err != nil {
+			debos.Warnf("Failed to sync image device: %s", err)
+			if cleanupErr == nil {
+				cleanupErr = err
+			}
+			synced = false
+		}
+	}
+
+	if i.loopDev != "" {
+		image := path.Join(context.Artifactdir, i.ImageName)
+		if err := debos.SyncFile(image); err != nil {
+			debos.Warnf("Failed to sync image file: %s", err)
+			if cleanupErr == nil {
+				cleanupErr = err
+			}
+			synced = false
+		}
+
+		if !synced {
+			debos.KeepLoopDevice(context, i.loopDev)
+			return cleanupErr
+		}
+
+		if err := debos.DetachLoopDevice(context, i.loopDev); err != nil {
+			debos.Warnf("%s", err)
 			return err
 		}
 	}
 
+	return cleanupErr
+}
+
+// PostMachine flushes the image file written by the fakemachine
+func (i ImagePartitionAction) PostMachine(context *debos.DebosContext) error {
+	image := path.Join(context.Artifactdir, i.ImageName)
+	if err := debos.SyncFile(image); err != nil {
+		debos.Warnf("Failed to sync image file: %s", err)
+		return err
+	}
+
 	return nil
 }
 
@@ -584,9 +1422,30 @@ func (i ImagePartitionAction) PostMachineCleanup(context *debos.DebosContext) er
 	return nil
 }
 
+func (i *ImagePartitionAction) Summary() string {
+	summary := []string{fmt.Sprintf("Create %s image %s of %s", i.PartitionType, i.ImageName, i.ImageSize)}
+	for _, p := range i.Partitions {
+		summary = append(summary, fmt.Sprintf("  partition %s: %s from %s to %s", p.Name, p.FS, p.Start, p.End))
+	}
+	for _, vg := range i.VolumeGroups {
+		summary = append(summary, fmt.Sprintf("  volume group %s on %s", vg.Name, strings.Join(vg.Partitions, ", ")))
+		for _, lv := range vg.Volumes {
+			size := lv.Size
+			if lv.Expand {
+				size = "remaining space"
+			}
+			summary = append(summary, fmt.Sprintf("    volume %s: %s of %s", lv.Name, lv.FS, size))
+		}
+	}
+	for _, m := range i.Mountpoints {
+		summary = append(summary, fmt.Sprintf("  mount %s on %s", m.Partition, m.Mountpoint))
+	}
+	return strings.Join(summary, "\n")
+}
+
 func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 	if len(i.GptGap) > 0 {
-		log.Println("WARNING: special version of parted is needed for 'gpt_gap' option")
+		debos.Warnf("special version of parted is needed for 'gpt_gap' option")
 		if i.PartitionType != "gpt" {
 			return fmt.Errorf("gpt_gap property could be used only with 'gpt' label")
 		}
@@ -613,22 +1472,34 @@ func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 			}
 		}
 
-		if len(p.FSUUID) > 0 {
-			if p.FS == "btrfs" || p.FS == "ext2" || p.FS == "ext3" || p.FS == "ext4" || p.FS == "xfs" {
-				_, err := uuid.Parse(p.FSUUID)
-				if err != nil {
-					return fmt.Errorf("Incorrect UUID %s", p.FSUUID)
-				}
-			} else {
-				return fmt.Errorf("Setting the UUID is not supported for filesystem %s", p.FS)
+		if i.PartitionType != "gpt" && p.PartLabel != "" {
+			return fmt.Errorf("Can only set partition partlabel on GPT filesystem")
+		}
+
+		if len(p.PartUUID) > 0 {
+			if i.PartitionType != "gpt" {
+				return fmt.Errorf("Can only set partition partuuid on GPT filesystem")
+			}
+			if _, err := uuid.Parse(p.PartUUID); err != nil {
+				return fmt.Errorf("Incorrect partition UUID %s", p.PartUUID)
 			}
 		}
 
-		if i.PartitionType != "gpt" && p.PartLabel != "" {
-			return fmt.Errorf("Can only set partition partlabel on GPT filesystem")
+		if p.FS == "lvm" && p.PartType == "" {
+			p.PartType = "lvm"
 		}
 
 		if p.PartType != "" {
+			if p.PartType == "linux-root" && i.PartitionType == "gpt" {
+				guid, found := rootPartitionTypes[context.Architecture]
+				if !found {
+					return fmt.Errorf("No root partition type known for architecture %s", context.Architecture)
+				}
+				p.PartType = guid
+			} else if t, found := partitionTypes[i.PartitionType][p.PartType]; found {
+				p.PartType = t
+			}
+
 			var partTypeLen int
 			switch i.PartitionType {
 			case "gpt":
@@ -644,18 +1515,51 @@ func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 		if p.Start == "" {
 			return fmt.Errorf("Partition %s missing start", p.Name)
 		}
+		if p.Expand {
+			if idx != len(i.Partitions)-1 {
+				return fmt.Errorf("Only the last partition can be expanded, not %s", p.Name)
+			}
+			if p.End != "" {
+				return fmt.Errorf("Partition %s can't have both an end and expand", p.Name)
+			}
+			/* Fill up to the last sector, leaving room for the GPT backup
+			 * header and partition entries */
+			if i.PartitionType == "gpt" {
+				p.End = "-34s"
+			} else {
+				p.End = "-1s"
+			}
+		}
 		if p.End == "" {
 			return fmt.Errorf("Partition %s missing end", p.Name)
 		}
 
-		switch p.FS {
-		case "fat32":
-			p.FS = "vfat"
-		case "":
-			return fmt.Errorf("Partition %s missing fs type", p.Name)
+		if err := i.verifyFilesystem(p); err != nil {
+			return err
+		}
+
+		if p.Encrypt {
+			if (p.Keyfile == "") == (p.Passphrase == "") {
+				return fmt.Errorf("Encrypted partition %s needs either a keyfile or a passphrase", p.Name)
+			}
+			if p.FS == "none" || p.FS == "lvm" {
+				return fmt.Errorf("Encrypted partition %s needs a filesystem", p.Name)
+			}
+			if p.Keyfile != "" {
+				p.Keyfile = debos.CleanPathAt(p.Keyfile, context.RecipeDir)
+				if _, err := os.Stat(p.Keyfile); err != nil {
+					return err
+				}
+			}
+		} else if p.Keyfile != "" || p.Passphrase != "" {
+			return fmt.Errorf("Partition %s has a keyfile or passphrase but isn't encrypted", p.Name)
 		}
 	}
 
+	if err := i.verifyVolumeGroups(); err != nil {
+		return err
+	}
+
 	for idx, _ := range i.Mountpoints {
 		m := &i.Mountpoints[idx]
 
@@ -673,9 +1577,20 @@ func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 				break
 			}
 		}
+		for vidx := range i.VolumeGroups {
+			vg := &i.VolumeGroups[vidx]
+			for lidx := range vg.Volumes {
+				if m.part == nil && m.Partition == vg.Volumes[lidx].Name {
+					m.part = &vg.Volumes[lidx]
+				}
+			}
+		}
 		if m.part == nil {
 			return fmt.Errorf("Couldn't find partition for %s", m.Mountpoint)
 		}
+		if m.part.FS == "none" || m.part.FS == "lvm" {
+			return fmt.Errorf("Partition %s has no filesystem to mount on %s", m.Partition, m.Mountpoint)
+		}
 	}
 
 	size, err := units.FromHumanSize(i.ImageSize)
@@ -684,5 +1599,249 @@ func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 	}
 
 	i.size = size
+
+	if len(i.Partitions) > 0 && i.Partitions[len(i.Partitions)-1].Expand {
+		for _, p := range i.Partitions {
+			offset, err := parseOffset(p.Start, i.size)
+			if !p.Expand {
+				offset, err = parseOffset(p.End, i.size)
+			}
+			if err == nil && offset >= i.size {
+				return fmt.Errorf("Image size %s is too small to expand partition %s", i.ImageSize, p.Name)
+			}
+		}
+	}
+
+	if i.Alignment < 0 {
+		return fmt.Errorf("Alignment must be a positive number of MiB")
+	}
+	if i.Alignment > 0 {
+		alignment := int64(i.Alignment) * 1024 * 1024
+		for idx := range i.Partitions {
+			p := &i.Partitions[idx]
+
+			start, err := parseOffset(p.Start, i.size)
+			if err != nil || start < 0 {
+				return fmt.Errorf("Couldn't align start %s of partition %s", p.Start, p.Name)
+			}
+			start = (start + alignment - 1) / alignment * alignment
+
+			end, err := parseOffset(p.End, i.size)
+			if err == nil && end >= 0 && start >= end {
+				return fmt.Errorf("Aligned start of partition %s is beyond its end", p.Name)
+			}
+			if start >= i.size {
+				return fmt.Errorf("Aligned start of partition %s is beyond the image size", p.Name)
+			}
+
+			p.Start = fmt.Sprintf("%ds", start/512)
+		}
+	}
+
+	for idx := range i.Partitions {
+		p := &i.Partitions[idx]
+		if p.Content != "" {
+			if err := i.checkContent(p, context); err != nil {
+				return err
+			}
+		}
+	}
+
+	return debos.CheckBinaries(i.binaries()...)
+}
+
+// verifyFilesystem checks the filesystem properties of a partition or logical volume
+func (i *ImagePartitionAction) verifyFilesystem(p *Partition) error {
+	switch p.FS {
+	case "fat32":
+		p.FS = "vfat"
+	case "":
+		return fmt.Errorf("Partition %s missing fs type", p.Name)
+	}
+
+	if len(p.FSUUID) > 0 {
+		if p.FS == "btrfs" || p.FS == "ext2" || p.FS == "ext3" || p.FS == "ext4" || p.FS == "xfs" {
+			_, err := uuid.Parse(p.FSUUID)
+			if err != nil {
+				return fmt.Errorf("Incorrect UUID %s", p.FSUUID)
+			}
+		} else {
+			return fmt.Errorf("Setting the UUID is not supported for filesystem %s", p.FS)
+		}
+	}
+
+	if p.Reserved != nil || p.InodeRatio != 0 {
+		if p.FS != "ext2" && p.FS != "ext3" && p.FS != "ext4" {
+			return fmt.Errorf("Partition %s: 'reserved' and 'inoderatio' are only supported for ext2, ext3 and ext4", p.Name)
+		}
+		if p.Reserved != nil && (*p.Reserved < 0 || *p.Reserved > 50) {
+			return fmt.Errorf("Partition %s: 'reserved' must be between 0 and 50%%", p.Name)
+		}
+		if p.InodeRatio != 0 && (p.InodeRatio < 1024 || p.InodeRatio > 67108864) {
+			return fmt.Errorf("Partition %s: 'inoderatio' must be between 1024 and 67108864 bytes", p.Name)
+		}
+	}
+
+	if (p.FS == "none" || p.FS == "lvm") && (len(p.MKFSOptions) > 0 || len(p.Features) > 0) {
+		return fmt.Errorf("Partition %s has filesystem options but no filesystem", p.Name)
+	}
+
+	if len(p.Subvolumes) > 0 && p.FS != "btrfs" {
+		return fmt.Errorf("Subvolumes are only supported on btrfs, not on partition %s", p.Name)
+	}
+	for sidx, s := range p.Subvolumes {
+		if s.Name == "" {
+			return fmt.Errorf("Subvolume without a name on partition %s", p.Name)
+		}
+		for j := sidx + 1; j < len(p.Subvolumes); j++ {
+			if p.Subvolumes[j].Name == s.Name {
+				return fmt.Errorf("Subvolume %s already exists on partition %s", s.Name, p.Name)
+			}
+		}
+		if s.Mountpoint != "" {
+			i.Mountpoints = append(i.Mountpoints,
+				Mountpoint{Mountpoint: s.Mountpoint, Partition: p.Name, subvolume: s.Name})
+		}
+	}
+
 	return nil
 }
+
+// Valid names of LVM volume groups and logical volumes
+var lvmNameRe = regexp.MustCompile(`^[a-zA-Z0-9+_.][a-zA-Z0-9+_.-]*$`)
+
+/* verifyVolumeGroups checks the volume groups and their logical volumes, and
+ * resolves their physical volumes */
+func (i *ImagePartitionAction) verifyVolumeGroups() error {
+	names := make(map[string]bool)
+	for _, p := range i.Partitions {
+		names[p.Name] = true
+	}
+
+	pvs := make(map[string]string) // Volume groups of the physical volumes
+	for idx := range i.VolumeGroups {
+		vg := &i.VolumeGroups[idx]
+		if vg.Name == "" {
+			return fmt.Errorf("Volume group without a name")
+		}
+		if !lvmNameRe.MatchString(vg.Name) {
+			return fmt.Errorf("Invalid volume group name '%s'", vg.Name)
+		}
+		for j := idx + 1; j < len(i.VolumeGroups); j++ {
+			if i.VolumeGroups[j].Name == vg.Name {
+				return fmt.Errorf("Volume group %s already exists", vg.Name)
+			}
+		}
+
+		if len(vg.Partitions) == 0 {
+			return fmt.Errorf("Volume group %s has no partitions", vg.Name)
+		}
+		for _, name := range vg.Partitions {
+			var pv *Partition
+			for pidx := range i.Partitions {
+				if i.Partitions[pidx].Name == name {
+					pv = &i.Partitions[pidx]
+				}
+			}
+			if pv == nil {
+				return fmt.Errorf("Couldn't find partition %s of volume group %s", name, vg.Name)
+			}
+			if pv.FS != "lvm" {
+				return fmt.Errorf("Partition %s of volume group %s must have the 'lvm' fs type", name, vg.Name)
+			}
+			if other, found := pvs[name]; found {
+				return fmt.Errorf("Partition %s is used by volume groups %s and %s", name, other, vg.Name)
+			}
+			pvs[name] = vg.Name
+			vg.pvs = append(vg.pvs, pv)
+		}
+
+		if len(vg.Volumes) == 0 {
+			return fmt.Errorf("Volume group %s has no volumes", vg.Name)
+		}
+		for lidx := range vg.Volumes {
+			lv := &vg.Volumes[lidx]
+			if lv.Name == "" {
+				return fmt.Errorf("Volume without a name in volume group %s", vg.Name)
+			}
+			if !lvmNameRe.MatchString(lv.Name) {
+				return fmt.Errorf("Invalid volume name '%s'", lv.Name)
+			}
+			if names[lv.Name] {
+				return fmt.Errorf("Partition %s already exists", lv.Name)
+			}
+			names[lv.Name] = true
+			lv.volumeGroup = vg.Name
+
+			if lv.Start != "" || lv.End != "" || lv.PartLabel != "" || lv.PartType != "" ||
+				lv.PartUUID != "" || len(lv.Flags) > 0 || lv.Encrypt || lv.Keyfile != "" ||
+				lv.Passphrase != "" || lv.Content != "" {
+				return fmt.Errorf("Volume %s only supports a size and filesystem properties", lv.Name)
+			}
+
+			if lv.Expand {
+				if lidx != len(vg.Volumes)-1 {
+					return fmt.Errorf("Only the last volume of volume group %s can be expanded, not %s", vg.Name, lv.Name)
+				}
+				if lv.Size != "" {
+					return fmt.Errorf("Volume %s can't have both a size and expand", lv.Name)
+				}
+			} else {
+				if lv.Size == "" {
+					return fmt.Errorf("Volume %s missing size", lv.Name)
+				}
+				size, err := parseOffset(lv.Size, 0)
+				if err != nil || size <= 0 {
+					return fmt.Errorf("Invalid size %s of volume %s", lv.Size, lv.Name)
+				}
+				lv.size = size
+			}
+
+			if lv.FS == "lvm" {
+				return fmt.Errorf("Volume %s can't be an LVM physical volume", lv.Name)
+			}
+			if err := i.verifyFilesystem(lv); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, p := range i.Partitions {
+		if p.FS == "lvm" && pvs[p.Name] == "" {
+			return fmt.Errorf("Partition %s isn't part of a volume group", p.Name)
+		}
+	}
+
+	return nil
+}
+
+// binaries lists the commands needed to create the image
+func (i *ImagePartitionAction) binaries() []string {
+	binaries := []string{"parted", "sfdisk", "udevadm", "blkid"}
+
+	partitions := append([]Partition{}, i.Partitions...)
+	for _, vg := range i.VolumeGroups {
+		partitions = append(partitions, vg.Volumes...)
+	}
+	if len(i.VolumeGroups) > 0 {
+		binaries = append(binaries, "pvcreate", "vgcreate", "lvcreate", "vgchange")
+	}
+
+	for _, p := range partitions {
+		switch p.FS {
+		case "none", "lvm", "":
+		case "hfsx":
+			binaries = append(binaries, "mkfs.hfsplus")
+		default:
+			binaries = append(binaries, "mkfs."+p.FS)
+		}
+		if p.Encrypt {
+			binaries = append(binaries, "cryptsetup")
+		}
+		if len(p.Subvolumes) > 0 {
+			binaries = append(binaries, "btrfs")
+		}
+	}
+
+	return binaries
+}
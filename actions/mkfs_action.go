@@ -0,0 +1,147 @@
+/*
+Mkfs Action
+
+Create a filesystem on an existing device or partition, e.g. a disk or image
+partitioned by other means than the 'image-partition' action. The filesystem is
+created on the host before the build starts, so the device doesn't need to be
+available in the fakemachine.
+
+Yaml syntax:
+ - action: mkfs
+   device: path
+   fs: filesystem
+   label: label
+   fsuuid: string
+   features: list of filesystem features
+   options: list of options
+
+Mandatory properties:
+
+- device -- path of the device or partition to format, e.g. '/dev/sdb1'.
+Relative paths are resolved against the artifact directory, which allows to
+format image files. Mounted devices are refused.
+
+- fs -- filesystem type to create, e.g. 'ext4', 'vfat', 'btrfs' or 'xfs',
+like for the partitions of the 'image-partition' action.
+
+Optional properties:
+
+- label -- label of the filesystem.
+
+- fsuuid -- filesystem UUID. This option is only supported for btrfs, ext2,
+ext3, ext4 and xfs.
+
+- features -- list of additional filesystem features to enable.
+
+- options -- list of additional arguments passed as is to the mkfs command.
+*/
+package actions
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+type MkfsAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Device           string
+	FS               string
+	Label            string
+	FSUUID           string
+	Features         []string
+	Options          []string
+}
+
+// isMounted checks whether the device is mounted on the host
+func isMounted(device string) (bool, error) {
+	device, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return false, err
+	}
+
+	mounts, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return false, err
+	}
+	defer mounts.Close()
+
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		source := strings.Fields(scanner.Text())[0]
+		if resolved, err := filepath.EvalSymlinks(source); err == nil && resolved == device {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+func (m *MkfsAction) Verify(context *debos.DebosContext) error {
+	if m.Device == "" {
+		return fmt.Errorf("'device' property can't be empty")
+	}
+	// lvm only marks the physical volumes of image-partition
+	if m.FS == "" || m.FS == "none" || m.FS == "lvm" {
+		return fmt.Errorf("'fs' property must be set to a filesystem")
+	}
+
+	if !path.IsAbs(m.Device) {
+		m.Device = path.Join(context.Artifactdir, m.Device)
+	}
+
+	// The device is formatted and thus checked on the host only
+	if fakemachine.InMachine() {
+		return nil
+	}
+
+	fi, err := os.Stat(m.Device)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeDevice == 0 && !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is neither a device nor a file", m.Device)
+	}
+
+	mounted, err := isMounted(m.Device)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return fmt.Errorf("Refusing to format %s which is mounted", m.Device)
+	}
+
+	cmdline := mkfsCommand(m.FS, m.Label, m.Features, m.FSUUID)
+	if len(cmdline) == 0 {
+		return fmt.Errorf("Unsupported filesystem '%s'", m.FS)
+	}
+	return debos.CheckBinaries(cmdline[0])
+}
+
+func (m *MkfsAction) Summary() string {
+	return fmt.Sprintf("Create %s filesystem on %s", m.FS, m.Device)
+}
+
+func (m *MkfsAction) format() error {
+	m.LogStart()
+
+	cmdline := mkfsCommand(m.FS, m.Label, m.Features, m.FSUUID)
+	cmdline = append(cmdline, m.Options...)
+	cmdline = append(cmdline, m.Device)
+
+	return debos.Command{}.Run("mkfs", cmdline...)
+}
+
+func (m *MkfsAction) PreMachine(context *debos.DebosContext, machine *fakemachine.Machine, args *[]string) error {
+	return m.format()
+}
+
+func (m *MkfsAction) PreNoMachine(context *debos.DebosContext) error {
+	return m.format()
+}
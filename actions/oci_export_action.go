@@ -0,0 +1,356 @@
+/*
+OciExport Action
+
+Export the target filesystem as a container image, loadable with
+'docker load', 'podman load' or 'skopeo'. The filesystem makes up the single
+layer of the image.
+
+Yaml syntax:
+ - action: oci-export
+   file: image.tar
+   image: name:tag
+   format: oci
+   entrypoint:
+     - /bin/sh
+   cmd:
+     - -c
+     - command
+   env:
+     - VARIABLE=value
+   workdir: /
+   labels:
+     key: value
+
+Mandatory properties:
+
+- file -- name of the image archive, relative to the artifact directory.
+
+- image -- reference of the image, e.g. 'debos/rootfs:bookworm' or
+'registry.example.org:5000/rootfs'. The tag is 'latest' if not given.
+
+Optional properties:
+
+- format -- format of the archive: 'oci' (default) for an OCI image layout,
+e.g. for 'skopeo copy oci-archive:image.tar ...', or 'docker' for the format
+of 'docker save', e.g. for 'docker load -i image.tar'.
+
+- entrypoint -- entrypoint of the containers, as a list of arguments.
+
+- cmd -- default arguments of the entrypoint, or command when there is no
+entrypoint, as a list of arguments.
+
+- env -- list of environment variables of the containers, as 'NAME=value'.
+
+- workdir -- working directory of the containers.
+
+- labels -- map of labels of the image.
+
+The image is created with the current date, or the date given by the
+SOURCE_DATE_EPOCH environment variable.
+*/
+package actions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-debos/debos"
+)
+
+const (
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType    = "application/vnd.oci.image.layer.v1.tar"
+)
+
+// Image platforms of the Debian architectures
+var ociPlatforms = map[string]struct{ arch, variant string }{
+	"amd64":    {"amd64", ""},
+	"arm64":    {"arm64", "v8"},
+	"armhf":    {"arm", "v7"},
+	"armel":    {"arm", "v5"},
+	"i386":     {"386", ""},
+	"mips64el": {"mips64le", ""},
+	"mipsel":   {"mipsle", ""},
+	"ppc64el":  {"ppc64le", ""},
+	"riscv64":  {"riscv64", ""},
+	"s390x":    {"s390x", ""},
+}
+
+// Image reference, with an optional registry host and tag
+var ociReferenceRe = regexp.MustCompile(`^(?:[a-zA-Z0-9-]+(?:\.[a-zA-Z0-9-]+)*(?::[0-9]+)?/)?` +
+	`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+	`(?::[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127})?$`)
+
+type OciExportAction struct {
+	debos.BaseAction `yaml:",inline"`
+	File             string
+	Image            string
+	Format           string
+	Entrypoint       []string
+	Cmd              []string
+	Env              []string
+	Workdir          string
+	Labels           map[string]string
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociConfig struct {
+	Created      string `json:"created"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+	OS           string `json:"os"`
+	Config       struct {
+		Entrypoint []string          `json:"Entrypoint,omitempty"`
+		Cmd        []string          `json:"Cmd,omitempty"`
+		Env        []string          `json:"Env,omitempty"`
+		WorkingDir string            `json:"WorkingDir,omitempty"`
+		Labels     map[string]string `json:"Labels,omitempty"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []ociHistory `json:"history"`
+}
+
+type ociHistory struct {
+	Created   string `json:"created"`
+	CreatedBy string `json:"created_by"`
+}
+
+func NewOciExportAction() *OciExportAction {
+	return &OciExportAction{Format: "oci"}
+}
+
+// reference splits the image reference into its name and tag
+func (oci *OciExportAction) reference() (string, string) {
+	name, tag := oci.Image, "latest"
+	if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		name, tag = name[:idx], name[idx+1:]
+	}
+	return name, tag
+}
+
+func (oci *OciExportAction) Verify(context *debos.DebosContext) error {
+	if oci.File == "" {
+		return fmt.Errorf("'file' property can't be empty")
+	}
+
+	if !ociReferenceRe.MatchString(oci.Image) {
+		return fmt.Errorf("Invalid image reference '%s'", oci.Image)
+	}
+
+	if oci.Format != "oci" && oci.Format != "docker" {
+		return fmt.Errorf("Unsupported image format '%s', either 'oci' or 'docker'", oci.Format)
+	}
+
+	if _, found := ociPlatforms[context.Architecture]; !found {
+		return fmt.Errorf("Unsupported architecture '%s' for container images", context.Architecture)
+	}
+
+	for _, e := range oci.Env {
+		if !strings.Contains(e, "=") {
+			return fmt.Errorf("Invalid environment variable '%s', expected 'NAME=value'", e)
+		}
+	}
+
+	return debos.CheckBinaries("tar")
+}
+
+func (oci *OciExportAction) Summary() string {
+	return fmt.Sprintf("Export rootfs as %s image %s to %s", oci.Format, oci.Image, oci.File)
+}
+
+// writeBlob writes data in the OCI layout and returns its descriptor
+func writeBlob(dir, mediaType string, data []byte) (ociDescriptor, error) {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	err := ioutil.WriteFile(path.Join(dir, "blobs/sha256", digest), data, 0644)
+	return ociDescriptor{MediaType: mediaType, Digest: "sha256:" + digest, Size: int64(len(data))}, err
+}
+
+// writeLayer writes the tarball of the rootfs to file and returns its digest
+func (oci *OciExportAction) writeLayer(context *debos.DebosContext, file string, epoch time.Time, reproducible bool) (string, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	command := []string{"tar", "-c"}
+	command = append(command, debos.TarXattrsOptions...)
+	if reproducible {
+		command = append(command, "--sort=name", "--clamp-mtime",
+			fmt.Sprintf("--mtime=@%d", epoch.Unix()),
+			"--pax-option=exthdr.name=%d/PaxHeaders/%f,delete=atime,delete=ctime")
+	}
+	command = append(command, "-f", "-", "-C", context.Rootdir, ".")
+
+	hash := sha256.New()
+	cmd := debos.Command{Stdout: io.MultiWriter(f, hash)}
+	if err := cmd.Run("Exporting layer", command...); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), f.Close()
+}
+
+func (oci *OciExportAction) Run(context *debos.DebosContext) error {
+	oci.LogStart()
+
+	workdir, err := ioutil.TempDir(context.Scratchdir, "oci")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workdir)
+
+	epoch, reproducible, err := debos.SourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	if !reproducible {
+		epoch = time.Now()
+	}
+	created := epoch.UTC().Format(time.RFC3339)
+
+	layerfile := path.Join(workdir, "layer.tar")
+	layerDigest, err := oci.writeLayer(context, layerfile, epoch, reproducible)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(layerfile)
+	if err != nil {
+		return err
+	}
+	layer := ociDescriptor{MediaType: ociLayerMediaType, Digest: "sha256:" + layerDigest, Size: fi.Size()}
+
+	var config ociConfig
+	platform := ociPlatforms[context.Architecture]
+	config.Created = created
+	config.Architecture = platform.arch
+	config.Variant = platform.variant
+	config.OS = "linux"
+	config.Config.Entrypoint = oci.Entrypoint
+	config.Config.Cmd = oci.Cmd
+	config.Config.Env = oci.Env
+	config.Config.WorkingDir = oci.Workdir
+	config.Config.Labels = oci.Labels
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = []string{layer.Digest}
+	config.History = []ociHistory{{created, "debos"}}
+
+	configData, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	name, tag := oci.reference()
+	switch oci.Format {
+	case "docker":
+		err = oci.writeDocker(workdir, layerfile, layerDigest, configData, name+":"+tag)
+	default:
+		err = oci.writeOci(workdir, layerfile, layer, configData, name+":"+tag)
+	}
+	if err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(workdir)
+	if err != nil {
+		return err
+	}
+	command := []string{"tar", "-c", "-f", path.Join(context.Artifactdir, oci.File), "-C", workdir}
+	for _, e := range entries {
+		command = append(command, e.Name())
+	}
+
+	return debos.Command{}.Run("Exporting image", command...)
+}
+
+// writeOci lays out the image as an OCI image layout
+func (oci *OciExportAction) writeOci(dir, layerfile string, layer ociDescriptor, configData []byte, ref string) error {
+	if err := os.MkdirAll(path.Join(dir, "blobs/sha256"), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(layerfile, path.Join(dir, "blobs/sha256", strings.TrimPrefix(layer.Digest, "sha256:"))); err != nil {
+		return err
+	}
+
+	config, err := writeBlob(dir, ociConfigMediaType, configData)
+	if err != nil {
+		return err
+	}
+
+	manifestData, err := json.Marshal(struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		MediaType     string          `json:"mediaType"`
+		Config        ociDescriptor   `json:"config"`
+		Layers        []ociDescriptor `json:"layers"`
+	}{2, ociManifestMediaType, config, []ociDescriptor{layer}})
+	if err != nil {
+		return err
+	}
+	manifest, err := writeBlob(dir, ociManifestMediaType, manifestData)
+	if err != nil {
+		return err
+	}
+	manifest.Annotations = map[string]string{"org.opencontainers.image.ref.name": ref}
+
+	index, err := json.Marshal(struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		Manifests     []ociDescriptor `json:"manifests"`
+	}{2, []ociDescriptor{manifest}})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "index.json"), index, 0644); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+}
+
+// writeDocker lays out the image like 'docker save' does
+func (oci *OciExportAction) writeDocker(dir, layerfile, layerDigest string, configData []byte, ref string) error {
+	if err := os.Mkdir(path.Join(dir, layerDigest), 0755); err != nil {
+		return err
+	}
+	layer := path.Join(layerDigest, "layer.tar")
+	if err := os.Rename(layerfile, path.Join(dir, layer)); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(configData)
+	config := hex.EncodeToString(sum[:]) + ".json"
+	if err := ioutil.WriteFile(path.Join(dir, config), configData, 0644); err != nil {
+		return err
+	}
+
+	manifest, err := json.Marshal([]struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}{{config, []string{ref}, []string{layer}}})
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(dir, "manifest.json"), manifest, 0644)
+}
@@ -0,0 +1,150 @@
+/*
+OsRelease Action
+
+Set fields of the os-release(5) file of the target filesystem, e.g. to stamp
+the image with build information so deployed systems can report which image
+they're running. Existing fields are kept unless overridden.
+
+Yaml syntax:
+ - action: os-release
+   file: /etc/os-release
+   fields:
+     KEY: value
+
+Mandatory properties:
+
+- fields -- map of the fields to set, keys being upper case as in
+os-release(5). Values are quoted as needed. For example, with template
+variables given on the command line:
+ fields:
+   IMAGE_ID: my-image
+   IMAGE_VERSION: '{{ .version }}'
+   BUILD_ID: '{{ .git_sha }}'
+
+Optional properties:
+
+- file -- path of the file in the target filesystem, '/etc/os-release' by
+default. A symlink to the actual file, e.g. '/usr/lib/os-release', is followed.
+The file is created if it doesn't exist, e.g. for a separate
+'/etc/image-release'.
+*/
+package actions
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+var osReleaseKeyRe = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+type OsReleaseAction struct {
+	debos.BaseAction `yaml:",inline"`
+	File             string
+	Fields           map[string]string
+}
+
+func NewOsReleaseAction() *OsReleaseAction {
+	return &OsReleaseAction{File: "/etc/os-release"}
+}
+
+func (o *OsReleaseAction) Verify(context *debos.DebosContext) error {
+	if len(o.Fields) == 0 {
+		return fmt.Errorf("'fields' property can't be empty")
+	}
+
+	for key := range o.Fields {
+		if !osReleaseKeyRe.MatchString(key) {
+			return fmt.Errorf("Invalid os-release field '%s'", key)
+		}
+	}
+
+	_, err := debos.RestrictedPath(context.Rootdir, o.File)
+	return err
+}
+
+func (o *OsReleaseAction) Summary() string {
+	return fmt.Sprintf("Set %d fields of %s", len(o.Fields), o.File)
+}
+
+// quoteOsRelease quotes the value of a field like a shell string
+func quoteOsRelease(value string) string {
+	if value != "" && strings.IndexFunc(value, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._-:/", r))
+	}) < 0 {
+		return value
+	}
+
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// target returns the path of the file to update, following a symlink
+func (o *OsReleaseAction) target(context *debos.DebosContext) (string, error) {
+	file, err := debos.RestrictedPath(context.Rootdir, o.File)
+	if err != nil {
+		return "", err
+	}
+
+	link, err := os.Readlink(file)
+	if err != nil {
+		// Not a symlink
+		return file, nil
+	}
+	if !path.IsAbs(link) {
+		link = path.Join(path.Dir(o.File), link)
+	}
+	return debos.RestrictedPath(context.Rootdir, link)
+}
+
+func (o *OsReleaseAction) Run(context *debos.DebosContext) error {
+	o.LogStart()
+
+	file, err := o.target(context)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	content, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Override the existing fields in place
+	set := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		key := strings.SplitN(strings.TrimSpace(line), "=", 2)[0]
+		if value, found := o.Fields[key]; found && strings.Contains(line, "=") {
+			line = key + "=" + quoteOsRelease(value)
+			set[key] = true
+		}
+		lines = append(lines, line)
+	}
+
+	// Then append the new ones
+	var keys []string
+	for key := range o.Fields {
+		if !set[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, key+"="+quoteOsRelease(o.Fields[key]))
+	}
+
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
@@ -8,6 +8,7 @@ Yaml syntax:
    repository: repository name
    branch: branch name
    subject: commit message
+   body: detailed commit message
    collection-id: org.apertis.example
    ref-binding:
      - branch1
@@ -15,6 +16,8 @@ Yaml syntax:
    metadata:
      key: value
      vendor.key: somevalue
+   gpg-sign: key id
+   gpg-homedir: path to GnuPG home directory
 
 Mandatory properties:
 
@@ -30,12 +33,23 @@ Optional properties:
 
 - subject -- one line message with commit description.
 
+- body -- full description of the commit, e.g. release notes.
+
 - collection-id -- Collection ID ref binding (requires libostree 2018.6).
 
 - ref-binding -- enforce that the commit was retrieved from one of the branch names in this array.
   If 'collection-id' is set and 'ref-binding' is empty, will default to the branch name.
 
-- metadata -- key-value pairs of meta information to be added into commit.
+- metadata -- key-value pairs of meta information to be added into commit,
+e.g. 'version: 2024.1' for update servers to present the commit. Keys can't be
+empty nor contain '='.
+
+- gpg-sign -- GPG key ID to sign the commit with, e.g. for the clients to
+verify the updates they pull.
+
+- gpg-homedir -- GnuPG home directory holding the secret key to sign the
+commit with, relative to the recipe directory. Mandatory when 'gpg-sign' is
+set, the key being checked to be available before the recipe is run.
 */
 package actions
 
@@ -43,9 +57,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
 	"path"
+	"sort"
+	"strings"
 
 	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
 	"github.com/sjoerdsimons/ostree-go/pkg/otbuiltin"
 )
 
@@ -54,34 +72,96 @@ type OstreeCommitAction struct {
 	Repository       string
 	Branch           string
 	Subject          string
+	Body             string
 	Command          string
 	CollectionID     string   `yaml:"collection-id"`
 	RefBinding       []string `yaml:"ref-binding"`
 	Metadata         map[string]string
+	GpgSign          string `yaml:"gpg-sign"`
+	GpgHomedir       string `yaml:"gpg-homedir"`
 }
 
-func emptyDir(dir string) {
-	d, _ := os.Open(dir)
+func emptyDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
 	defer d.Close()
 
 	files, err := d.Readdirnames(-1)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	for _, f := range files {
 		err := os.RemoveAll(path.Join(dir, f))
 		if err != nil {
-			log.Fatalf("Failed to remove file: %v", err)
+			return fmt.Errorf("Failed to remove file: %v", err)
 		}
 	}
+
+	return nil
+}
+
+func (ot *OstreeCommitAction) Verify(context *debos.DebosContext) error {
+	for k := range ot.Metadata {
+		if strings.TrimSpace(k) == "" {
+			return fmt.Errorf("Metadata keys can't be empty")
+		}
+		if strings.Contains(k, "=") {
+			return fmt.Errorf("Invalid metadata key '%s': '=' is not allowed", k)
+		}
+	}
+
+	if ot.GpgSign == "" {
+		if ot.GpgHomedir != "" {
+			return fmt.Errorf("'gpg-homedir' is only used together with 'gpg-sign'")
+		}
+		return nil
+	}
+
+	if ot.GpgHomedir == "" {
+		return fmt.Errorf("'gpg-homedir' is needed to sign the commit with key %s", ot.GpgSign)
+	}
+
+	ot.GpgHomedir = debos.CleanPathAt(ot.GpgHomedir, context.RecipeDir)
+	if _, err := os.Stat(ot.GpgHomedir); err != nil {
+		return fmt.Errorf("Invalid 'gpg-homedir': %v", err)
+	}
+
+	/* A missing key would only make the commit fail once the whole rootfs
+	 * has been built, so look for it upfront */
+	if _, err := exec.LookPath("gpg"); err == nil {
+		cmd := exec.Command("gpg", "--homedir", ot.GpgHomedir, "--list-secret-keys", ot.GpgSign)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("Secret key %s not found in %s: %s", ot.GpgSign, ot.GpgHomedir, out)
+		}
+	}
+
+	return nil
+}
+
+func (ot *OstreeCommitAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	// The GnuPG home directory may be outside of the recipe directory
+	if ot.GpgHomedir != "" {
+		m.AddVolume(ot.GpgHomedir)
+	}
+
+	return nil
+}
+
+func (ot *OstreeCommitAction) Summary() string {
+	return fmt.Sprintf("Commit rootfs to branch %s of repository %s", ot.Branch, ot.Repository)
 }
 
 func (ot *OstreeCommitAction) Run(context *debos.DebosContext) error {
 	ot.LogStart()
 	repoPath := path.Join(context.Artifactdir, ot.Repository)
 
-	emptyDir(path.Join(context.Rootdir, "dev"))
+	err := emptyDir(path.Join(context.Rootdir, "dev"))
+	if err != nil {
+		return err
+	}
 
 	repo, err := otbuiltin.OpenRepo(repoPath)
 	if err != nil {
@@ -95,8 +175,16 @@ func (ot *OstreeCommitAction) Run(context *debos.DebosContext) error {
 
 	opts := otbuiltin.NewCommitOptions()
 	opts.Subject = ot.Subject
-	for k, v := range ot.Metadata {
-		str := fmt.Sprintf("%s=%s", k, v)
+	opts.Body = ot.Body
+
+	// Keep the metadata in a stable order for reproducible commits
+	keys := make([]string, 0, len(ot.Metadata))
+	for k := range ot.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		str := fmt.Sprintf("%s=%s", k, ot.Metadata[k])
 		opts.AddMetadataString = append(opts.AddMetadataString, str)
 	}
 
@@ -111,6 +199,19 @@ func (ot *OstreeCommitAction) Run(context *debos.DebosContext) error {
 	// Add values from 'ref-binding' if any
 	opts.RefBinding = append(opts.RefBinding, ot.RefBinding...)
 
+	epoch, found, err := debos.SourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	if found {
+		opts.Timestamp = epoch
+	}
+
+	if ot.GpgSign != "" {
+		opts.GpgSign = []string{ot.GpgSign}
+		opts.GpgHomedir = ot.GpgHomedir
+	}
+
 	ret, err := repo.Commit(context.Rootdir, ot.Branch, opts)
 	if err != nil {
 		return err
@@ -19,6 +19,14 @@ Yaml syntax:
    setup-kernel-cmdline: bool
    appendkernelcmdline: arguments
    collection-id: org.apertis.example
+   remote:
+     name: remote name
+     url: URL
+     content-url: URL
+     gpg-verify: bool
+     gpg-keyring: path to keyring
+     branches:
+       - branch name
 
 Mandatory properties:
 
@@ -47,17 +55,40 @@ action to the configured commandline.
 - tls-client-key-path -- path to client certificate key to use for the remote repository
 
 - collection-id -- Collection ID ref binding (require libostree 2018.6).
+
+- remote -- remote to configure in the deployment, for the installed system to
+be able to pull its updates. Written to '/etc/ostree/remotes.d/<name>.conf'.
+
+Optional properties for the remote:
+
+- url -- URL of the remote repository, mandatory to configure a remote.
+
+- name -- name of the remote, 'origin' by default.
+
+- content-url -- URL to fetch the content from when it differs from 'url',
+e.g. for a CDN.
+
+- gpg-verify -- whether the commits pulled from the remote must be signed,
+true by default.
+
+- gpg-keyring -- keyring holding the keys the commits are signed with, relative
+to the recipe directory. Without it the keys need to be provided in some other
+way when 'gpg-verify' is enabled.
+
+- branches -- branches to pull from the remote by default.
 */
 package actions
 
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
 
 	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
 	ostree "github.com/sjoerdsimons/ostree-go/pkg/otbuiltin"
 )
 
@@ -73,10 +104,22 @@ type OstreeDeployAction struct {
 	TlsClientCertPath   string `yaml:"tls-client-cert-path"`
 	TlsClientKeyPath    string `yaml:"tls-client-key-path"`
 	CollectionID        string `yaml:"collection-id"`
+	Remote              OstreeRemote
+}
+
+type OstreeRemote struct {
+	Name       string
+	Url        string
+	ContentUrl string `yaml:"content-url"`
+	GpgVerify  bool   `yaml:"gpg-verify"`
+	GpgKeyring string `yaml:"gpg-keyring"`
+	Branches   []string
 }
 
 func NewOstreeDeployAction() *OstreeDeployAction {
 	ot := &OstreeDeployAction{SetupFSTab: true, SetupKernelCmdline: true}
+	ot.Remote.Name = "origin"
+	ot.Remote.GpgVerify = true
 	ot.Description = "Deploying from ostree"
 	return ot
 }
@@ -103,6 +146,81 @@ func (ot *OstreeDeployAction) setupFSTab(deployment *ostree.Deployment, context
 	return err
 }
 
+/* setupRemote writes the configuration of the remote to pull the updates from
+ * into the deployment */
+func (ot *OstreeDeployAction) setupRemote(deployment *ostree.Deployment, context *debos.DebosContext) error {
+	deploymentDir := fmt.Sprintf("ostree/deploy/%s/deploy/%s.%d",
+		deployment.Osname(), deployment.Csum(), deployment.Deployserial())
+
+	remotesDir := path.Join(context.Rootdir, deploymentDir, "etc/ostree/remotes.d")
+	if err := os.MkdirAll(remotesDir, 0755); err != nil {
+		return err
+	}
+
+	var conf strings.Builder
+	fmt.Fprintf(&conf, "[remote \"%s\"]\n", ot.Remote.Name)
+	fmt.Fprintf(&conf, "url=%s\n", ot.Remote.Url)
+	if ot.Remote.ContentUrl != "" {
+		fmt.Fprintf(&conf, "contenturl=%s\n", ot.Remote.ContentUrl)
+	}
+	fmt.Fprintf(&conf, "gpg-verify=%t\n", ot.Remote.GpgVerify)
+	if ot.Remote.GpgKeyring != "" {
+		keyring := fmt.Sprintf("%s.gpg", ot.Remote.Name)
+		err := debos.CopyFile(ot.Remote.GpgKeyring, path.Join(remotesDir, keyring), 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&conf, "gpgkeypath=/etc/ostree/remotes.d/%s\n", keyring)
+	}
+	if len(ot.Remote.Branches) > 0 {
+		fmt.Fprintf(&conf, "branches=%s;\n", strings.Join(ot.Remote.Branches, ";"))
+	}
+	if ot.CollectionID != "" {
+		fmt.Fprintf(&conf, "collection-id=%s\n", ot.CollectionID)
+	}
+
+	conffile := path.Join(remotesDir, ot.Remote.Name+".conf")
+	return ioutil.WriteFile(conffile, []byte(conf.String()), 0644)
+}
+
+func (ot *OstreeDeployAction) Verify(context *debos.DebosContext) error {
+	if ot.Remote.Url == "" {
+		if ot.Remote.ContentUrl != "" || ot.Remote.GpgKeyring != "" || len(ot.Remote.Branches) > 0 {
+			return fmt.Errorf("The 'url' of the remote is mandatory to configure it")
+		}
+		return nil
+	}
+
+	if ot.Remote.Name == "" {
+		return fmt.Errorf("The name of the remote can't be empty")
+	}
+
+	if ot.Remote.GpgKeyring != "" {
+		ot.Remote.GpgKeyring = debos.CleanPathAt(ot.Remote.GpgKeyring, context.RecipeDir)
+		if _, err := os.Stat(ot.Remote.GpgKeyring); err != nil {
+			return fmt.Errorf("Invalid 'gpg-keyring' of the remote: %v", err)
+		}
+	} else if ot.Remote.GpgVerify {
+		debos.Warnf("gpg-verify is enabled for remote %s but no gpg-keyring is given, pulling updates will fail unless the keys are deployed otherwise",
+			ot.Remote.Name)
+	}
+
+	return nil
+}
+
+func (ot *OstreeDeployAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	// The keyring may be outside of the recipe directory
+	if ot.Remote.GpgKeyring != "" {
+		m.AddVolume(path.Dir(ot.Remote.GpgKeyring))
+	}
+
+	return nil
+}
+
+func (ot *OstreeDeployAction) Summary() string {
+	return fmt.Sprintf("Deploy branch %s of repository %s as os %s", ot.Branch, ot.Repository, ot.Os)
+}
+
 func (ot *OstreeDeployAction) Run(context *debos.DebosContext) error {
 	ot.LogStart()
 
@@ -192,6 +310,13 @@ func (ot *OstreeDeployAction) Run(context *debos.DebosContext) error {
 		}
 	}
 
+	if ot.Remote.Url != "" {
+		err = ot.setupRemote(deployment, context)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = sysroot.SimpleWriteDeployment(ot.Os, deployment, nil, 0, nil)
 	if err != nil {
 		return err
@@ -8,6 +8,16 @@ Yaml syntax:
    origin: name
    source: directory
    destination: directory
+   owner: user:group
+   preserve-owner: bool
+   templated: bool
+   templates:
+     - pattern
+   include:
+     - pattern
+   exclude:
+     - pattern
+   symlinks: keep
 
 Mandatory properties:
 
@@ -21,30 +31,263 @@ Optional properties:
 - destination -- absolute path in the target rootfs where 'source' will be copied.
 All existing files will be overwritten.
 If destination isn't set '/' of the rootfs will be used.
+
+- owner -- owner of the copied files and directories, as 'user' or 'user:group'.
+Names are looked up in the target rootfs, numeric ids are used as is. If the
+group is omitted the primary group of the user is used, or the same id as the
+user for a numeric user id.
+
+- preserve-owner -- keep the owner and group of the source files. Please keep
+in mind that the source files are usually owned by the user running debos.
+Mutually exclusive with 'owner'.
+
+- templated -- render the copied files through the template engine, with the
+same variables and functions as the recipe, e.g. '{{ .hostname }}'. Files are
+copied verbatim otherwise.
+
+- templates -- list of glob patterns restricting the files rendered by
+'templated', e.g. '*.conf' or 'etc/systemd/system/*.service'. Implies
+'templated'.
+
+- include -- list of glob patterns of the files to copy, all files are copied
+if unset. Directories are always copied, so only the files of the matching
+ones can be selected with e.g. 'etc/*'.
+
+- exclude -- list of glob patterns of the files and directories not to copy,
+e.g. '.git' or '*~'. Excluded directories are skipped with all their content.
+Exclusion takes precedence over 'include'.
+
+- symlinks -- how the targets of the symlinks are copied:
+ - keep -- as is, the default. Absolute targets are resolved in the target
+rootfs once booted, dangling symlinks being copied as well.
+ - rewrite -- absolute targets pointing into the overlay source on the host,
+e.g. created by 'ln -s $PWD/overlay/etc/foo', are rewritten to the matching
+path in the target rootfs.
+ - relative -- like 'rewrite', then all absolute targets are made relative to
+the symlink so they also resolve from the host, e.g. '/etc/alternatives/editor'
+becomes '../alternatives/editor' for a symlink in '/etc/vim'.
+
+The patterns of 'templates', 'include' and 'exclude' are matched against the
+path relative to 'source' and against the name of the file or directory.
+
+By default copied files are owned by the user running debos, which is root
+within fakemachine. Directories already existing in the
+target rootfs keep their owner and permissions.
 */
 package actions
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
 
 	"github.com/go-debos/debos"
 )
 
 type OverlayAction struct {
 	debos.BaseAction `yaml:",inline"`
-	Origin           string // origin of overlay, here the export from other action may be used
-	Source           string // external path there overlay is
-	Destination      string // path inside of rootfs
+	Origin           string   // origin of overlay, here the export from other action may be used
+	Source           string   // external path there overlay is
+	Destination      string   // path inside of rootfs
+	Owner            string   // owner of the copied files
+	PreserveOwner    bool     `yaml:"preserve-owner"`
+	Templated        bool     // render the files through the template engine
+	Templates        []string // patterns of the files to render
+	Include          []string // patterns of the files to copy
+	Exclude          []string // patterns of the files and directories to skip
+	Symlinks         string   // how the targets of the symlinks are copied
+	funcs            template.FuncMap
+	templateVars     map[string]interface{}
+	strictTemplates  bool
+}
+
+func (overlay *OverlayAction) setTemplateVars(funcs template.FuncMap, vars map[string]interface{}, strict bool) {
+	overlay.funcs = funcs
+	overlay.templateVars = vars
+	overlay.strictTemplates = strict
+}
+
+// matchPatterns tells whether the relative path or its base name matches
+func matchPatterns(patterns []string, relpath string) bool {
+	for _, pattern := range patterns {
+		if match, _ := filepath.Match(pattern, relpath); match {
+			return true
+		}
+		if match, _ := filepath.Match(pattern, filepath.Base(relpath)); match {
+			return true
+		}
+	}
+	return false
+}
+
+// isTemplate tells whether the file at the relative path must be rendered
+func (overlay *OverlayAction) isTemplate(relpath string) bool {
+	if len(overlay.Templates) == 0 {
+		return overlay.Templated
+	}
+	return matchPatterns(overlay.Templates, relpath)
+}
+
+// filter selects the entries of the source to copy
+func (overlay *OverlayAction) filter(relpath string, info os.FileInfo) bool {
+	if matchPatterns(overlay.Exclude, relpath) {
+		return false
+	}
+	if len(overlay.Include) == 0 || info.IsDir() {
+		return true
+	}
+	return matchPatterns(overlay.Include, relpath)
+}
+
+// symlinkTarget returns the target of the copy of a symlink whose target is
+// link. sourcedir is the overlay source on the host and linkpath the path of
+// the copy in the target rootfs.
+func (overlay *OverlayAction) symlinkTarget(sourcedir, linkpath, link string) string {
+	if overlay.Symlinks == "" || overlay.Symlinks == "keep" || !path.IsAbs(link) {
+		return link
+	}
+
+	if rel, err := filepath.Rel(sourcedir, link); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+		link = path.Join("/", overlay.Destination, rel)
+	}
+
+	if overlay.Symlinks == "relative" {
+		if rel, err := filepath.Rel(path.Dir(linkpath), link); err == nil {
+			link = rel
+		}
+	}
+
+	return link
+}
+
+// render writes the template src rendered with the recipe variables to dst
+func (overlay *OverlayAction) render(src, dst string, mode os.FileMode) error {
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	t := template.New(path.Base(src)).Funcs(overlay.funcs)
+	if overlay.strictTemplates {
+		t.Option("missingkey=error")
+	}
+	t, err = t.Parse(string(content))
+	if err != nil {
+		return err
+	}
+
+	data := new(bytes.Buffer)
+	if err := t.Execute(data, overlay.templateVars); err != nil {
+		return err
+	}
+
+	// Replace the destination rather than writing through its links
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := ioutil.WriteFile(dst, data.Bytes(), mode); err != nil {
+		return err
+	}
+	return os.Chmod(dst, mode)
+}
+
+// lookupId returns the id and the fourth field of the entry for name in a
+// passwd(5) or group(5) formatted file; for passwd that's the primary group.
+func lookupId(file, name string) (int, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 4 || fields[0] != name {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		return id, fields[3], err
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, "", err
+	}
+
+	return 0, "", fmt.Errorf("'%s' not found in %s", name, file)
+}
+
+// owner resolves the 'owner' property against the target rootfs
+func (overlay *OverlayAction) owner(context *debos.DebosContext) (uid int, gid int, err error) {
+	owner := strings.SplitN(overlay.Owner, ":", 2)
+
+	primary := ""
+	if uid, err = strconv.Atoi(owner[0]); err != nil {
+		uid, primary, err = lookupId(path.Join(context.Rootdir, "etc/passwd"), owner[0])
+		if err != nil {
+			return
+		}
+	} else if len(owner) == 1 {
+		// Numeric user without group
+		gid = uid
+		return
+	}
+
+	if len(owner) == 1 {
+		gid, err = strconv.Atoi(primary)
+		return
+	}
+
+	if gid, err = strconv.Atoi(owner[1]); err != nil {
+		gid, _, err = lookupId(path.Join(context.Rootdir, "etc/group"), owner[1])
+	}
+	return
 }
 
 func (overlay *OverlayAction) Verify(context *debos.DebosContext) error {
 	if _, err := debos.RestrictedPath(context.Rootdir, overlay.Destination); err != nil {
 		return err
 	}
+
+	if len(overlay.Owner) > 0 && overlay.PreserveOwner {
+		return errors.New("Properties 'owner' and 'preserve-owner' are mutually exclusive")
+	}
+
+	switch overlay.Symlinks {
+	case "", "keep", "rewrite", "relative":
+	default:
+		return fmt.Errorf("Invalid symlinks policy '%s', either 'keep', 'rewrite' or 'relative'", overlay.Symlinks)
+	}
+
+	patterns := append(append(append([]string{}, overlay.Templates...), overlay.Include...), overlay.Exclude...)
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid pattern '%s': %v", pattern, err)
+		}
+	}
+
 	return nil
 }
 
+func (overlay *OverlayAction) Summary() string {
+	origin := "recipe"
+	if len(overlay.Origin) > 0 {
+		origin = overlay.Origin
+	}
+	destination := overlay.Destination
+	if len(destination) == 0 {
+		destination = "/"
+	}
+	return fmt.Sprintf("Overlay '%s' from %s on %s", overlay.Source, origin, destination)
+}
+
 func (overlay *OverlayAction) Run(context *debos.DebosContext) error {
 	overlay.LogStart()
 	origin := context.RecipeDir
@@ -63,5 +306,55 @@ func (overlay *OverlayAction) Run(context *debos.DebosContext) error {
 		return err
 	}
 
-	return debos.CopyTree(sourcedir, destination)
+	options := debos.CopyTreeOptions{PreserveOwner: overlay.PreserveOwner}
+	if len(overlay.Owner) > 0 {
+		options.ForceOwner = true
+		options.Uid, options.Gid, err = overlay.owner(context)
+		if err != nil {
+			return fmt.Errorf("Couldn't resolve owner '%s': %v", overlay.Owner, err)
+		}
+	}
+
+	options.Record = func(src, dst string, info os.FileInfo) error {
+		kind := "file"
+		switch {
+		case info.IsDir():
+			kind = "directory"
+		case info.Mode()&os.ModeSymlink != 0:
+			kind = "symlink"
+		}
+		return debos.RecordFile(debos.FileRecord{
+			Action:      "overlay",
+			Source:      src,
+			Destination: path.Join("/", strings.TrimPrefix(dst, context.Rootdir)),
+			Type:        kind,
+		})
+	}
+
+	if len(overlay.Include) > 0 || len(overlay.Exclude) > 0 {
+		options.Filter = overlay.filter
+	}
+
+	options.Symlink = func(src, dst, link string) string {
+		linkpath := path.Join("/", strings.TrimPrefix(dst, context.Rootdir))
+		return overlay.symlinkTarget(sourcedir, linkpath, link)
+	}
+
+	if overlay.Templated || len(overlay.Templates) > 0 {
+		options.Copy = func(src, dst string, mode os.FileMode) error {
+			relpath, err := filepath.Rel(sourcedir, src)
+			if err != nil || relpath == "." {
+				relpath = filepath.Base(src)
+			}
+			if !overlay.isTemplate(relpath) {
+				return debos.CopyFile(src, dst, mode)
+			}
+			if err := overlay.render(src, dst, mode); err != nil {
+				return fmt.Errorf("Failed to render template: %v", err)
+			}
+			return nil
+		}
+	}
+
+	return debos.CopyTreeWithOptions(sourcedir, destination, options)
 }
@@ -1,12 +1,15 @@
 /*
 Pack Action
 
-Create tarball with filesystem.
+Create tarball with filesystem. Extended attributes of the files, such as file
+capabilities, are stored in the tarball.
 
 Yaml syntax:
  - action: pack
    file: filename.ext
    compression: gz
+   level: 9
+   checksum: sha256
 
 Mandatory properties:
 
@@ -14,33 +17,44 @@ Mandatory properties:
 
 Optional properties:
 
-- compression -- compression type to use. Currently only 'gz', 'bzip2' and 'xz'
-compression types are supported. Use 'none' for uncompressed tarball. The 'gz'
-compression type will be used by default.
+- compression -- compression type to use. Currently 'gz', 'bzip2', 'xz' and
+'zstd' compression types are supported, 'gzip' being an alias of 'gz'. Use
+'none' for uncompressed tarball. The 'gz' compression type will be used by
+default. The 'xz' and 'zstd' compressors use all the available CPUs.
 
+- level -- compression level, from 1 to 9 (19 for 'zstd'). By default the
+default level of the compressor is used.
+
+- checksum -- hash algorithm used to write the checksum of the tarball next to
+it, in a file named after the tarball with the algorithm as extension, e.g.
+'rootfs.tar.gz.sha256'. Either 'sha256', 'sha512' or 'md5'. The checksum is
+computed while the tarball is written and the file is compatible with
+sha256sum(1) and friends. See the 'verify' property of the 'Unpack' action.
+
+The compression type of tarballs is detected when unpacking them, see the
+'Unpack' action.
 */
 package actions
 
 import (
+	"encoding/hex"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	"os"
 	"path"
+	"strconv"
 	"strings"
 
 	"github.com/go-debos/debos"
 )
 
-var tarOpts = map[string]string{
-	"gz":    "z",
-	"bzip2": "j",
-	"xz":    "J",
-	"none":  "",
-}
-
 type PackAction struct {
 	debos.BaseAction `yaml:",inline"`
 	Compression      string
+	Level            int
 	File             string
+	Checksum         string
 }
 
 func NewPackAction() *PackAction {
@@ -52,27 +66,107 @@ func NewPackAction() *PackAction {
 }
 
 func (pf *PackAction) Verify(context *debos.DebosContext) error {
-	_, compressionAvailable := tarOpts[pf.Compression]
-	if compressionAvailable {
+	if pf.Compression == "gzip" {
+		pf.Compression = "gz"
+	}
+
+	if _, found := hashAlgorithms[pf.Checksum]; pf.Checksum != "" && !found {
+		return fmt.Errorf("Unsupported checksum algorithm %s", pf.Checksum)
+	}
+
+	if pf.Compression == "none" {
+		if pf.Level != 0 {
+			return fmt.Errorf("Option 'level' requires compression")
+		}
 		return nil
 	}
 
-	possibleTypes := make([]string, 0, len(tarOpts))
-	for key := range tarOpts {
-		possibleTypes = append(possibleTypes, key)
+	compressor, compressionAvailable := compressors[pf.Compression]
+	if !compressionAvailable {
+		possibleTypes := []string{"none"}
+		for key := range compressors {
+			possibleTypes = append(possibleTypes, key)
+		}
+
+		return fmt.Errorf("Option 'compression' has an unsupported type: `%s`. Possible types are %s.",
+			pf.Compression, strings.Join(possibleTypes, ", "))
 	}
 
-	return fmt.Errorf("Option 'compression' has an unsupported type: `%s`. Possible types are %s.",
-		pf.Compression, strings.Join(possibleTypes, ", "))
+	if pf.Level < 0 || pf.Level > compressor.maxLevel {
+		return fmt.Errorf("Compression level for %s should be between 1 and %d",
+			pf.Compression, compressor.maxLevel)
+	}
+
+	if err := debos.CheckBinaries("tar", compressor.command); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (pf *PackAction) Summary() string {
+	return fmt.Sprintf("Pack rootfs to %s (compression: %s)", pf.File, pf.Compression)
+}
+
+// compressProgram returns the compressor command line used by tar
+func (pf *PackAction) compressProgram() string {
+	program := []string{compressors[pf.Compression].command}
+	if pf.Level > 0 {
+		program = append(program, "-"+strconv.Itoa(pf.Level))
+	}
+	if pf.Compression == "xz" || pf.Compression == "zstd" {
+		program = append(program, "-T0")
+	}
+
+	return strings.Join(program, " ")
 }
 
 func (pf *PackAction) Run(context *debos.DebosContext) error {
 	pf.LogStart()
 	outfile := path.Join(context.Artifactdir, pf.File)
 
-	var tarOpt = "cf" + tarOpts[pf.Compression]
-	log.Printf("Compressing to %s\n", outfile)
-	return debos.Command{}.Run("Packing", "tar", tarOpt, outfile,
-		"--xattrs", "--xattrs-include=*.*",
-		"-C", context.Rootdir, ".")
+	command := []string{"tar", "-c"}
+	if pf.Compression != "none" {
+		command = append(command, "--use-compress-program="+pf.compressProgram())
+	}
+	command = append(command, debos.TarXattrsOptions...)
+
+	// Make the tarball reproducible
+	epoch, found, err := debos.SourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	if found {
+		command = append(command, "--sort=name", "--clamp-mtime",
+			fmt.Sprintf("--mtime=@%d", epoch.Unix()),
+			"--pax-option=exthdr.name=%d/PaxHeaders/%f,delete=atime,delete=ctime")
+	}
+
+	debos.Infof("Compressing to %s\n", outfile)
+	if pf.Checksum == "" {
+		command = append(command, "-f", outfile, "-C", context.Rootdir, ".")
+		return debos.Command{}.Run("Packing", command...)
+	}
+
+	// Hash the tarball while it's being written
+	f, err := os.Create(outfile)
+	if err != nil {
+		return fmt.Errorf("Couldn't create %s: %v", outfile, err)
+	}
+	defer f.Close()
+
+	hash := hashAlgorithms[pf.Checksum]()
+	cmd := debos.Command{Stdout: io.MultiWriter(f, hash)}
+	command = append(command, "-f", "-", "-C", context.Rootdir, ".")
+	if err := cmd.Run("Packing", command...); err != nil {
+		return err
+	}
+
+	sidecar := fmt.Sprintf("%s  %s\n", hex.EncodeToString(hash.Sum(nil)), path.Base(pf.File))
+	err = ioutil.WriteFile(outfile+"."+pf.Checksum, []byte(sidecar), 0644)
+	if err != nil {
+		return fmt.Errorf("Couldn't write checksum: %v", err)
+	}
+
+	return f.Close()
 }
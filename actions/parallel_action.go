@@ -0,0 +1,241 @@
+/*
+Parallel Action
+
+Run a group of independent actions concurrently, e.g. several downloads or
+overlays, to speed up the build. The actions of the group are all done before
+the next action of the recipe starts.
+
+As the actions run at the same time they must not depend on each other, e.g.
+an overlay can't use the origin of a download of the same group, and should
+not modify the same files. Only the following actions can be part of a group:
+'download', 'overlay', 'unpack' and 'run' outside of the chroot, actions
+running in the chroot or setting up the image being sequential by nature.
+
+Yaml syntax:
+ - action: parallel
+   jobs: 4
+   actions:
+     - action: download
+       url: https://example.org/firmware.tar.gz
+       name: firmware
+     - action: overlay
+       source: overlays/common
+
+Mandatory properties:
+
+- actions -- list of the actions to run concurrently, with the same syntax as
+the actions of the recipe, including 'if' and 'foreach'.
+
+Optional properties:
+
+- jobs -- maximum number of actions running at the same time, the number of
+CPUs by default.
+
+When an action fails no more actions of the group are started, the failures
+of the actions already running being all reported.
+*/
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+type ParallelAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Jobs             int
+	Actions          []YamlAction
+	contexts         []*debos.DebosContext // Contexts of the started actions
+}
+
+func (p *ParallelAction) setTemplateVars(funcs template.FuncMap, vars map[string]interface{}, strict bool) {
+	for _, a := range p.Actions {
+		if ta, ok := a.Action.(templatedAction); ok {
+			ta.setTemplateVars(funcs, vars, strict)
+		}
+	}
+}
+
+func (p *ParallelAction) Verify(context *debos.DebosContext) error {
+	if len(p.Actions) == 0 {
+		return errors.New("'actions' property can't be empty")
+	}
+	if p.Jobs < 0 {
+		return fmt.Errorf("Invalid number of jobs %d", p.Jobs)
+	}
+
+	for _, a := range p.Actions {
+		switch action := a.Action.(type) {
+		case *DownloadAction, *OverlayAction, *UnpackAction:
+		case *RunAction:
+			if action.Chroot {
+				return fmt.Errorf("Action `%s` can't run in parallel in the chroot", a)
+			}
+		default:
+			return fmt.Errorf("Action `%s` can't run in parallel", a)
+		}
+
+		if err := a.Verify(context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *ParallelAction) Summary() string {
+	summary := []string{fmt.Sprintf("Run %d actions in parallel", len(p.Actions))}
+	for _, a := range p.Actions {
+		summary = append(summary, fmt.Sprintf("  - %s", a))
+		if s := a.Summary(); s != "" {
+			for _, line := range strings.Split(s, "\n") {
+				summary = append(summary, "    "+line)
+			}
+		}
+	}
+	return strings.Join(summary, "\n")
+}
+
+func (p *ParallelAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	for _, a := range p.Actions {
+		if err := a.PreMachine(context, m, args); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *ParallelAction) PreNoMachine(context *debos.DebosContext) error {
+	for _, a := range p.Actions {
+		if err := a.PreNoMachine(context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/* actionContext gives an action of the group its own copy of the context, so
+ * the origins it adds don't race with the other actions */
+func actionContext(context *debos.DebosContext) *debos.DebosContext {
+	common := *context.CommonContext
+	common.Origins = make(map[string]string, len(context.Origins))
+	for k, v := range context.Origins {
+		common.Origins[k] = v
+	}
+
+	return &debos.DebosContext{&common, context.RecipeDir, context.Architecture}
+}
+
+func (p *ParallelAction) Run(context *debos.DebosContext) error {
+	p.LogStart()
+
+	jobs := p.Jobs
+	if jobs == 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	p.contexts = make([]*debos.DebosContext, len(p.Actions))
+	errs := make([]error, len(p.Actions))
+
+	var lock sync.Mutex
+	failed := false
+	slots := make(chan struct{}, jobs)
+	var running sync.WaitGroup
+	for i, a := range p.Actions {
+		slots <- struct{}{}
+
+		lock.Lock()
+		stop := failed
+		lock.Unlock()
+		if stop || debos.Interrupted() {
+			break
+		}
+
+		p.contexts[i] = actionContext(context)
+		running.Add(1)
+		go func(i int, a YamlAction) {
+			defer running.Done()
+			defer func() { <-slots }()
+
+			if err := a.Run(p.contexts[i]); err != nil {
+				lock.Lock()
+				errs[i] = fmt.Errorf("Action `%s` failed: %v", a, err)
+				failed = true
+				lock.Unlock()
+			}
+		}(i, a)
+	}
+	running.Wait()
+
+	// Make the origins added by the actions available to the next ones
+	for _, c := range p.contexts {
+		if c == nil {
+			continue
+		}
+		for k, v := range c.Origins {
+			context.Origins[k] = v
+		}
+	}
+
+	var failures []string
+	for _, err := range errs {
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	switch {
+	case len(failures) == 1:
+		return errors.New(failures[0])
+	case len(failures) > 1:
+		return fmt.Errorf("%d actions failed:\n%s", len(failures), strings.Join(failures, "\n"))
+	}
+
+	if debos.Interrupted() {
+		return errors.New("Interrupted")
+	}
+
+	return nil
+}
+
+func (p *ParallelAction) Cleanup(context *debos.DebosContext) error {
+	// Only the started actions get cleaned up
+	for i, a := range p.Actions {
+		if i >= len(p.contexts) || p.contexts[i] == nil {
+			continue
+		}
+		if err := a.Cleanup(p.contexts[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *ParallelAction) PostMachine(context *debos.DebosContext) error {
+	for _, a := range p.Actions {
+		if err := a.PostMachine(context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *ParallelAction) PostMachineCleanup(context *debos.DebosContext) error {
+	for _, a := range p.Actions {
+		if err := a.PostMachineCleanup(context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
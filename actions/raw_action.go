@@ -21,21 +21,34 @@ Optional properties:
 - offset -- offset in bytes for output image file.
 It is possible to use internal templating mechanism of debos to calculate offset
 with sectors (512 bytes) instead of bytes, for instance: '{{ sector 256 }}'.
-The default value is zero.
+The offset can also be given with a unit: a number of sectors with the 's'
+suffix, e.g. '2048s', or a size in human readable form, e.g. '8KiB' or '1MiB'
+for binary units and '1MB' for decimal ones. The default value is zero.
 
-- partition -- named partition to write to
+- partition -- named partition to write to, the offset is then relative to the
+start of the partition. This allows to keep bootloaders in sync with the
+partition layout, e.g. by writing them to a partition without filesystem.
+
+When writing to the image rather than a partition, the action fails if the data
+would overwrite the partition tables (the MBR partition entries, and the GPT
+headers and partition entries) or a partition holding a filesystem. The boot
+code area of the MBR (the first 440 bytes) can be written.
 */
 package actions
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"os/exec"
 	"path"
 	"strconv"
+	"strings"
 
+	"github.com/docker/go-units"
 	"github.com/go-debos/debos"
 )
 
@@ -48,6 +61,136 @@ type RawAction struct {
 	Partition        string // Partition to write otherwise full image
 }
 
+// parseRawOffset converts an offset in bytes, sectors or human readable form
+func parseRawOffset(offset string) (int64, error) {
+	var value int64
+	var err error
+
+	if len(offset) == 0 {
+		return 0, nil
+	}
+
+	if n, perr := strconv.ParseInt(offset, 0, 64); perr == nil {
+		value = n
+	} else if strings.HasSuffix(offset, "s") {
+		var n int
+		n, err = strconv.Atoi(strings.TrimSuffix(offset, "s"))
+		value = int64(sector(n))
+	} else if strings.Contains(strings.ToLower(offset), "i") {
+		value, err = units.RAMInBytes(offset)
+	} else {
+		value, err = units.FromHumanSize(offset)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't parse offset %s: %v", offset, err)
+	}
+	if value < 0 {
+		return 0, fmt.Errorf("Offset %s can't be negative", offset)
+	}
+
+	return value, nil
+}
+
+// Range of bytes in the image, end being exclusive
+type imageRegion struct {
+	start int64
+	end   int64
+	name  string
+}
+
+// partitionTableRegions returns the regions of the image holding the
+// partition tables, assuming 512 bytes sectors
+func partitionTableRegions(image *os.File) ([]imageRegion, error) {
+	var regions []imageRegion
+
+	mbr := make([]byte, 512)
+	if _, err := image.ReadAt(mbr, 0); err != nil {
+		return nil, err
+	}
+	if mbr[510] == 0x55 && mbr[511] == 0xaa {
+		regions = append(regions, imageRegion{446, 512, "MBR partition table"})
+	}
+
+	header := make([]byte, 512)
+	if _, err := image.ReadAt(header, 512); err != nil {
+		return nil, err
+	}
+	if string(header[0:8]) != "EFI PART" {
+		return regions, nil
+	}
+
+	backup := int64(binary.LittleEndian.Uint64(header[32:40])) * 512
+	entries := int64(binary.LittleEndian.Uint64(header[72:80])) * 512
+	size := int64(binary.LittleEndian.Uint32(header[80:84])) * int64(binary.LittleEndian.Uint32(header[84:88]))
+
+	regions = append(regions,
+		imageRegion{512, 1024, "GPT header"},
+		imageRegion{entries, entries + size, "GPT partition entries"},
+		imageRegion{backup - size, backup, "backup GPT partition entries"},
+		imageRegion{backup, backup + 512, "backup GPT header"})
+
+	return regions, nil
+}
+
+// partitionRegions returns the regions of the partitions holding a filesystem,
+// the other partitions being meant to receive raw data
+func partitionRegions(context *debos.DebosContext) []imageRegion {
+	var regions []imageRegion
+
+	for _, p := range context.ImagePartitions {
+		device, err := debos.RealPath(p.DevicePath)
+		if err != nil {
+			continue
+		}
+
+		fstype, _ := exec.Command("blkid", "-p", "-o", "value", "-s", "TYPE", device).Output()
+		if len(strings.TrimSpace(string(fstype))) == 0 {
+			continue
+		}
+
+		// Encrypted partitions have no start, their mapper device not being a partition
+		sysfs := path.Join("/sys/class/block", path.Base(device))
+		start, err := ioutil.ReadFile(path.Join(sysfs, "start"))
+		if err != nil {
+			continue
+		}
+		size, err := ioutil.ReadFile(path.Join(sysfs, "size"))
+		if err != nil {
+			continue
+		}
+
+		s, err1 := strconv.ParseInt(strings.TrimSpace(string(start)), 10, 64)
+		l, err2 := strconv.ParseInt(strings.TrimSpace(string(size)), 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		regions = append(regions, imageRegion{s * 512, (s + l) * 512, "partition " + p.Name})
+	}
+
+	return regions
+}
+
+// checkOverlap ensures data written to the image doesn't clobber the partition
+// tables or the partitions holding a filesystem
+func (raw *RawAction) checkOverlap(context *debos.DebosContext, target *os.File, offset int64, length int64) error {
+	regions, err := partitionTableRegions(target)
+	if err != nil {
+		return fmt.Errorf("Couldn't read partition table: %v", err)
+	}
+	regions = append(regions, partitionRegions(context)...)
+
+	for _, r := range regions {
+		if offset < r.end && offset+length > r.start {
+			return fmt.Errorf("Writing %d bytes at offset %d would overwrite the %s (bytes %d to %d)",
+				length, offset, r.name, r.start, r.end-1)
+		}
+	}
+
+	return nil
+}
+
 func (raw *RawAction) checkDeprecatedSyntax() error {
 
 	// New syntax is based on 'origin' and 'source'
@@ -55,8 +198,8 @@ func (raw *RawAction) checkDeprecatedSyntax() error {
 	// TODO: remove deprecated syntax verification
 	if len(raw.Path) > 0 {
 		// Deprecated syntax based on 'source' and 'path'
-		log.Printf("Usage of 'source' and 'path' properties is deprecated.")
-		log.Printf("Please use 'origin' and 'source' properties.")
+		debos.Warnf("Usage of 'source' and 'path' properties is deprecated.")
+		debos.Warnf("Please use 'origin' and 'source' properties.")
 		if len(raw.Origin) > 0 {
 			return errors.New("Can't mix 'origin' and 'path'(deprecated option) properties")
 		}
@@ -80,9 +223,25 @@ func (raw *RawAction) Verify(context *debos.DebosContext) error {
 		return errors.New("'origin' and 'source' properties can't be empty")
 	}
 
+	if _, err := parseRawOffset(raw.Offset); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+func (raw *RawAction) Summary() string {
+	target := "image"
+	if raw.Partition != "" {
+		target = fmt.Sprintf("partition %s", raw.Partition)
+	}
+	offset := raw.Offset
+	if len(offset) == 0 {
+		offset = "0"
+	}
+	return fmt.Sprintf("Write %s from %s to %s at offset %s", raw.Source, raw.Origin, target, offset)
+}
+
 func (raw *RawAction) Run(context *debos.DebosContext) error {
 	raw.LogStart()
 	origin, found := context.Origins[raw.Origin]
@@ -112,17 +271,30 @@ func (raw *RawAction) Run(context *debos.DebosContext) error {
 		devicePath = context.Image
 	}
 
-	target, err := os.OpenFile(devicePath, os.O_WRONLY, 0)
+	target, err := os.OpenFile(devicePath, os.O_RDWR, 0)
 	if err != nil {
 		return fmt.Errorf("Failed to open %s: %v", devicePath, err)
 	}
 	defer target.Close()
 
-	var offset int64 = 0
-	if len(raw.Offset) > 0 {
-		offset, err = strconv.ParseInt(raw.Offset, 0, 64)
+	offset, err := parseRawOffset(raw.Offset)
+	if err != nil {
+		return err
+	}
+
+	size, err := target.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("Couldn't get size of %s: %v", devicePath, err)
+	}
+	if offset+int64(len(content)) > size {
+		return fmt.Errorf("Writing %d bytes at offset %d exceeds the size of %s (%d bytes)",
+			len(content), offset, devicePath, size)
+	}
+
+	if raw.Partition == "" {
+		err = raw.checkOverlap(context, target, offset, int64(len(content)))
 		if err != nil {
-			return fmt.Errorf("Couldn't parse offset %v", err)
+			return err
 		}
 	}
 
@@ -6,6 +6,9 @@ Recipe syntax
 Recipe is a YAML file which is pre-processed though Golang
 text templating engine (https://golang.org/pkg/text/template)
 
+Recipes with the '.json' extension are parsed as JSON documents instead, with
+exactly the same properties as their YAML counterpart.
+
 Recipe is composed of 2 parts:
 
 - header
@@ -20,6 +23,10 @@ Comments are allowed and should be prefixed with '#' symbol.
  # Header
  architecture: arm64
 
+ # Optional list of recipes whose actions are run first
+ includes:
+   - base.yaml
+
  # Actions are executed in listed order
  actions:
    - action: ActionName1
@@ -29,24 +36,145 @@ Comments are allowed and should be prefixed with '#' symbol.
      # Use value of variable 'Var' defined above
      property2: {{$Var}}
 
+Template variables passed on the command line are strings, unless their value
+is prefixed with a type: 'int=', 'float=', 'bool=' or 'string=', e.g.
+'-t count:int=4' or '-t debug:bool=true'. Typed variables can be used as such in
+the templates, for instance '{{ if .debug }}'. The 'string=' prefix allows to
+pass strings starting with one of the prefixes unchanged. The variables can also
+be read from YAML or JSON files with '--template-vars-file', where numbers and
+booleans keep their type; '-t' takes precedence over the files.
+
+Undefined variables are rendered as '<no value>' by default. With
+'--strict-templates', referencing an undefined variable is an error naming it,
+which catches typos, and the variables passed on the command line but not used
+by the recipe are reported. Optional variables can still be used with the
+'index' function, e.g. '{{ $suite := or (index . "suite") "bookworm" }}'.
+
+Besides the template variables passed on the command line, the following
+functions can be used within the recipe:
+
+- sector -- convert a number of 512 bytes sectors to bytes, e.g. '{{ sector 256 }}'
+
+- env -- value of an environment variable of the debos process, e.g.
+'{{ env "CI_COMMIT_SHA" }}'. An unset variable results in an empty string.
+Please keep in mind the recipe is templated again inside fakemachine, where
+only the environment variables propagated to it are set (see '--environ-var').
+
+- add, sub, mul, div, mod -- integer arithmetic, e.g. '{{ add .start 64 }}' or
+'{{ sector (mul 1024 2048) }}'. Template variables need to be passed as 'int='
+to be used as numbers.
+
+- lower, upper -- convert a string to lower or upper case.
+
+- replace -- replace all occurrences of a string, e.g. '{{ replace "-" "_" .name }}'
+or '{{ .name | replace "-" "_" }}'.
+
+- trimPrefix -- remove a leading string, e.g. '{{ trimPrefix "v" .version }}'.
+
+- include -- contents of a file, relative to the directory of the recipe, e.g.
+'{{ include "packages.txt" }}'. The contents are inserted as is, without being
+templated or indented.
+
+- indent, nindent -- indent every line of a string by a number of spaces, to
+embed multi-line contents in a YAML block scalar, e.g.
+'{{ include "setup.sh" | indent 4 }}'. 'nindent' additionally starts with a
+newline so it can directly follow the '|' or '>' marker of the block scalar:
+
+ - action: run
+   chroot: true
+   command: |{{ include "setup.sh" | nindent 5 }}
+
+The number of spaces has to be larger than the indentation of the property
+holding the block scalar, and nothing may follow the block scalar marker except
+the template. With 'indent', the template has to start at the beginning of the
+line following the marker, as the first line gets indented too. Note '|' keeps
+the newlines of the contents, e.g. of a script, while '>' folds them.
+
 Mandatory properties for receipt:
 
 - architecture -- target architecture
 
 - actions -- at least one action should be listed
 
+Optional properties for receipt:
+
+- min-debos-version -- oldest version of debos able to build the recipe, e.g.
+'1.1'. Older versions refuse to build it, rather than failing on the actions
+or properties they don't know about. Any version is accepted if unset.
+
+- includes -- list of recipe files, relative to the directory of the recipe
+including them. The actions of the included recipes are inserted in the listed
+order before the actions of the including recipe. Included recipes are templated
+with the same template variables and may include other recipes themselves,
+however an include cycle is an error. The 'architecture' property can be
+omitted in an included recipe, otherwise it must match the including one.
+Please note that paths used by the included actions are still resolved relative
+to the directory of the top-level recipe.
+
+Properties common to all actions:
+
+- action -- name of the action, see the supported actions below.
+
+- description -- optional description of the action, used in the logs.
+
+- label -- optional name used to select actions with the '--only' and '--skip'
+command line options, several actions can have the same label. The 'run'
+action also uses it to label its output.
+
+- architecture -- optional Debian architecture to use for this action instead of
+the one of the recipe, e.g. to debootstrap a foreign root filesystem or to run
+a command for another architecture in a multi-architecture build. It applies to
+all the stages of the action and is restored afterwards.
+
+- if -- optional condition, the action being skipped entirely if it is false.
+It's usually computed using the template variables, for instance:
+ - action: overlay
+   if: '{{ eq .board "rpi4" }}'
+   source: overlays/rpi4
+The condition can be 'true', 'false', '1', '0' or any other boolean form
+accepted by https://golang.org/pkg/strconv/#ParseBool.
+
+- foreach -- optional list of items to repeat the action for, either as a list
+or as a string of comma or space separated values, so it can come from a
+template variable. The properties of the action are templated again for each
+item, using '[[' and ']]' as delimiters so they are left untouched when the
+recipe is first templated. Besides the template variables, '.item' is the
+current item and '.index' its position starting from 0. For instance:
+ - action: overlay
+   foreach: '{{ .boards }}'
+   source: 'overlays/[[ .item ]]'
+ - action: apt
+   foreach: [ vim, git ]
+   packages: [ '[[ .item ]]' ]
+Values starting with '[[' need to be quoted not to be taken as YAML lists. The
+'if' property of such an action is evaluated for each item.
+
 Supported actions
 
 - apt -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Apt_Action
 
+- compress -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Compress_Action
+
+- convert-image -- https://godoc.org/github.com/go-debos/debos/actions#hdr-ConvertImage_Action
+
 - debootstrap -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Debootstrap_Action
 
 - download -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Download_Action
 
 - filesystem-deploy -- https://godoc.org/github.com/go-debos/debos/actions#hdr-FilesystemDeploy_Action
 
+- grub -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Grub_Action
+
+- hash -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Hash_Action
+
 - image-partition -- https://godoc.org/github.com/go-debos/debos/actions#hdr-ImagePartition_Action
 
+- mkfs -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Mkfs_Action
+
+- oci-export -- https://godoc.org/github.com/go-debos/debos/actions#hdr-OciExport_Action
+
+- os-release -- https://godoc.org/github.com/go-debos/debos/actions#hdr-OsRelease_Action
+
 - ostree-commit -- https://godoc.org/github.com/go-debos/debos/actions#hdr-OstreeCommit_Action
 
 - ostree-deploy -- https://godoc.org/github.com/go-debos/debos/actions#hdr-OstreeDeploy_Action
@@ -55,26 +183,47 @@ Supported actions
 
 - pack -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Pack_Action
 
+- parallel -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Parallel_Action
+
 - raw -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Raw_Action
 
 - recipe -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Recipe_Action
 
+- resize -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Resize_Action
+
 - run -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Run_Action
 
+- systemd-unit -- https://godoc.org/github.com/go-debos/debos/actions#hdr-SystemdUnit_Action
+
 - unpack -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Unpack_Action
+
+- users -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Users_Action
+
+- write-device -- https://godoc.org/github.com/go-debos/debos/actions#hdr-WriteDevice_Action
+
+- zerofree -- https://godoc.org/github.com/go-debos/debos/actions#hdr-Zerofree_Action
 */
 package actions
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
 	"gopkg.in/yaml.v2"
+	"io/ioutil"
 	"path"
+	"sort"
 	"text/template"
+	"text/template/parse"
+	"unicode"
 	"log"
+	"os"
 	"strings"
 	"reflect"
+	"strconv"
 )
 
 /* the YamlAction just embed the Action interface and implements the
@@ -82,11 +231,148 @@ import (
  * specific action at unmarshaling time */
 type YamlAction struct {
 	debos.Action
+	label        string
+	architecture string // Overrides the architecture of the recipe if set
+
+	// Properties of an action to repeat, before templating its items
+	foreach []string
+	raw     yaml.MapSlice
 }
 
 type Recipe struct {
-	Architecture string
-	Actions      []YamlAction
+	Architecture    string
+	MinDebosVersion string `yaml:"min-debos-version" json:"min-debos-version"`
+	Includes        []string
+	Actions         []YamlAction
+
+	// Fail on references to undefined template variables
+	StrictTemplates bool `yaml:"-" json:"-"`
+	usedVars        map[string]bool
+}
+
+// Label returns the label of the action given in the recipe, if any
+func (y YamlAction) Label() string {
+	return y.label
+}
+
+/* withArchitecture overrides the architecture of the context for the action,
+ * the returned function restoring it */
+func (y YamlAction) withArchitecture(context *debos.DebosContext) func() {
+	if y.architecture == "" {
+		return func() {}
+	}
+	architecture := context.Architecture
+	context.Architecture = y.architecture
+	return func() { context.Architecture = architecture }
+}
+
+func (y YamlAction) Verify(context *debos.DebosContext) error {
+	if y.architecture != "" {
+		if err := debos.CheckArchitecture(y.architecture); err != nil {
+			return err
+		}
+	}
+
+	defer y.withArchitecture(context)()
+	return y.Action.Verify(context)
+}
+
+func (y YamlAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
+	defer y.withArchitecture(context)()
+	return y.Action.PreMachine(context, m, args)
+}
+
+func (y YamlAction) PreNoMachine(context *debos.DebosContext) error {
+	defer y.withArchitecture(context)()
+	return y.Action.PreNoMachine(context)
+}
+
+func (y YamlAction) Run(context *debos.DebosContext) error {
+	defer y.withArchitecture(context)()
+	return y.Action.Run(context)
+}
+
+func (y YamlAction) Cleanup(context *debos.DebosContext) error {
+	defer y.withArchitecture(context)()
+	return y.Action.Cleanup(context)
+}
+
+func (y YamlAction) PostMachine(context *debos.DebosContext) error {
+	defer y.withArchitecture(context)()
+	return y.Action.PostMachine(context)
+}
+
+func (y YamlAction) PostMachineCleanup(context *debos.DebosContext) error {
+	defer y.withArchitecture(context)()
+	return y.Action.PostMachineCleanup(context)
+}
+
+/* actionFactories maps the action property of the recipe to a function
+ * creating the matching action with its default values, more actions can be
+ * added with RegisterAction */
+var actionFactories = map[string]func() debos.Action{
+	"debootstrap":       func() debos.Action { return NewDebootstrapAction() },
+	"pack":              func() debos.Action { return NewPackAction() },
+	"unpack":            func() debos.Action { return &UnpackAction{} },
+	"run":               func() debos.Action { return &RunAction{} },
+	"apt":               func() debos.Action { return NewAptAction() },
+	"oci-export":        func() debos.Action { return NewOciExportAction() },
+	"os-release":        func() debos.Action { return NewOsReleaseAction() },
+	"ostree-commit":     func() debos.Action { return &OstreeCommitAction{} },
+	"ostree-deploy":     func() debos.Action { return NewOstreeDeployAction() },
+	"overlay":           func() debos.Action { return &OverlayAction{} },
+	"image-partition":   func() debos.Action { return NewImagePartitionAction() },
+	"mkfs":              func() debos.Action { return &MkfsAction{} },
+	"filesystem-deploy": func() debos.Action { return NewFilesystemDeployAction() },
+	"raw":               func() debos.Action { return &RawAction{} },
+	"compress":          func() debos.Action { return NewCompressAction() },
+	"convert-image":     func() debos.Action { return &ConvertImageAction{} },
+	"download":          func() debos.Action { return &DownloadAction{} },
+	"grub":              func() debos.Action { return NewGrubAction() },
+	"hash":              func() debos.Action { return NewHashAction() },
+	"recipe":            func() debos.Action { return &RecipeAction{} },
+	"parallel":          func() debos.Action { return &ParallelAction{} },
+	"systemd-unit":      func() debos.Action { return &SystemdUnitAction{} },
+	"users":             func() debos.Action { return &UsersAction{} },
+	"zerofree":          func() debos.Action { return &ZerofreeAction{} },
+	"resize":            func() debos.Action { return &ResizeAction{} },
+	"write-device":      func() debos.Action { return &WriteDeviceAction{} },
+}
+
+/*
+RegisterAction makes an action available to recipes under the given name,
+factory creating a new instance of it with its default values. This allows
+maintaining actions outside of this package, e.g. in a file of the debos
+command selected with build tags:
+
+	func init() {
+		actions.RegisterAction("my-action", func() debos.Action {
+			return &MyAction{}
+		})
+	}
+
+RegisterAction panics if the name is already in use, like for the built-in
+actions.
+*/
+func RegisterAction(name string, factory func() debos.Action) {
+	if factory == nil {
+		panic("actions: RegisterAction factory is nil")
+	}
+	if _, dup := actionFactories[name]; dup {
+		panic("actions: RegisterAction called twice for action " + name)
+	}
+	actionFactories[name] = factory
+}
+
+// ActionNames returns the sorted list of the known actions
+func ActionNames() []string {
+	names := make([]string, 0, len(actionFactories))
+	for name := range actionFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
 }
 
 func (y *YamlAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -97,46 +383,254 @@ func (y *YamlAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
-	switch aux.Action {
-	case "debootstrap":
-		y.Action = NewDebootstrapAction()
-	case "pack":
-		y.Action = NewPackAction()
-	case "unpack":
-		y.Action = &UnpackAction{}
-	case "run":
-		y.Action = &RunAction{}
-	case "apt":
-		y.Action = NewAptAction()
-	case "ostree-commit":
-		y.Action = &OstreeCommitAction{}
-	case "ostree-deploy":
-		y.Action = NewOstreeDeployAction()
-	case "overlay":
-		y.Action = &OverlayAction{}
-	case "image-partition":
-		y.Action = &ImagePartitionAction{}
-	case "filesystem-deploy":
-		y.Action = NewFilesystemDeployAction()
-	case "raw":
-		y.Action = &RawAction{}
-	case "download":
-		y.Action = &DownloadAction{}
-	case "recipe":
-		y.Action = &RecipeAction{}
-	default:
-		return fmt.Errorf("Unknown action: %v", aux.Action)
+	/* The foreach actions are expanded once the recipe is parsed, all their
+	 * properties (including the condition) depending on the item */
+	var repeat struct {
+		Foreach interface{}
+	}
+	if err := unmarshal(&repeat); err != nil {
+		return err
+	}
+	if repeat.Foreach != nil {
+		return y.setForeach(repeat.Foreach, unmarshal)
+	}
+
+	if len(aux.If) > 0 {
+		enabled, err := strconv.ParseBool(strings.TrimSpace(aux.If))
+		if err != nil {
+			return fmt.Errorf("Invalid 'if' condition for action %s: '%s'", aux.Action, aux.If)
+		}
+		// Disabled actions are dropped from the recipe once parsed
+		if !enabled {
+			y.Action = nil
+			return nil
+		}
+	}
+
+	/* The label isn't part of BaseAction as the run action has its own
+	 * label property, which is used for both */
+	var selection struct {
+		Label        string
+		Architecture string
 	}
+	if err := unmarshal(&selection); err != nil {
+		return err
+	}
+	y.label = selection.Label
+	y.architecture = selection.Architecture
+
+	factory, found := actionFactories[aux.Action]
+	if !found {
+		/* Report it as a type error so the parsing carries on and all the
+		 * unknown actions get reported at once */
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("Unknown action: %v", aux.Action)}}
+	}
+	y.Action = factory()
 
 	unmarshal(y.Action)
 
 	return nil
 }
 
+/* setForeach keeps the items and the properties of an action to repeat, the
+ * items being either a list or a string of comma or space separated values */
+func (y *YamlAction) setForeach(foreach interface{}, unmarshal func(interface{}) error) error {
+	y.Action = nil
+	y.foreach = []string{}
+
+	switch items := foreach.(type) {
+	case []interface{}:
+		for _, item := range items {
+			y.foreach = append(y.foreach, fmt.Sprint(item))
+		}
+	case string:
+		y.foreach = strings.FieldsFunc(items, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})
+	default:
+		return fmt.Errorf("Invalid 'foreach' for action: '%v', expected a list", foreach)
+	}
+
+	var raw yaml.MapSlice
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	for _, item := range raw {
+		if item.Key != "foreach" {
+			y.raw = append(y.raw, item)
+		}
+	}
+
+	return nil
+}
+
+/* expand creates an action for each item of a foreach action, templating its
+ * properties with the item */
+func (r *Recipe) expand(y YamlAction, funcs template.FuncMap, templateVars map[string]interface{}) ([]YamlAction, error) {
+	out, err := yaml.Marshal(y.raw)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := template.New("foreach").Delims("[[", "]]").Funcs(funcs).Option(r.missingKey()).Parse(string(out))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid 'foreach' action: %v", err)
+	}
+	usedTemplateVars(t.Tree.Root, r.usedVars)
+
+	var expanded []YamlAction
+	for index, item := range y.foreach {
+		vars := make(map[string]interface{}, len(templateVars)+2)
+		for k, v := range templateVars {
+			vars[k] = v
+		}
+		vars["item"] = item
+		vars["index"] = index
+
+		data := new(bytes.Buffer)
+		if err := t.Execute(data, vars); err != nil {
+			return nil, err
+		}
+
+		var a YamlAction
+		if err := yaml.Unmarshal(data.Bytes(), &a); err != nil {
+			return nil, unknownActionsError(err)
+		}
+		// Items can be disabled by their condition as well
+		if a.Action != nil {
+			expanded = append(expanded, a)
+		}
+	}
+
+	return expanded, nil
+}
+
+/* enabledActions expands the foreach actions and drops the ones disabled by
+ * their 'if' property, including the actions of parallel groups */
+func (r *Recipe) enabledActions(list []YamlAction, funcs template.FuncMap, templateVars map[string]interface{}) ([]YamlAction, error) {
+	var enabled []YamlAction
+	for _, a := range list {
+		if a.foreach != nil {
+			expanded, err := r.expand(a, funcs, templateVars)
+			if err != nil {
+				return nil, err
+			}
+			enabled = append(enabled, expanded...)
+		} else if a.Action != nil {
+			enabled = append(enabled, a)
+		}
+	}
+
+	for _, a := range enabled {
+		if p, ok := a.Action.(*ParallelAction); ok {
+			actions, err := r.enabledActions(p.Actions, funcs, templateVars)
+			if err != nil {
+				return nil, err
+			}
+			p.Actions = actions
+		}
+	}
+
+	return enabled, nil
+}
+
+/* Actions from a JSON recipe are converted back to YAML, so they get decoded
+ * by UnmarshalYAML and the yaml properties of the actions apply unchanged */
+func (y *YamlAction) UnmarshalJSON(data []byte) error {
+	var raw interface{}
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	out, err := yaml.Marshal(raw)
+	if err != nil {
+		return err
+	}
+
+	return unknownActionsError(yaml.Unmarshal(out, y))
+}
+
+/* unknownActionsError turns the type error gathering the unknown actions of a
+ * recipe back into a plain error listing them along with the valid ones,
+ * leaving other errors as is */
+func unknownActionsError(err error) error {
+	terr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return err
+	}
+
+	for _, e := range terr.Errors {
+		if !strings.HasPrefix(e, "Unknown action: ") {
+			return err
+		}
+	}
+
+	return fmt.Errorf("%s\nValid actions: %s", strings.Join(terr.Errors, "\n"),
+		strings.Join(ActionNames(), ", "))
+}
+
 func sector(s int) int {
 	return s * 512
 }
 
+func add(a, b int) int {
+	return a + b
+}
+
+func sub(a, b int) int {
+	return a - b
+}
+
+func mul(a, b int) int {
+	return a * b
+}
+
+func div(a, b int) (int, error) {
+	if b == 0 {
+		return 0, errors.New("division by zero")
+	}
+	return a / b, nil
+}
+
+func mod(a, b int) (int, error) {
+	if b == 0 {
+		return 0, errors.New("division by zero")
+	}
+	return a % b, nil
+}
+
+// Arguments are ordered so the string can be piped, e.g. '{{ .var | replace "a" "b" }}'
+func replace(old, new, s string) string {
+	return strings.Replace(s, old, new, -1)
+}
+
+func trimPrefix(prefix, s string) string {
+	return strings.TrimPrefix(s, prefix)
+}
+
+// indent prefixes each line with the number of spaces, e.g. '{{ .text | indent 4 }}'
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
+
+// nindent is indent starting with a newline, for use after a block scalar marker
+func nindent(spaces int, s string) string {
+	return "\n" + indent(spaces, s)
+}
+
+// include returns the template function reading files relative to the recipe
+func include(recipeDir string) func(string) (string, error) {
+	return func(name string) (string, error) {
+		data, err := ioutil.ReadFile(debos.CleanPathAt(name, recipeDir))
+		if err != nil {
+			return "", fmt.Errorf("Failed to include '%s': %v", name, err)
+		}
+		return string(data), nil
+	}
+}
+
 func DumpActionStruct(iface interface{}) string {
 	var a []string
 
@@ -218,24 +712,208 @@ Parse method reads YAML recipe file and map all steps to appropriate actions.
 
 - templateVars -- optional argument allowing to use custom map for templating
 engine. Multiple template maps have no effect; only first map will be used.
+
+With StrictTemplates set, referencing an undefined variable is an error and
+the variables not used by the recipe are reported.
 */
 func (r *Recipe) Parse(file string, printRecipe bool, dump bool, templateVars ...map[string]string) error {
-	t := template.New(path.Base(file))
-	funcs := template.FuncMap{
-		"sector": sector,
+	if len(templateVars) == 0 {
+		templateVars = append(templateVars, make(map[string]string))
+	}
+
+	vars, err := typedTemplateVars(templateVars[0])
+	if err != nil {
+		return err
+	}
+
+	// Only track the used variables while parsing
+	r.usedVars = make(map[string]bool)
+	defer func() { r.usedVars = nil }()
+	if err := r.parse(file, printRecipe, dump, vars, []string{}); err != nil {
+		return err
+	}
+
+	if r.StrictTemplates {
+		var unused []string
+		for k := range vars {
+			if !r.usedVars[k] && k != "architecture" {
+				unused = append(unused, k)
+			}
+		}
+		sort.Strings(unused)
+		if len(unused) > 0 {
+			debos.Warnf("Template variables not used by recipe %s: %s\n", file, strings.Join(unused, ", "))
+		}
+	}
+
+	if dump {
+		DumpActions(reflect.ValueOf(*r).Interface(), 0)
+	}
+
+	if len(r.Architecture) == 0 {
+		return fmt.Errorf("Recipe file must have 'architecture' property")
+	}
+
+	if len(r.Actions) == 0 {
+		return fmt.Errorf("Recipe file must have at least one action")
+	}
+
+	return nil
+}
+
+// typedTemplateVars converts the values with a type prefix, e.g. 'int=4'
+func typedTemplateVars(vars map[string]string) (map[string]interface{}, error) {
+	typed := make(map[string]interface{}, len(vars))
+
+	for k, v := range vars {
+		var err error
+		kind := strings.SplitN(v, "=", 2)
+		if len(kind) != 2 {
+			typed[k] = v
+			continue
+		}
+
+		switch kind[0] {
+		case "int":
+			typed[k], err = strconv.Atoi(kind[1])
+		case "float":
+			typed[k], err = strconv.ParseFloat(kind[1], 64)
+		case "bool":
+			typed[k], err = strconv.ParseBool(kind[1])
+		case "string":
+			typed[k] = kind[1]
+		default:
+			typed[k] = v
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for template variable %s: %s", k, v)
+		}
+	}
+
+	return typed, nil
+}
+
+/* templateFuncs returns the functions available to the templates of recipes,
+ * files being included relative to recipeDir */
+func templateFuncs(recipeDir string) template.FuncMap {
+	return template.FuncMap{
+		"sector":     sector,
+		"env":        os.Getenv,
+		"add":        add,
+		"sub":        sub,
+		"mul":        mul,
+		"div":        div,
+		"mod":        mod,
+		"lower":      strings.ToLower,
+		"upper":      strings.ToUpper,
+		"replace":    replace,
+		"trimPrefix": trimPrefix,
+		"include":    include(recipeDir),
+		"indent":     indent,
+		"nindent":    nindent,
+	}
+}
+
+/* templatedAction is implemented by the actions templating files with the
+ * variables of the recipe */
+type templatedAction interface {
+	setTemplateVars(funcs template.FuncMap, vars map[string]interface{}, strict bool)
+}
+
+// missingKey returns the template option for the undefined variables
+func (r *Recipe) missingKey() string {
+	if r.StrictTemplates {
+		return "missingkey=error"
+	}
+	return "missingkey=default"
+}
+
+/* usedTemplateVars collects the names of the variables a template refers to,
+ * either as fields, e.g. '.name', or as strings, e.g. 'index . "name"' */
+func usedTemplateVars(node parse.Node, used map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			usedTemplateVars(c, used)
+		}
+	case *parse.ActionNode:
+		usedTemplateVars(n.Pipe, used)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			usedTemplateVars(c, used)
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			usedTemplateVars(a, used)
+		}
+	case *parse.ChainNode:
+		usedTemplateVars(n.Node, used)
+	case *parse.FieldNode:
+		used[n.Ident[0]] = true
+	case *parse.StringNode:
+		used[n.Text] = true
+	case *parse.IfNode:
+		usedTemplateVars(n.Pipe, used)
+		usedTemplateVars(n.List, used)
+		usedTemplateVars(n.ElseList, used)
+	case *parse.RangeNode:
+		usedTemplateVars(n.Pipe, used)
+		usedTemplateVars(n.List, used)
+		usedTemplateVars(n.ElseList, used)
+	case *parse.WithNode:
+		usedTemplateVars(n.Pipe, used)
+		usedTemplateVars(n.List, used)
+		usedTemplateVars(n.ElseList, used)
+	case *parse.TemplateNode:
+		usedTemplateVars(n.Pipe, used)
+	}
+}
+
+/* checkRecipeVersion checks the version required by a recipe failing to parse,
+ * as newer properties or actions are the likely reason */
+func checkRecipeVersion(file string, data []byte) error {
+	var header struct {
+		MinDebosVersion string `yaml:"min-debos-version"`
+	}
+	// JSON is a subset of YAML
+	if err := yaml.Unmarshal(data, &header); err != nil || header.MinDebosVersion == "" {
+		return nil
+	}
+	if err := debos.CheckVersion(header.MinDebosVersion); err != nil {
+		return fmt.Errorf("Recipe '%s': %v", file, err)
 	}
+	return nil
+}
+
+// parse templates and unmarshals a single recipe file, then prepends the
+// actions of the included recipes. The stack holds the chain of including
+// files, to detect include cycles.
+func (r *Recipe) parse(file string, printRecipe bool, dump bool, templateVars map[string]interface{}, stack []string) error {
+	t := template.New(path.Base(file))
+	funcs := templateFuncs(path.Dir(debos.CleanPath(file)))
 	t.Funcs(funcs)
+	t.Option(r.missingKey())
 
 	if _, err := t.ParseFiles(file); err != nil {
 		return err
 	}
-
-	if len(templateVars) == 0 {
-		templateVars = append(templateVars, make(map[string]string))
+	if r.usedVars == nil {
+		r.usedVars = make(map[string]bool)
+	}
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree != nil {
+			usedTemplateVars(tmpl.Tree.Root, r.usedVars)
+		}
 	}
 
 	data := new(bytes.Buffer)
-	if err := t.Execute(data, templateVars[0]); err != nil {
+	if err := t.Execute(data, templateVars); err != nil {
 		return err
 	}
 
@@ -247,21 +925,72 @@ func (r *Recipe) Parse(file string, printRecipe bool, dump bool, templateVars ..
 		log.Printf("%s", data)
 	}
 
-	if err := yaml.Unmarshal(data.Bytes(), &r); err != nil {
-		return err
+	if strings.ToLower(path.Ext(file)) == ".json" {
+		if err := json.Unmarshal(data.Bytes(), &r); err != nil {
+			if verr := checkRecipeVersion(file, data.Bytes()); verr != nil {
+				return verr
+			}
+			return err
+		}
+	} else {
+		if err := yaml.Unmarshal(data.Bytes(), &r); err != nil {
+			if verr := checkRecipeVersion(file, data.Bytes()); verr != nil {
+				return verr
+			}
+			return unknownActionsError(err)
+		}
 	}
 
-	if dump {
-		DumpActions(reflect.ValueOf(*r).Interface(), 0)
+	if r.MinDebosVersion != "" {
+		if err := debos.CheckVersion(r.MinDebosVersion); err != nil {
+			return fmt.Errorf("Recipe '%s': %v", file, err)
+		}
 	}
 
-	if len(r.Architecture) == 0 {
-		return fmt.Errorf("Recipe file must have 'architecture' property")
+	enabled, err := r.enabledActions(r.Actions, funcs, templateVars)
+	if err != nil {
+		return err
 	}
+	r.Actions = enabled
 
-	if len(r.Actions) == 0 {
-		return fmt.Errorf("Recipe file must have at least one action")
+	for _, a := range r.Actions {
+		if ta, ok := a.Action.(templatedAction); ok {
+			ta.setTemplateVars(funcs, templateVars, r.StrictTemplates)
+		}
+	}
+
+	stack = append(stack, debos.CleanPath(file))
+
+	var included []YamlAction
+	for _, include := range r.Includes {
+		incfile := debos.CleanPathAt(include, path.Dir(stack[len(stack)-1]))
+
+		for idx, f := range stack {
+			if f == incfile {
+				cycle := append(stack[idx:], incfile)
+				return fmt.Errorf("Recipe include cycle detected: %s", strings.Join(cycle, " -> "))
+			}
+		}
+
+		inc := Recipe{StrictTemplates: r.StrictTemplates, usedVars: r.usedVars}
+		// Pass a copy of the stack so siblings don't share the backing array
+		incstack := append([]string{}, stack...)
+		if err := inc.parse(incfile, printRecipe, dump, templateVars, incstack); err != nil {
+			return err
+		}
+
+		if len(inc.Architecture) > 0 {
+			if len(r.Architecture) == 0 {
+				r.Architecture = inc.Architecture
+			} else if inc.Architecture != r.Architecture {
+				return fmt.Errorf("Included recipe '%s' is for architecture '%s' but expected '%s'",
+					include, inc.Architecture, r.Architecture)
+			}
+		}
+
+		included = append(included, inc.Actions...)
 	}
+	r.Actions = append(included, r.Actions...)
 
 	return nil
 }
@@ -33,6 +33,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"github.com/go-debos/debos"
 	"github.com/go-debos/fakemachine"
 )
@@ -72,6 +73,7 @@ func (recipe *RecipeAction) Verify(context *debos.DebosContext) error {
 		recipe.templateVars[k] = v
 	}
 
+	recipe.Actions.StrictTemplates = context.StrictTemplates
 	if err := recipe.Actions.Parse(file, context.PrintRecipe, context.Verbose, recipe.templateVars); err != nil {
 		return err
 	}
@@ -89,6 +91,19 @@ func (recipe *RecipeAction) Verify(context *debos.DebosContext) error {
 	return nil
 }
 
+func (recipe *RecipeAction) Summary() string {
+	summary := []string{fmt.Sprintf("Include recipe %s", recipe.Recipe)}
+	for _, a := range recipe.Actions.Actions {
+		summary = append(summary, fmt.Sprintf("  - %s", a))
+		if s := a.Summary(); s != "" {
+			for _, line := range strings.Split(s, "\n") {
+				summary = append(summary, "    "+line)
+			}
+		}
+	}
+	return strings.Join(summary, "\n")
+}
+
 func (recipe *RecipeAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine, args *[]string) error {
 	// TODO: check args?
 
@@ -6,6 +6,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
 	"testing"
 	"strings"
 )
@@ -72,7 +74,18 @@ architecture: arm64
 actions:
   - action: test_unknown_action
 `,
-			"Unknown action: test_unknown_action",
+			"Unknown action: test_unknown_action" + validActions(),
+		},
+		// Test all the unknown actions get reported
+		{`
+architecture: arm64
+
+actions:
+  - action: test_unknown_action
+  - action: raw
+  - action: other_unknown_action
+`,
+			"Unknown action: test_unknown_action\nUnknown action: other_unknown_action" + validActions(),
 		},
 		// Test if 'architecture' property absence
 		{`
@@ -147,11 +160,15 @@ architecture: arm64
 actions:
   - action: {{ sector 42 }}
 `,
-		"Unknown action: 21504",
+		"Unknown action: 21504" + validActions(),
 	}
 	runTest(t, testSector)
 }
 
+func validActions() string {
+	return "\nValid actions: " + strings.Join(actions.ActionNames(), ", ")
+}
+
 func runTest(t *testing.T, test testRecipe, templateVars ...map[string]string) actions.Recipe {
 	file, err := ioutil.TempFile(os.TempDir(), "recipe")
 	assert.Empty(t, err)
@@ -341,3 +358,1333 @@ func runTestWithSubRecipes(t *testing.T, test testSubRecipe, templateVars ...map
 
 	return r
 }
+
+func TestParse_includes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	var files = map[string]string{
+		"main.yaml": `
+architecture: amd64
+includes: [ base.yaml ]
+
+actions:
+  - action: pack
+`,
+		"base.yaml": `
+includes: [ sub/packages.yaml ]
+
+actions:
+  - action: debootstrap
+`,
+		"sub/packages.yaml": `
+actions:
+  - action: {{ .action }}
+`,
+		"cycle-a.yaml": `
+architecture: amd64
+includes: [ cycle-b.yaml ]
+
+actions:
+  - action: pack
+`,
+		"cycle-b.yaml": `
+includes: [ cycle-a.yaml ]
+`,
+		"armhf.yaml": `
+architecture: armhf
+includes: [ base.yaml ]
+`,
+	}
+
+	assert.Empty(t, os.Mkdir(dir+"/sub", 0755))
+	for name, content := range files {
+		assert.Empty(t, ioutil.WriteFile(dir+"/"+name, []byte(content), 0644))
+	}
+
+	r := actions.Recipe{}
+	err = r.Parse(dir+"/main.yaml", false, false, map[string]string{"action": "apt"})
+	assert.Empty(t, err)
+	var names []string
+	for _, a := range r.Actions {
+		names = append(names, a.String())
+	}
+	assert.Equal(t, []string{"apt", "debootstrap", "pack"}, names)
+
+	r = actions.Recipe{}
+	err = r.Parse(dir+"/cycle-a.yaml", false, false)
+	assert.EqualError(t, err, strings.Replace("Recipe include cycle detected: "+
+		"/tmp/cycle-a.yaml -> /tmp/cycle-b.yaml -> /tmp/cycle-a.yaml", "/tmp", dir, -1))
+
+	r = actions.Recipe{}
+	err = r.Parse(dir+"/armhf.yaml", false, false, map[string]string{"action": "apt"})
+	assert.Empty(t, err)
+	assert.Equal(t, "armhf", r.Architecture)
+}
+
+// Test of 'env' function embedded to recipe package
+func TestParse_env(t *testing.T) {
+	os.Setenv("DEBOS_TEST_ACTION", "pack")
+	defer os.Unsetenv("DEBOS_TEST_ACTION")
+
+	var test = testRecipe{
+		`
+architecture: arm64
+
+actions:
+  - action: {{ env "DEBOS_TEST_ACTION" }}
+    description: "{{ env "DEBOS_TEST_UNSET" }}"
+`,
+		"",
+	}
+	r := runTest(t, test)
+	assert.Equal(t, "pack", r.Actions[0].String())
+}
+
+// Check JSON recipes are equivalent to YAML ones
+func TestParse_json(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	var recipes = map[string]string{
+		"recipe.yaml": `
+architecture: arm64
+actions:
+  - action: debootstrap
+    suite: bullseye
+    keyring-package: debian-archive-keyring
+    components: [ main, contrib ]
+  - action: apt
+    recommends: true
+    packages: [ sudo ]
+`,
+		"recipe.json": `
+{
+  "architecture": "arm64",
+  "actions": [
+    { "action": "debootstrap", "suite": "{{ "bullseye" }}",
+      "keyring-package": "debian-archive-keyring",
+      "components": [ "main", "contrib" ] },
+    { "action": "apt", "recommends": true, "packages": [ "sudo" ] }
+  ]
+}
+`,
+	}
+
+	var parsed []actions.Recipe
+	for _, name := range []string{"recipe.yaml", "recipe.json"} {
+		file := dir + "/" + name
+		assert.Empty(t, ioutil.WriteFile(file, []byte(recipes[name]), 0644))
+
+		r := actions.Recipe{}
+		assert.Empty(t, r.Parse(file, false, false))
+		parsed = append(parsed, r)
+	}
+
+	assert.Equal(t, parsed[0], parsed[1])
+	assert.Equal(t, "debian-archive-keyring", parsed[1].Actions[0].Action.(*actions.DebootstrapAction).KeyringPackage)
+
+	// Unknown actions are reported the same way
+	file := dir + "/unknown.json"
+	ioutil.WriteFile(file, []byte(`{ "architecture": "arm64", "actions": [ { "action": "unknown" } ] }`), 0644)
+	r := actions.Recipe{}
+	assert.EqualError(t, r.Parse(file, false, false), "Unknown action: unknown"+validActions())
+}
+
+// Check template variables with a type prefix
+func TestParse_typedVars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	file := dir + "/recipe.yaml"
+	err = ioutil.WriteFile(file, []byte(`
+architecture: arm64
+actions:
+  - action: {{ if .debug }}run{{ else }}pack{{ end }}
+    description: "{{ .count }} {{ .name }} {{ .literal }} {{ .ratio }}"
+`), 0644)
+	assert.Empty(t, err)
+
+	vars := map[string]string{
+		"debug":   "bool=true",
+		"count":   "int=4",
+		"ratio":   "float=0.5",
+		"name":    "value=1",
+		"literal": "string=int=4",
+	}
+	r := actions.Recipe{}
+	assert.Empty(t, r.Parse(file, false, false, vars))
+	assert.IsType(t, &actions.RunAction{}, r.Actions[0].Action)
+	assert.Equal(t, "4 value=1 int=4 0.5", r.Actions[0].String())
+
+	// A plain string is always true, a typed false is false
+	vars["debug"] = "bool=false"
+	r = actions.Recipe{}
+	assert.Empty(t, r.Parse(file, false, false, vars))
+	assert.IsType(t, &actions.PackAction{}, r.Actions[0].Action)
+
+	vars["count"] = "int=four"
+	r = actions.Recipe{}
+	assert.EqualError(t, r.Parse(file, false, false, vars), "Invalid value for template variable count: int=four")
+}
+
+// Test of arithmetic and string functions embedded to recipe package
+func TestParse_funcs(t *testing.T) {
+	var test = testRecipe{
+		`
+architecture: arm64
+
+actions:
+  - action: run
+    description: "{{ add 1 2 }} {{ sub 1 2 }} {{ mul .count 512 }} {{ div 7 2 }} {{ mod 7 2 }} {{ sector (add .count 1) }}"
+  - action: run
+    description: "{{ lower "ABC" }} {{ upper "abc" }} {{ .name | replace "-" "_" }} {{ trimPrefix "v" "v1.0" }}"
+`,
+		"",
+	}
+	r := runTest(t, test, map[string]string{"count": "int=4", "name": "a-b-c"})
+	assert.Equal(t, "3 -1 2048 3 1 2560", r.Actions[0].String())
+	assert.Equal(t, "abc ABC a_b_c 1.0", r.Actions[1].String())
+
+	// The template error is wrapped with its location
+	file, err := ioutil.TempFile(os.TempDir(), "recipe")
+	assert.Empty(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString("architecture: arm64\nactions:\n  - action: {{ div 1 0 }}\n")
+	file.Close()
+	r = actions.Recipe{}
+	err = r.Parse(file.Name(), false, false)
+	assert.Contains(t, err.Error(), "division by zero")
+}
+
+// Test the include function inserting files relative to the recipe
+func TestParse_include(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debos-include")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "description.txt"), []byte("included"), 0644))
+	recipe := path.Join(dir, "recipe.yaml")
+	assert.Empty(t, ioutil.WriteFile(recipe, []byte(`
+architecture: arm64
+actions:
+  - action: run
+    description: {{ include "description.txt" }}
+`), 0644))
+
+	// Files are relative to the recipe, not to the working directory
+	r := actions.Recipe{}
+	assert.Empty(t, r.Parse(recipe, false, false))
+	assert.Equal(t, "included", r.Actions[0].String())
+
+	assert.Empty(t, ioutil.WriteFile(recipe, []byte(`
+architecture: arm64
+actions:
+  - action: run
+    description: {{ include "missing.txt" }}
+`), 0644))
+	r = actions.Recipe{}
+	err = r.Parse(recipe, false, false)
+	assert.Contains(t, err.Error(), "Failed to include 'missing.txt'")
+
+	// Multi-line files are indented to be embedded in block scalars
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "setup.sh"), []byte("set -e\n\necho done\n"), 0644))
+	assert.Empty(t, ioutil.WriteFile(recipe, []byte(`
+architecture: arm64
+actions:
+  - action: run
+    command: |{{ include "setup.sh" | nindent 6 }}
+  - action: run
+    command: |
+{{ include "setup.sh" | indent 6 }}
+`), 0644))
+	r = actions.Recipe{}
+	assert.Empty(t, r.Parse(recipe, false, false))
+	assert.Equal(t, "set -e\n\necho done\n", r.Actions[0].Action.(*actions.RunAction).Command)
+	assert.Equal(t, "set -e\n\necho done\n", r.Actions[1].Action.(*actions.RunAction).Command)
+}
+
+// Check actions are skipped according to their 'if' property
+func TestParse_if(t *testing.T) {
+	var test = testRecipe{
+		`
+architecture: arm64
+
+actions:
+  - action: run
+    description: rpi4
+    if: '{{ eq .board "rpi4" }}'
+  - action: run
+    description: rpi3
+    if: '{{ eq .board "rpi3" }}'
+  - action: unknown
+    if: false
+  - action: pack
+    if: 1
+`,
+		"",
+	}
+	r := runTest(t, test, map[string]string{"board": "rpi3"})
+	assert.Equal(t, 2, len(r.Actions))
+	assert.Equal(t, "rpi3", r.Actions[0].String())
+	assert.Equal(t, "pack", r.Actions[1].String())
+
+	var testInvalid = testRecipe{
+		`
+architecture: arm64
+
+actions:
+  - action: pack
+    if: maybe
+`,
+		"Invalid 'if' condition for action pack: 'maybe'",
+	}
+	runTest(t, testInvalid)
+}
+
+type testAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Message          string
+}
+
+// Check actions registered from outside of the package
+func TestParse_registerAction(t *testing.T) {
+	actions.RegisterAction("test-register", func() debos.Action {
+		return &testAction{Message: "default"}
+	})
+	assert.Contains(t, actions.ActionNames(), "test-register")
+	assert.Panics(t, func() {
+		actions.RegisterAction("test-register", func() debos.Action { return &testAction{} })
+	})
+	assert.Panics(t, func() {
+		actions.RegisterAction("apt", func() debos.Action { return &testAction{} })
+	})
+
+	r := runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: test-register
+  - action: test-register
+    message: custom
+`, ""})
+	assert.Equal(t, "default", r.Actions[0].Action.(*testAction).Message)
+	assert.Equal(t, "custom", r.Actions[1].Action.(*testAction).Message)
+}
+
+type testArchitectureAction struct {
+	debos.BaseAction `yaml:",inline"`
+	architecture     string
+}
+
+func (a *testArchitectureAction) Run(context *debos.DebosContext) error {
+	a.architecture = context.Architecture
+	return nil
+}
+
+// Check the architecture overridden for a single action
+func TestParse_architecture(t *testing.T) {
+	actions.RegisterAction("test-architecture", func() debos.Action {
+		return &testArchitectureAction{}
+	})
+
+	r := runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: test-architecture
+    architecture: armhf
+  - action: test-architecture
+`, ""})
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", "arm64"}
+	for _, a := range r.Actions {
+		assert.Empty(t, a.Verify(&context))
+		assert.Empty(t, a.Run(&context))
+		assert.Equal(t, "arm64", context.Architecture)
+	}
+	assert.Equal(t, "armhf", r.Actions[0].Action.(*testArchitectureAction).architecture)
+	assert.Equal(t, "arm64", r.Actions[1].Action.(*testArchitectureAction).architecture)
+
+	r = runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: test-architecture
+    architecture: arm65
+`, ""})
+	err := r.Actions[0].Verify(&context)
+	assert.Contains(t, err.Error(), "Unknown architecture 'arm65'")
+}
+
+// Check actions repeated for a list of items
+func TestParse_foreach(t *testing.T) {
+	r := runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: overlay
+    foreach: '{{ .boards }}'
+    source: 'overlays/[[ .item ]]-[[ .index ]]'
+  - action: run
+    foreach: [ one, two, three ]
+    if: '[[ ne .item "two" ]]'
+    command: 'echo [[ .item ]] [[ .suffix ]]'
+`, ""}, map[string]string{"boards": "rpi3, rpi4", "suffix": "done"})
+
+	assert.Equal(t, 4, len(r.Actions))
+	assert.Equal(t, "overlays/rpi3-0", r.Actions[0].Action.(*actions.OverlayAction).Source)
+	assert.Equal(t, "overlays/rpi4-1", r.Actions[1].Action.(*actions.OverlayAction).Source)
+	assert.Equal(t, "echo one done", r.Actions[2].Action.(*actions.RunAction).Command)
+	assert.Equal(t, "echo three done", r.Actions[3].Action.(*actions.RunAction).Command)
+
+	runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: run
+    foreach: [ one ]
+    command: echo
+  - action: overlay
+    foreach: { not: a list }
+`, "Invalid 'foreach' for action: 'map[not:a list]', expected a list"})
+}
+
+// Check overlays rendering their files with the recipe variables
+func TestOverlay_templated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	recipedir := path.Join(dir, "recipe")
+	rootdir := path.Join(dir, "root")
+	assert.Empty(t, os.MkdirAll(path.Join(recipedir, "overlay/etc"), 0755))
+	assert.Empty(t, os.Mkdir(rootdir, 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(recipedir, "overlay/etc/hostname"),
+		[]byte("{{ .hostname }}\n"), 0644))
+	assert.Empty(t, ioutil.WriteFile(path.Join(recipedir, "overlay/etc/motd"),
+		[]byte("{{ .hostname }}\n"), 0644))
+
+	r := runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: overlay
+    source: overlay
+    templates: [ hostname ]
+`, ""}, map[string]string{"hostname": "board"})
+
+	context := debos.DebosContext{&debos.CommonContext{Rootdir: rootdir}, recipedir, "arm64"}
+	assert.Empty(t, r.Actions[0].Verify(&context))
+	assert.Empty(t, r.Actions[0].Run(&context))
+
+	content, err := ioutil.ReadFile(path.Join(rootdir, "etc/hostname"))
+	assert.Empty(t, err)
+	assert.Equal(t, "board\n", string(content))
+	content, err = ioutil.ReadFile(path.Join(rootdir, "etc/motd"))
+	assert.Empty(t, err)
+	assert.Equal(t, "{{ .hostname }}\n", string(content))
+}
+
+// Check the files selected by the include and exclude patterns of overlays
+func TestOverlay_filter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	recipedir := path.Join(dir, "recipe")
+	rootdir := path.Join(dir, "root")
+	for _, file := range []string{".git/config", "etc/a.conf", "etc/a.conf~", "etc/b.txt", "usr/c.conf"} {
+		assert.Empty(t, os.MkdirAll(path.Join(recipedir, "overlay", path.Dir(file)), 0755))
+		assert.Empty(t, ioutil.WriteFile(path.Join(recipedir, "overlay", file), []byte(file), 0644))
+	}
+	assert.Empty(t, os.Mkdir(rootdir, 0755))
+
+	r := runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: overlay
+    source: overlay
+    include: [ 'etc/*', config ]
+    exclude: [ .git, '*~' ]
+`, ""})
+
+	context := debos.DebosContext{&debos.CommonContext{Rootdir: rootdir}, recipedir, "arm64"}
+	assert.Empty(t, r.Actions[0].Verify(&context))
+	assert.Empty(t, r.Actions[0].Run(&context))
+
+	for file, copied := range map[string]bool{
+		".git/config": false,
+		"etc/a.conf":  true,
+		"etc/a.conf~": false,
+		"etc/b.txt":   true,
+		"usr/c.conf":  false,
+	} {
+		_, err := os.Stat(path.Join(rootdir, file))
+		assert.Equal(t, copied, err == nil, file)
+	}
+}
+
+// Check the targets of the symlinks copied by the overlays
+func TestOverlay_symlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	recipedir := path.Join(dir, "recipe")
+	assert.Empty(t, os.MkdirAll(path.Join(recipedir, "overlay/etc/vim"), 0755))
+	assert.Empty(t, os.Symlink(path.Join(recipedir, "overlay/etc/vim/vimrc"),
+		path.Join(recipedir, "overlay/etc/vimrc")))
+	assert.Empty(t, os.Symlink("/etc/alternatives/editor", path.Join(recipedir, "overlay/etc/vim/editor")))
+	assert.Empty(t, os.Symlink("missing", path.Join(recipedir, "overlay/etc/dangling")))
+
+	for policy, links := range map[string]map[string]string{
+		"keep": {
+			"etc/vimrc":      path.Join(recipedir, "overlay/etc/vim/vimrc"),
+			"etc/vim/editor": "/etc/alternatives/editor",
+			"etc/dangling":   "missing",
+		},
+		"rewrite": {
+			"etc/vimrc":      "/etc/vim/vimrc",
+			"etc/vim/editor": "/etc/alternatives/editor",
+			"etc/dangling":   "missing",
+		},
+		"relative": {
+			"etc/vimrc":      "vim/vimrc",
+			"etc/vim/editor": "../alternatives/editor",
+			"etc/dangling":   "missing",
+		},
+	} {
+		rootdir := path.Join(dir, policy)
+		assert.Empty(t, os.Mkdir(rootdir, 0755))
+
+		r := runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: overlay
+    source: overlay
+    symlinks: ` + policy, ""})
+
+		context := debos.DebosContext{&debos.CommonContext{Rootdir: rootdir}, recipedir, "arm64"}
+		assert.Empty(t, r.Actions[0].Verify(&context))
+		assert.Empty(t, r.Actions[0].Run(&context))
+
+		for file, expected := range links {
+			link, err := os.Readlink(path.Join(rootdir, file))
+			assert.Empty(t, err)
+			assert.Equal(t, expected, link, policy+": "+file)
+		}
+	}
+
+	r := runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: overlay
+    source: overlay
+    symlinks: follow
+`, ""})
+	context := debos.DebosContext{&debos.CommonContext{Rootdir: dir}, recipedir, "arm64"}
+	assert.EqualError(t, r.Actions[0].Verify(&context),
+		"Invalid symlinks policy 'follow', either 'keep', 'rewrite' or 'relative'")
+}
+
+// Check the fields set by os-release, following the /etc/os-release symlink
+func TestOsRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Empty(t, os.MkdirAll(path.Join(dir, "etc"), 0755))
+	assert.Empty(t, os.MkdirAll(path.Join(dir, "usr/lib"), 0755))
+	assert.Empty(t, os.Symlink("../usr/lib/os-release", path.Join(dir, "etc/os-release")))
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "usr/lib/os-release"),
+		[]byte("# Debian\nNAME=\"Debian GNU/Linux\"\nID=debian\n"), 0644))
+
+	r := runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: os-release
+    fields:
+      ID: custom
+      IMAGE_VERSION: '{{ .version }}'
+      VARIANT: Build "$1"
+`, ""}, map[string]string{"version": "1.2"})
+
+	context := debos.DebosContext{&debos.CommonContext{Rootdir: dir}, "", "arm64"}
+	assert.Empty(t, r.Actions[0].Verify(&context))
+	assert.Empty(t, r.Actions[0].Run(&context))
+
+	content, err := ioutil.ReadFile(path.Join(dir, "usr/lib/os-release"))
+	assert.Empty(t, err)
+	assert.Equal(t, "# Debian\nNAME=\"Debian GNU/Linux\"\nID=custom\nIMAGE_VERSION=1.2\nVARIANT=\"Build \\\"\\$1\\\"\"\n", string(content))
+
+	r = runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: os-release
+    fields:
+      id: lower
+`, ""})
+	assert.EqualError(t, r.Actions[0].Verify(&context), "Invalid os-release field 'id'")
+}
+
+// Check partitions without filesystem can't be formatted nor mounted
+// Check the ext filesystem tuning of the partitions is validated
+func TestImagePartition_extTuning(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", "arm64"}
+
+	var tests = []testRecipe{
+		{`
+architecture: arm64
+
+actions:
+  - action: image-partition
+    imagename: test.img
+    imagesize: 1GB
+    partitiontype: gpt
+    partitions:
+      - name: root
+        fs: vfat
+        start: 1MB
+        end: 100%
+        reserved: 0
+`, "Partition root: 'reserved' and 'inoderatio' are only supported for ext2, ext3 and ext4"},
+		{`
+architecture: arm64
+
+actions:
+  - action: image-partition
+    imagename: test.img
+    imagesize: 1GB
+    partitiontype: gpt
+    partitions:
+      - name: root
+        fs: ext4
+        start: 1MB
+        end: 100%
+        reserved: 60
+`, "Partition root: 'reserved' must be between 0 and 50%"},
+		{`
+architecture: arm64
+
+actions:
+  - action: image-partition
+    imagename: test.img
+    imagesize: 1GB
+    partitiontype: gpt
+    partitions:
+      - name: root
+        fs: ext4
+        start: 1MB
+        end: 100%
+        inoderatio: 512
+`, "Partition root: 'inoderatio' must be between 1024 and 67108864 bytes"},
+	}
+
+	for _, test := range tests {
+		r := runTest(t, testRecipe{test.recipe, ""})
+		assert.EqualError(t, r.Actions[0].Verify(&context), test.err)
+	}
+}
+
+func TestImagePartition_lvm(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", "arm64"}
+
+	var tests = []testRecipe{
+		{`
+architecture: arm64
+
+actions:
+  - action: image-partition
+    imagename: test.img
+    imagesize: 4GB
+    partitiontype: gpt
+    partitions:
+      - name: boot
+        fs: ext4
+        start: 1MB
+        end: 512MB
+      - name: lvm
+        fs: lvm
+        start: 512MB
+        expand: true
+    volumegroups:
+      - name: vg0
+        partitions: [ boot ]
+        volumes:
+          - name: root
+            fs: ext4
+            expand: true
+`, "Partition boot of volume group vg0 must have the 'lvm' fs type"},
+		{`
+architecture: arm64
+
+actions:
+  - action: image-partition
+    imagename: test.img
+    imagesize: 4GB
+    partitiontype: gpt
+    partitions:
+      - name: boot
+        fs: ext4
+        start: 1MB
+        end: 512MB
+      - name: lvm
+        fs: lvm
+        start: 512MB
+        expand: true
+    volumegroups:
+      - name: vg0
+        partitions: [ lvm ]
+        volumes:
+          - name: boot
+            fs: ext4
+            size: 1GB
+`, "Partition boot already exists"},
+		{`
+architecture: arm64
+
+actions:
+  - action: image-partition
+    imagename: test.img
+    imagesize: 4GB
+    partitiontype: gpt
+    partitions:
+      - name: boot
+        fs: ext4
+        start: 1MB
+        end: 512MB
+      - name: lvm
+        fs: lvm
+        start: 512MB
+        expand: true
+    volumegroups:
+      - name: vg0
+        partitions: [ lvm ]
+        volumes:
+          - name: root
+            fs: ext4
+            expand: true
+          - name: var
+            fs: ext4
+            size: 1GB
+`, "Only the last volume of volume group vg0 can be expanded, not root"},
+		{`
+architecture: arm64
+
+actions:
+  - action: image-partition
+    imagename: test.img
+    imagesize: 4GB
+    partitiontype: gpt
+    partitions:
+      - name: boot
+        fs: ext4
+        start: 1MB
+        end: 512MB
+      - name: lvm
+        fs: lvm
+        start: 512MB
+        expand: true
+    volumegroups:
+      - name: vg0
+        partitions: [ lvm ]
+        volumes:
+          - name: root
+            fs: ext4
+            start: 0%
+            end: 100%
+`, "Volume root only supports a size and filesystem properties"},
+		{`
+architecture: arm64
+
+actions:
+  - action: image-partition
+    imagename: test.img
+    imagesize: 4GB
+    partitiontype: gpt
+    partitions:
+      - name: boot
+        fs: ext4
+        start: 1MB
+        end: 512MB
+      - name: lvm
+        fs: lvm
+        start: 512MB
+        expand: true
+    volumegroups:
+      - name: vg0
+        partitions: [ lvm ]
+        volumes:
+          - name: root
+            fs: ext4
+            size: 50%
+`, "Invalid size 50% of volume root"},
+		{`
+architecture: arm64
+
+actions:
+  - action: image-partition
+    imagename: test.img
+    imagesize: 4GB
+    partitiontype: gpt
+    partitions:
+      - name: boot
+        fs: ext4
+        start: 1MB
+        end: 512MB
+      - name: lvm
+        fs: lvm
+        start: 512MB
+        expand: true
+    volumegroups:
+      - name: vg0
+        partitions: [ lvm ]
+        volumes:
+          - name: root
+            fs: ext4
+            size: 1GB
+    mountpoints:
+      - mountpoint: /
+        partition: lvm
+`, "Partition lvm has no filesystem to mount on /"},
+		{`
+architecture: arm64
+
+actions:
+  - action: image-partition
+    imagename: test.img
+    imagesize: 4GB
+    partitiontype: gpt
+    partitions:
+      - name: boot
+        fs: ext4
+        start: 1MB
+        end: 512MB
+      - name: lvm
+        fs: lvm
+        start: 512MB
+        expand: true
+`, "Partition lvm isn't part of a volume group"},
+	}
+
+	for _, test := range tests {
+		r := runTest(t, testRecipe{test.recipe, ""})
+		assert.EqualError(t, r.Actions[0].Verify(&context), test.err)
+	}
+}
+
+// The fs values of image-partition which aren't filesystems are refused
+func TestMkfs_notFilesystem(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", "arm64"}
+	for _, fs := range []string{"none", "lvm"} {
+		r := runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: mkfs
+    device: disk.img
+    fs: ` + fs + `
+`, ""})
+		assert.EqualError(t, r.Actions[0].Verify(&context), "'fs' property must be set to a filesystem")
+	}
+}
+
+func TestImagePartition_noFilesystem(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", "arm64"}
+
+	var tests = []testRecipe{
+		{`
+architecture: arm64
+
+actions:
+  - action: image-partition
+    imagename: test.img
+    imagesize: 1GB
+    partitiontype: gpt
+    partitions:
+      - name: uboot-env
+        fs: none
+        start: 1MB
+        end: 2MB
+        features: [ "^64bit" ]
+`, "Partition uboot-env has filesystem options but no filesystem"},
+		{`
+architecture: arm64
+
+actions:
+  - action: image-partition
+    imagename: test.img
+    imagesize: 1GB
+    partitiontype: gpt
+    partitions:
+      - name: vendor
+        fs: none
+        start: 1MB
+        end: 100MB
+    mountpoints:
+      - mountpoint: /vendor
+        partition: vendor
+`, "Partition vendor has no filesystem to mount on /vendor"},
+	}
+
+	for _, test := range tests {
+		r := runTest(t, testRecipe{test.recipe, ""})
+		assert.EqualError(t, r.Actions[0].Verify(&context), test.err)
+	}
+
+	// Content written to the partition must fit
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "env.bin"), make([]byte, 2000000), 0644))
+	context.RecipeDir = dir
+
+	r := runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: image-partition
+    imagename: test.img
+    imagesize: 1GB
+    partitiontype: gpt
+    partitions:
+      - name: uboot-env
+        fs: none
+        start: 1MB
+        end: 2MB
+        content: env.bin
+`, ""})
+	assert.EqualError(t, r.Actions[0].Verify(&context),
+		"Content "+dir+"/env.bin (2000000 bytes) doesn't fit in partition uboot-env (1000000 bytes)")
+}
+
+// Check references to undefined variables fail with strict templates
+func TestParse_strictTemplates(t *testing.T) {
+	file, err := ioutil.TempFile(os.TempDir(), "recipe")
+	assert.Empty(t, err)
+	defer os.Remove(file.Name())
+
+	file.WriteString(`
+{{- $suite := or (index . "suite") "bookworm" -}}
+architecture: arm64
+
+actions:
+  - action: debootstrap
+    suite: {{ $suite }}
+    mirror: {{ .mirorr }}
+`)
+	file.Close()
+
+	vars := map[string]string{"mirror": "http://deb.debian.org/debian"}
+
+	r := actions.Recipe{}
+	assert.Empty(t, r.Parse(file.Name(), false, false, vars))
+	assert.Equal(t, "<no value>", r.Actions[0].Action.(*actions.DebootstrapAction).Mirror)
+
+	r = actions.Recipe{StrictTemplates: true}
+	err = r.Parse(file.Name(), false, false, vars)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `map has no entry for key "mirorr"`)
+}
+
+// Check recipes requiring a newer debos are refused, even with unknown actions
+func TestParse_minDebosVersion(t *testing.T) {
+	runTest(t, testRecipe{`
+min-debos-version: "1.0"
+architecture: arm64
+
+actions:
+  - action: run
+    command: ls
+`, ""})
+
+	for _, recipe := range []string{`
+min-debos-version: "99.0"
+architecture: arm64
+
+actions:
+  - action: run
+    command: ls
+`, `
+min-debos-version: "99.0"
+architecture: arm64
+
+actions:
+  - action: future
+`} {
+		file, err := ioutil.TempFile(os.TempDir(), "recipe")
+		assert.Empty(t, err)
+		defer os.Remove(file.Name())
+		file.WriteString(recipe)
+		file.Close()
+
+		r := actions.Recipe{}
+		err = r.Parse(file.Name(), false, false)
+		assert.EqualError(t, err, "Recipe '"+file.Name()+"': debos 99.0 or newer is required, this is debos "+debos.Version)
+	}
+}
+
+// Check the actions of parallel groups are parsed, run and their failures reported
+func TestParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	recipedir := path.Join(dir, "recipe")
+	rootdir := path.Join(dir, "root")
+	for _, name := range []string{"a", "b", "c", "d"} {
+		assert.Empty(t, os.MkdirAll(path.Join(recipedir, name), 0755))
+		assert.Empty(t, ioutil.WriteFile(path.Join(recipedir, name, name), []byte(name), 0644))
+	}
+	assert.Empty(t, os.Mkdir(rootdir, 0755))
+
+	r := runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: parallel
+    jobs: 2
+    actions:
+      - action: overlay
+        source: a
+      - action: overlay
+        source: b
+        if: false
+      - action: overlay
+        foreach: [ c, d ]
+        source: '[[ .item ]]'
+`, ""})
+
+	p := r.Actions[0].Action.(*actions.ParallelAction)
+	assert.Equal(t, 3, len(p.Actions))
+
+	context := debos.DebosContext{&debos.CommonContext{Rootdir: rootdir, Origins: map[string]string{}}, recipedir, "arm64"}
+	assert.Empty(t, p.Verify(&context))
+	assert.Empty(t, p.Run(&context))
+	assert.Empty(t, p.Cleanup(&context))
+	for name, copied := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		_, err := os.Stat(path.Join(rootdir, name))
+		assert.Equal(t, copied, err == nil, name)
+	}
+
+	r = runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: parallel
+    jobs: 1
+    actions:
+      - action: overlay
+        origin: missing
+      - action: overlay
+        origin: unknown
+`, ""})
+	// No more actions are started after a failure
+	err = r.Actions[0].Run(&context)
+	assert.EqualError(t, err, "Action `overlay` failed: Origin not found 'missing'")
+
+	r = runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: parallel
+    actions:
+      - action: run
+        chroot: true
+        command: ls
+`, ""})
+	assert.EqualError(t, r.Actions[0].Verify(&context), "Action `run` can't run in parallel in the chroot")
+}
+
+// Check the symlinks created and removed by the systemd-unit action
+func TestSystemdUnit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	unitdir := path.Join(dir, "lib/systemd/system")
+	assert.Empty(t, os.MkdirAll(unitdir, 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(unitdir, "ssh.service"), []byte(`[Unit]
+Description=OpenBSD Secure Shell server
+
+[Service]
+ExecStart=/usr/sbin/sshd -D
+
+[Install]
+WantedBy=multi-user.target
+Alias=sshd.service
+Also=ssh.socket
+`), 0644))
+	assert.Empty(t, ioutil.WriteFile(path.Join(unitdir, "ssh.socket"), []byte(`[Install]
+WantedBy=sockets.target
+`), 0644))
+	assert.Empty(t, ioutil.WriteFile(path.Join(unitdir, "getty@.service"), []byte(`[Install]
+WantedBy=getty.target
+DefaultInstance=tty1
+`), 0644))
+
+	context := debos.DebosContext{&debos.CommonContext{Rootdir: dir}, "", "arm64"}
+	links := func() map[string]string {
+		found := make(map[string]string)
+		root := path.Join(dir, "etc/systemd/system")
+		filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode()&os.ModeSymlink != 0 {
+				rel, _ := filepath.Rel(root, p)
+				found[rel], _ = os.Readlink(p)
+			}
+			return nil
+		})
+		return found
+	}
+
+	r := runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: systemd-unit
+    enable: [ ssh.service, getty@.service, getty@ttyS0.service ]
+    mask: [ apt-daily.timer ]
+`, ""})
+	assert.Empty(t, r.Actions[0].Verify(&context))
+	assert.Empty(t, r.Actions[0].Run(&context))
+	assert.Equal(t, map[string]string{
+		"multi-user.target.wants/ssh.service":    "/lib/systemd/system/ssh.service",
+		"sshd.service":                           "/lib/systemd/system/ssh.service",
+		"sockets.target.wants/ssh.socket":        "/lib/systemd/system/ssh.socket",
+		"getty.target.wants/getty@tty1.service":  "/lib/systemd/system/getty@.service",
+		"getty.target.wants/getty@ttyS0.service": "/lib/systemd/system/getty@.service",
+		"apt-daily.timer":                        "/dev/null",
+	}, links())
+
+	r = runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: systemd-unit
+    disable: [ ssh.service, getty@tty1.service ]
+`, ""})
+	assert.Empty(t, r.Actions[0].Verify(&context))
+	assert.Empty(t, r.Actions[0].Run(&context))
+	assert.Equal(t, map[string]string{
+		"sockets.target.wants/ssh.socket":        "/lib/systemd/system/ssh.socket",
+		"getty.target.wants/getty@ttyS0.service": "/lib/systemd/system/getty@.service",
+		"apt-daily.timer":                        "/dev/null",
+	}, links())
+
+	r = runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: systemd-unit
+    enable: [ missing.service ]
+`, ""})
+	assert.Empty(t, r.Actions[0].Verify(&context))
+	assert.EqualError(t, r.Actions[0].Run(&context), "Unit missing.service not found in the target filesystem")
+
+	r = runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: systemd-unit
+    enable: [ ssh ]
+`, ""})
+	assert.EqualError(t, r.Actions[0].Verify(&context), "Invalid unit name 'ssh', expected a suffix such as '.service'")
+}
+
+func TestUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Empty(t, os.MkdirAll(path.Join(dir, "etc/skel"), 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "etc/skel/.profile"), []byte("# profile\n"), 0644))
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "etc/passwd"), []byte("root:x:0:0:root:/root:/bin/bash\n"), 0644))
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "etc/shadow"), []byte("root:*:18000:0:99999:7:::\n"), 0640))
+	assert.Empty(t, ioutil.WriteFile(path.Join(dir, "etc/group"), []byte("root:x:0:\nsudo:x:27:\n"), 0644))
+
+	context := debos.DebosContext{&debos.CommonContext{Rootdir: dir}, "", "arm64"}
+	read := func(file string) string {
+		content, _ := ioutil.ReadFile(path.Join(dir, file))
+		return string(content)
+	}
+
+	r := runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: users
+    users:
+      - name: root
+        password-hash: $6$salt$hash
+      - name: user
+        comment: Test user
+        groups: [ sudo ]
+        shell: /bin/bash
+        password: secret
+        sshkeys: [ "ssh-ed25519 AAAA user@host" ]
+      - name: locked
+        uid: 2000
+        lock: true
+`, ""})
+	assert.Empty(t, r.Actions[0].Verify(&context))
+	assert.Empty(t, r.Actions[0].Run(&context))
+
+	assert.Equal(t, `root:x:0:0:root:/root:/bin/bash
+user:x:1000:1000:Test user:/home/user:/bin/bash
+locked:x:2000:2000::/home/locked:/bin/sh
+`, read("etc/passwd"))
+	assert.Equal(t, "root:x:0:\nsudo:x:27:user\nuser:x:1000:\nlocked:x:2000:\n", read("etc/group"))
+
+	shadow := strings.Split(read("etc/shadow"), "\n")
+	assert.True(t, strings.HasPrefix(shadow[0], "root:$6$salt$hash:"))
+	fields := strings.Split(shadow[1], ":")
+	assert.Equal(t, "user", fields[0])
+	assert.Regexp(t, `^\$6\$[./0-9A-Za-z]{16}\$[./0-9A-Za-z]{86}$`, fields[1])
+	assert.True(t, strings.HasPrefix(shadow[2], "locked:!:"))
+
+	assert.Equal(t, "# profile\n", read("home/user/.profile"))
+	assert.Equal(t, "ssh-ed25519 AAAA user@host\n", read("home/user/.ssh/authorized_keys"))
+	fi, err := os.Stat(path.Join(dir, "home/user/.ssh/authorized_keys"))
+	assert.Empty(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	r = runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: users
+    users:
+      - name: locked
+        unlock: true
+`, ""})
+	assert.Empty(t, r.Actions[0].Verify(&context))
+	assert.EqualError(t, r.Actions[0].Run(&context), "Can't unlock user locked which has no password")
+
+	r = runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: users
+    users:
+      - name: one
+        uid: 1001
+      - name: two
+        uid: 1001
+`, ""})
+	assert.EqualError(t, r.Actions[0].Verify(&context), "Users one and two have the same uid 1001")
+
+	// Automatic uids skip the ones given to the following users
+	r = runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: users
+    users:
+      - name: auto
+      - name: fixed
+        uid: 1001
+`, ""})
+	assert.Empty(t, r.Actions[0].Verify(&context))
+	assert.Empty(t, r.Actions[0].Run(&context))
+	passwd := read("etc/passwd")
+	assert.Contains(t, passwd, "auto:x:1002:1002::/home/auto:/bin/sh\n")
+	assert.Contains(t, passwd, "fixed:x:1001:1001::/home/fixed:/bin/sh\n")
+
+	r = runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: users
+    users:
+      - name: user
+        password: secret
+        password-hash: $6$salt$hash
+`, ""})
+	assert.EqualError(t, r.Actions[0].Verify(&context), "User user: 'password' and 'password-hash' are mutually exclusive")
+}
+
+func TestMirrorLists(t *testing.T) {
+	r := runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: debootstrap
+    suite: bookworm
+    mirror: http://deb.debian.org/debian
+  - action: debootstrap
+    suite: bookworm
+    mirror:
+      - http://deb.debian.org/debian
+      - http://ftp.de.debian.org/debian
+  - action: apt
+    packages: [ hello ]
+    sources:
+      - uri: [ http://deb.debian.org/debian, http://ftp.de.debian.org/debian ]
+        suite: bookworm-backports
+        components: [ main ]
+`, ""})
+
+	single := r.Actions[0].Action.(*actions.DebootstrapAction)
+	assert.Equal(t, "http://deb.debian.org/debian", single.Mirror)
+	assert.Equal(t, "Bootstrap bookworm (main) from http://deb.debian.org/debian", single.Summary())
+
+	list := r.Actions[1].Action.(*actions.DebootstrapAction)
+	assert.Equal(t, "http://deb.debian.org/debian", list.Mirror)
+	assert.Equal(t, "Bootstrap bookworm (main) from http://deb.debian.org/debian (1 fallback mirrors)", list.Summary())
+
+	apt := r.Actions[2].Action.(*actions.AptAction)
+	assert.Equal(t, "http://deb.debian.org/debian", apt.Sources[0].Uri)
+	assert.Equal(t, "bookworm-backports", apt.Sources[0].Suite)
+}
+
+func TestZerofree(t *testing.T) {
+	context := debos.DebosContext{&debos.CommonContext{}, "", "arm64"}
+
+	r := runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: zerofree
+    method: dd
+`, ""})
+	assert.EqualError(t, r.Actions[0].Verify(&context), "Unknown zerofree method 'dd', either 'zerofree' or 'fill'")
+
+	r = runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: zerofree
+    method: fill
+`, ""})
+	assert.EqualError(t, r.Actions[0].Run(&context), "No partitions to zero, missing image-partition action?")
+
+	context.ImagePartitions = []debos.Partition{{"root", "/dev/null"}}
+	r = runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: zerofree
+    method: fill
+    partitions: [ boot ]
+`, ""})
+	assert.EqualError(t, r.Actions[0].Run(&context), "Partition boot not found")
+
+	r = runTest(t, testRecipe{`
+architecture: arm64
+
+actions:
+  - action: zerofree
+    method: fill
+    partitions: [ root ]
+`, ""})
+	assert.EqualError(t, r.Actions[0].Run(&context), "Partition root must be mounted to fill its free space")
+}
@@ -0,0 +1,157 @@
+/*
+Resize Action
+
+Install a service growing the root partition and filesystem to fill the
+device on the first boot, for images written to disks of various sizes, e.g.
+SD cards.
+
+The service extends the partition holding '/' with 'sfdisk' and then grows the
+filesystem while it's mounted, so the target filesystem needs to provide the
+matching tools: 'fdisk' and 'e2fsprogs', 'btrfs-progs' or 'xfsprogs'. The
+root partition must be the last one of the disk. Once done the service
+disables itself.
+
+Yaml syntax:
+ - action: resize
+   filesystem: ext4
+
+Optional properties:
+
+- filesystem -- filesystem of the root partition, checked to support growing
+online: 'ext2', 'ext3', 'ext4', 'btrfs' or 'xfs'. If unset, the filesystem of
+the root partition of the image is checked if any.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+const resizeService = "debos-grow-root.service"
+
+const resizeScript = `#!/bin/sh
+# Grow the root partition and filesystem to fill the device, installed by debos
+set -e
+
+root=$(findmnt -n -o SOURCE /)
+# Drop the btrfs subvolume if any
+root=${root%%\[*}
+fstype=$(findmnt -n -o FSTYPE /)
+
+part=$(basename "$(readlink -f "$root")")
+disk=$(basename "$(readlink -f "/sys/class/block/$part/..")")
+partnum=$(cat "/sys/class/block/$part/partition")
+
+# Move the backup GPT header to the end of the device first
+sfdisk --relocate gpt-bak-std "/dev/$disk" || true
+echo ", +" | sfdisk --no-reread --no-tell-kernel -N "$partnum" "/dev/$disk"
+partx -u "/dev/$disk"
+
+case "$fstype" in
+ext2|ext3|ext4)
+	resize2fs "$root"
+	;;
+btrfs)
+	btrfs filesystem resize max /
+	;;
+xfs)
+	xfs_growfs /
+	;;
+*)
+	echo "Don't know how to grow $fstype filesystems" >&2
+	exit 1
+	;;
+esac
+`
+
+const resizeUnit = `[Unit]
+Description=Grow the root filesystem to fill the device
+DefaultDependencies=no
+After=local-fs.target
+Before=sysinit.target shutdown.target
+Conflicts=shutdown.target
+
+[Service]
+Type=oneshot
+ExecStart=/usr/sbin/debos-grow-root
+ExecStartPost=/bin/systemctl --no-reload disable ` + resizeService + `
+RemainAfterExit=yes
+
+[Install]
+WantedBy=sysinit.target
+`
+
+// Filesystems which can be grown while mounted
+var resizeFilesystems = map[string]bool{
+	"ext2":  true,
+	"ext3":  true,
+	"ext4":  true,
+	"btrfs": true,
+	"xfs":   true,
+}
+
+type ResizeAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Filesystem       string
+}
+
+func (r *ResizeAction) checkFilesystem(fs string) error {
+	if !resizeFilesystems[fs] {
+		return fmt.Errorf("Filesystem %s can't be grown online", fs)
+	}
+	return nil
+}
+
+func (r *ResizeAction) Verify(context *debos.DebosContext) error {
+	if r.Filesystem != "" {
+		return r.checkFilesystem(r.Filesystem)
+	}
+	return nil
+}
+
+func (r *ResizeAction) Summary() string {
+	return "Grow the root partition and filesystem on the first boot"
+}
+
+func (r *ResizeAction) Run(context *debos.DebosContext) error {
+	r.LogStart()
+
+	// The partitioned image tells which filesystem will be grown
+	if r.Filesystem == "" && context.ImageRootDevice != "" {
+		out, err := exec.Command("blkid", "-o", "value", "-s", "TYPE", context.ImageRootDevice).Output()
+		if err != nil {
+			return fmt.Errorf("Failed to get the filesystem of %s: %v", context.ImageRootDevice, err)
+		}
+		if err := r.checkFilesystem(strings.TrimSpace(string(out))); err != nil {
+			return err
+		}
+	}
+
+	script := path.Join(context.Rootdir, "usr/sbin/debos-grow-root")
+	if err := os.MkdirAll(path.Dir(script), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(script, []byte(resizeScript), 0755); err != nil {
+		return err
+	}
+
+	unitdir := path.Join(context.Rootdir, "etc/systemd/system")
+	if err := os.MkdirAll(path.Join(unitdir, "sysinit.target.wants"), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(unitdir, resizeService), []byte(resizeUnit), 0644); err != nil {
+		return err
+	}
+
+	// Enable the service, like systemctl would
+	link := path.Join(unitdir, "sysinit.target.wants", resizeService)
+	os.Remove(link)
+	return os.Symlink(path.Join("/etc/systemd/system", resizeService), link)
+}
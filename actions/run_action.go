@@ -12,13 +12,16 @@ Yaml syntax:
    script: script name
    command: command line
    label: string
+   env:
+     VARIABLE: value
 
 Properties 'command' and 'script' are mutually exclusive.
 
 - command -- command with arguments; the command expected to be accessible in
 host's or chrooted environment -- depending on 'chroot' property.
 
-- script -- script with arguments; script must be located in recipe directory.
+- script -- script with arguments; script must be located in recipe directory
+and be executable.
 
 Optional properties:
 
@@ -30,9 +33,27 @@ directory where the image is mounted ($IMAGEMNTDIR).
 In both cases it is run with root privileges. If unset, chroot is set to false and
 the command or script is run in the host environment.
 
+In the chroot the command is started with 'systemd-nspawn', which provides its
+own '/proc', '/sys' and '/dev' to the target filesystem. Only the image file and
+its partition devices (if any) and the script directory (mounted as
+'/tmp/script') are made available from the build environment; the recipe and
+artifact directories are not accessible. Starting and stopping services is
+prohibited during the command.
+
+When 'systemd-nspawn' isn't available, debos falls back to 'chroot' with a
+warning, mounting '/proc', '/sys', '/dev' and the files above in the target
+filesystem for the duration of the command. Unlike with 'systemd-nspawn', the
+command shares the network and the processes of the build environment.
+
+On the host the command shares all the mounts of the build environment, i.e.
+the fakemachine or the host itself when running without fakemachine.
+
 - label -- if non-empty, this string is used to label output. If empty,
 a label is derived from the command or script.
 
+- env -- environment variables to set for the command or script, both on the
+host and in the chroot. These override inherited variables with the same name.
+
 - postprocess -- if set script or command is executed after all other commands and
 has access to the recipe directory ($RECIPEDIR) and the artifact directory ($ARTIFACTDIR).
 The working directory will be set to the artifact directory.
@@ -44,8 +65,11 @@ package actions
 
 import (
 	"errors"
+	"fmt"
 	"github.com/go-debos/fakemachine"
+	"os"
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/go-debos/debos"
@@ -58,6 +82,7 @@ type RunAction struct {
 	Script           string
 	Command          string
 	Label            string
+	Env              map[string]string
 }
 
 func (run *RunAction) Verify(context *debos.DebosContext) error {
@@ -68,6 +93,23 @@ func (run *RunAction) Verify(context *debos.DebosContext) error {
 	if run.Script == "" && run.Command == "" {
 		return errors.New("Script and Command both cannot be empty")
 	}
+
+	if run.Script != "" && run.Command != "" {
+		return errors.New("Script and Command are mutually exclusive")
+	}
+
+	if run.Script != "" {
+		// Expect we have no blank spaces in path
+		script := debos.CleanPathAt(strings.SplitN(run.Script, " ", 2)[0], context.RecipeDir)
+		fi, err := os.Stat(script)
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&0111 == 0 {
+			return fmt.Errorf("Script %s is not executable", script)
+		}
+	}
+
 	return nil
 }
 
@@ -140,9 +182,32 @@ func (run *RunAction) doRun(context debos.DebosContext) error {
 		}
 	}
 
+	// Sort to get a stable environment order
+	keys := make([]string, 0, len(run.Env))
+	for k := range run.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cmd.AddEnvKey(k, run.Env[k])
+	}
+
 	return cmd.Run(label, cmdline...)
 }
 
+func (run *RunAction) Summary() string {
+	where := "on the host"
+	if run.Chroot {
+		where = "in the chroot"
+	} else if run.PostProcess {
+		where = "on the host after the build"
+	}
+	if run.Script != "" {
+		return fmt.Sprintf("Run script '%s' %s", run.Script, where)
+	}
+	return fmt.Sprintf("Run command '%s' %s", run.Command, where)
+}
+
 func (run *RunAction) Run(context *debos.DebosContext) error {
 	if run.PostProcess {
 		/* This runs in postprocessing instead */
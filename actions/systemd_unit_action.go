@@ -0,0 +1,340 @@
+/*
+SystemdUnit Action
+
+Enable, disable or mask systemd units of the target filesystem. Like
+'systemctl enable' the symlinks in '/etc/systemd/system' are created from the
+'[Install]' section of the units, but without needing systemd to run in the
+chroot, which fails with some units or in some build environments.
+
+Yaml syntax:
+ - action: systemd-unit
+   enable:
+     - unit
+   disable:
+     - unit
+   mask:
+     - unit
+
+Optional properties, at least one of them has to be set:
+
+- enable -- list of units to enable, e.g. 'ssh.service' or
+'getty@ttyS0.service'. The symlinks are created as per the 'WantedBy',
+'RequiredBy', 'Alias' and 'Also' settings of the units.
+
+- disable -- list of units to disable, removing their symlinks in
+'/etc/systemd/system'.
+
+- mask -- list of units to mask, which prevents them from being started at all.
+
+The units to enable or disable must be installed in the target filesystem when
+the action runs, in '/etc/systemd/system', '/usr/local/lib/systemd/system',
+'/lib/systemd/system' or '/usr/lib/systemd/system'. Units are disabled first,
+then enabled and finally masked.
+*/
+package actions
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-debos/debos"
+)
+
+// Directories holding the units, by priority
+var systemdUnitDirs = []string{
+	"/etc/systemd/system",
+	"/usr/local/lib/systemd/system",
+	"/lib/systemd/system",
+	"/usr/lib/systemd/system",
+}
+
+var systemdUnitTypes = []string{
+	".automount", ".device", ".mount", ".path", ".scope", ".service",
+	".slice", ".socket", ".swap", ".target", ".timer",
+}
+
+type SystemdUnitAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Enable           []string
+	Disable          []string
+	Mask             []string
+}
+
+// unitInstall holds the '[Install]' section of a unit
+type unitInstall struct {
+	WantedBy        []string
+	RequiredBy      []string
+	Alias           []string
+	Also            []string
+	DefaultInstance string
+}
+
+func checkUnitName(unit string) error {
+	if strings.Contains(unit, "/") {
+		return fmt.Errorf("Invalid unit name '%s'", unit)
+	}
+	for _, t := range systemdUnitTypes {
+		if strings.HasSuffix(unit, t) && len(unit) > len(t) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid unit name '%s', expected a suffix such as '.service'", unit)
+}
+
+func (s *SystemdUnitAction) Verify(context *debos.DebosContext) error {
+	if len(s.Enable) == 0 && len(s.Disable) == 0 && len(s.Mask) == 0 {
+		return errors.New("At least one of 'enable', 'disable' or 'mask' is required")
+	}
+
+	listed := make(map[string]string)
+	for property, units := range map[string][]string{"enable": s.Enable, "disable": s.Disable, "mask": s.Mask} {
+		for _, unit := range units {
+			if err := checkUnitName(unit); err != nil {
+				return err
+			}
+			if other, found := listed[unit]; found && other != property {
+				return fmt.Errorf("Unit %s is listed in both '%s' and '%s'", unit, other, property)
+			}
+			listed[unit] = property
+		}
+	}
+
+	return nil
+}
+
+func (s *SystemdUnitAction) Summary() string {
+	var summary []string
+	if len(s.Enable) > 0 {
+		summary = append(summary, "Enable "+strings.Join(s.Enable, ", "))
+	}
+	if len(s.Disable) > 0 {
+		summary = append(summary, "Disable "+strings.Join(s.Disable, ", "))
+	}
+	if len(s.Mask) > 0 {
+		summary = append(summary, "Mask "+strings.Join(s.Mask, ", "))
+	}
+	return strings.Join(summary, "\n")
+}
+
+/* unitTemplate returns the template of an instance, e.g. 'getty@.service' for
+ * 'getty@tty1.service', along with the instance */
+func unitTemplate(unit string) (string, string) {
+	at := strings.Index(unit, "@")
+	dot := strings.LastIndex(unit, ".")
+	if at < 0 || dot < at {
+		return unit, ""
+	}
+	return unit[:at+1] + unit[dot:], unit[at+1 : dot]
+}
+
+/* findUnit returns the path in the target filesystem of the file of the unit,
+ * instances using the file of their template */
+func findUnit(context *debos.DebosContext, unit string) (string, error) {
+	template, _ := unitTemplate(unit)
+	for _, dir := range systemdUnitDirs {
+		for _, name := range []string{unit, template} {
+			file := path.Join(dir, name)
+			fi, err := os.Lstat(path.Join(context.Rootdir, file))
+			// Masked units aren't installed ones
+			if err != nil || fi.Mode()&os.ModeSymlink != 0 && dir == "/etc/systemd/system" {
+				continue
+			}
+			return file, nil
+		}
+	}
+
+	return "", fmt.Errorf("Unit %s not found in the target filesystem", unit)
+}
+
+// parseInstall reads the '[Install]' section of the unit file
+func parseInstall(file string) (unitInstall, error) {
+	var install unitInstall
+
+	f, err := os.Open(file)
+	if err != nil {
+		return install, err
+	}
+	defer f.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			section = strings.Trim(line, "[]")
+			continue
+		}
+		if section != "Install" {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		values := strings.Fields(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "WantedBy":
+			install.WantedBy = append(install.WantedBy, values...)
+		case "RequiredBy":
+			install.RequiredBy = append(install.RequiredBy, values...)
+		case "Alias":
+			install.Alias = append(install.Alias, values...)
+		case "Also":
+			install.Also = append(install.Also, values...)
+		case "DefaultInstance":
+			install.DefaultInstance = strings.TrimSpace(kv[1])
+		}
+	}
+
+	return install, scanner.Err()
+}
+
+// unitLinks returns the symlinks enabling the unit, relative to /etc/systemd/system
+func unitLinks(unit string, install unitInstall) []string {
+	var links []string
+
+	if _, instance := unitTemplate(unit); strings.Contains(unit, "@") && instance == "" {
+		// Enabling a template enables its default instance
+		if install.DefaultInstance == "" {
+			return nil
+		}
+		unit = strings.Replace(unit, "@.", "@"+install.DefaultInstance+".", 1)
+	}
+
+	for _, target := range install.WantedBy {
+		links = append(links, path.Join(target+".wants", unit))
+	}
+	for _, target := range install.RequiredBy {
+		links = append(links, path.Join(target+".requires", unit))
+	}
+	links = append(links, install.Alias...)
+
+	return links
+}
+
+func (s *SystemdUnitAction) install(context *debos.DebosContext, unit string) (string, unitInstall, error) {
+	file, err := findUnit(context, unit)
+	if err != nil {
+		return "", unitInstall{}, err
+	}
+
+	install, err := parseInstall(path.Join(context.Rootdir, file))
+	if err != nil {
+		return "", unitInstall{}, fmt.Errorf("Failed to read unit %s: %v", unit, err)
+	}
+
+	return file, install, nil
+}
+
+func (s *SystemdUnitAction) enable(context *debos.DebosContext, unit string, done map[string]bool) error {
+	if done[unit] {
+		return nil
+	}
+	done[unit] = true
+
+	file, install, err := s.install(context, unit)
+	if err != nil {
+		return err
+	}
+
+	links := unitLinks(unit, install)
+	if len(links) == 0 && len(install.Also) == 0 {
+		debos.Warnf("Unit %s has no installation config, nothing to enable\n", unit)
+	}
+
+	for _, link := range links {
+		target := path.Join(context.Rootdir, "/etc/systemd/system", link)
+		if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+			return err
+		}
+		os.Remove(target)
+		if err := os.Symlink(file, target); err != nil {
+			return fmt.Errorf("Failed to enable %s: %v", unit, err)
+		}
+	}
+
+	for _, also := range install.Also {
+		if err := s.enable(context, also, done); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SystemdUnitAction) disable(context *debos.DebosContext, unit string) error {
+	_, install, err := s.install(context, unit)
+	if err != nil {
+		return err
+	}
+
+	links := unitLinks(unit, install)
+
+	// Also drop the links not matching the current installation config
+	dirs, _ := ioutil.ReadDir(path.Join(context.Rootdir, "/etc/systemd/system"))
+	for _, dir := range dirs {
+		if dir.IsDir() && (strings.HasSuffix(dir.Name(), ".wants") || strings.HasSuffix(dir.Name(), ".requires")) {
+			links = append(links, path.Join(dir.Name(), unit))
+		}
+	}
+
+	for _, link := range links {
+		target := path.Join(context.Rootdir, "/etc/systemd/system", link)
+		if fi, err := os.Lstat(target); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if err := os.Remove(target); err != nil {
+			return fmt.Errorf("Failed to disable %s: %v", unit, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *SystemdUnitAction) mask(context *debos.DebosContext, unit string) error {
+	target := path.Join(context.Rootdir, "/etc/systemd/system", unit)
+	if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("Can't mask %s which is installed in /etc/systemd/system", unit)
+	}
+	os.Remove(target)
+
+	return os.Symlink("/dev/null", target)
+}
+
+func (s *SystemdUnitAction) Run(context *debos.DebosContext) error {
+	s.LogStart()
+
+	for _, unit := range s.Disable {
+		if err := s.disable(context, unit); err != nil {
+			return err
+		}
+	}
+
+	done := make(map[string]bool)
+	for _, unit := range s.Enable {
+		if err := s.enable(context, unit, done); err != nil {
+			return err
+		}
+	}
+
+	for _, unit := range s.Mask {
+		if err := s.mask(context, unit); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
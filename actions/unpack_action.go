@@ -4,13 +4,15 @@ Unpack Action
 Unpack files from archive to the filesystem.
 Useful for creating target rootfs from saved tarball with prepared file structure.
 
-Only (compressed) tar archives are supported currently.
+Only (compressed) tar archives are supported currently. Extended attributes
+stored in the archive, such as file capabilities, are restored.
 
 Yaml syntax:
  - action: unpack
    origin: name
    file: file.ext
    compression: gz
+   verify: bool
 
 Mandatory properties:
 
@@ -27,14 +29,23 @@ The default value is 'artifacts' directory in case if this property is omitted.
 
 - compression -- optional hint for unpack allowing to use proper compression method.
 
-Currently only 'gz', bzip2' and 'xz' compression types are supported.
-If not provided an attempt to autodetect the compression type will be done.
+Currently only 'gz', 'bzip2', 'xz' and 'zstd' compression types are supported.
+If not provided the compression type is detected from the content of the
+archive.
+
+- verify -- if set to `true` the archive is checked against the checksum file
+written next to it by the 'Pack' action, e.g. 'rootfs.tar.gz.sha256', before
+unpacking it. 'sha256', 'sha512' and 'md5' checksum files are looked for in
+this order.
 */
 package actions
 
 import (
 	"fmt"
 	"github.com/go-debos/debos"
+	"io/ioutil"
+	"os"
+	"strings"
 )
 
 type UnpackAction struct {
@@ -42,6 +53,7 @@ type UnpackAction struct {
 	Compression      string
 	Origin           string
 	File             string
+	VerifyChecksum   bool `yaml:"verify"`
 }
 
 func (pf *UnpackAction) Verify(context *debos.DebosContext) error {
@@ -66,6 +78,14 @@ func (pf *UnpackAction) Verify(context *debos.DebosContext) error {
 	return nil
 }
 
+func (pf *UnpackAction) Summary() string {
+	origin := "artifacts"
+	if len(pf.Origin) > 0 {
+		origin = pf.Origin
+	}
+	return fmt.Sprintf("Unpack %s from %s to rootfs", pf.File, origin)
+}
+
 func (pf *UnpackAction) Run(context *debos.DebosContext) error {
 	pf.LogStart()
 	var origin string
@@ -86,6 +106,12 @@ func (pf *UnpackAction) Run(context *debos.DebosContext) error {
 		return err
 	}
 
+	if pf.VerifyChecksum {
+		if err := pf.verifyChecksum(infile); err != nil {
+			return err
+		}
+	}
+
 	archive, err := debos.NewArchive(infile)
 	if err != nil {
 		return err
@@ -96,5 +122,46 @@ func (pf *UnpackAction) Run(context *debos.DebosContext) error {
 		}
 	}
 
-	return archive.Unpack(context.Rootdir)
+	if err := archive.Unpack(context.Rootdir); err != nil {
+		return err
+	}
+
+	return debos.RecordFile(debos.FileRecord{
+		Action:      "unpack",
+		Source:      infile,
+		Destination: "/",
+		Type:        "archive",
+	})
+}
+
+// verifyChecksum checks the archive against the first checksum file found
+func (pf *UnpackAction) verifyChecksum(infile string) error {
+	for _, algorithm := range []string{"sha256", "sha512", "md5"} {
+		content, err := ioutil.ReadFile(infile + "." + algorithm)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		fields := strings.Fields(string(content))
+		if len(fields) == 0 {
+			return fmt.Errorf("Invalid checksum file for %s", pf.File)
+		}
+
+		h := HashAction{Algorithm: algorithm}
+		sum, err := h.hashFile(infile)
+		if err != nil {
+			return err
+		}
+		if sum != strings.ToLower(fields[0]) {
+			return fmt.Errorf("Checksum mismatch for %s: expected %s, got %s", pf.File, fields[0], sum)
+		}
+
+		debos.Infof("Verified %s checksum of %s\n", algorithm, pf.File)
+		return nil
+	}
+
+	return fmt.Errorf("No checksum file found for %s", pf.File)
 }
@@ -0,0 +1,590 @@
+/*
+Users Action
+
+Create or modify the user accounts of the target filesystem, writing
+'/etc/passwd', '/etc/shadow' and '/etc/group' directly rather than running
+'useradd' or 'chpasswd' in the chroot. Existing users, e.g. 'root', are
+modified, other users are created along with a group of the same name and
+their home directory, populated from '/etc/skel'.
+
+Yaml syntax:
+ - action: users
+   users:
+     - name: user
+       uid: 1000
+       groups:
+         - group
+       shell: /bin/bash
+       home: /home/user
+       comment: Full name
+       password: secret
+       password-hash: hash
+       lock: bool
+       unlock: bool
+       sshkeys:
+         - key
+
+Mandatory properties:
+
+- users -- list of the users to create or modify, see below.
+
+Properties of the users:
+
+- name -- name of the user, mandatory.
+
+- uid -- user id of a new user, the first free one from 1000 by default.
+
+- groups -- list of existing groups the user is added to, e.g. 'sudo'.
+
+- shell -- login shell, '/bin/sh' by default for new users.
+
+- home -- home directory, '/home/<name>' by default for new users.
+
+- comment -- comment of the account, usually the full name of the user.
+
+- password -- password of the user, stored hashed with SHA-512. Better passed as
+a template variable than written in the recipe, e.g. '{{ .password }}'.
+
+- password-hash -- password already hashed in the crypt(3) format, e.g. with
+'mkpasswd'. Mutually exclusive with 'password'.
+
+- lock -- lock the password of the account, which prevents logging in with a
+password while keeping e.g. SSH keys working. New users are locked until given
+a password.
+
+- unlock -- unlock the password of the account.
+
+- sshkeys -- list of SSH public keys added to '~/.ssh/authorized_keys'.
+*/
+package actions
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-debos/debos"
+)
+
+var userNameRe = regexp.MustCompile(`^[a-z_][a-z0-9_.-]{0,30}\$?$`)
+
+type User struct {
+	Name         string
+	Uid          *int
+	Groups       []string
+	Shell        string
+	Home         string
+	Comment      string
+	Password     string
+	PasswordHash string `yaml:"password-hash"`
+	Lock         bool
+	Unlock       bool
+	SSHKeys      []string `yaml:"sshkeys"`
+}
+
+type UsersAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Users            []User
+}
+
+// Alphabet of the crypt(3) hashes
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+/* sha512Crypt hashes the password with the salt as per the SHA-512 crypt(3)
+ * algorithm, see https://www.akkadia.org/drepper/SHA-crypt.txt */
+func sha512Crypt(password, salt string, rounds int) string {
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	pw, s := []byte(password), []byte(salt)
+
+	// Repeats sum to length bytes
+	repeat := func(sum []byte, length int) []byte {
+		var out []byte
+		for ; length > len(sum); length -= len(sum) {
+			out = append(out, sum...)
+		}
+		return append(out, sum[:length]...)
+	}
+
+	b := sha512.New()
+	b.Write(pw)
+	b.Write(s)
+	b.Write(pw)
+	sumB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(pw)
+	a.Write(s)
+	a.Write(repeat(sumB, len(pw)))
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(sumB)
+		} else {
+			a.Write(pw)
+		}
+	}
+	sumA := a.Sum(nil)
+
+	dp := sha512.New()
+	for range pw {
+		dp.Write(pw)
+	}
+	p := repeat(dp.Sum(nil), len(pw))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(sumA[0]); i++ {
+		ds.Write(s)
+	}
+	sumS := repeat(ds.Sum(nil), len(s))
+
+	sum := sumA
+	for i := 0; i < rounds; i++ {
+		c := sha512.New()
+		if i&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(sum)
+		}
+		if i%3 != 0 {
+			c.Write(sumS)
+		}
+		if i%7 != 0 {
+			c.Write(p)
+		}
+		if i&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(p)
+		}
+		sum = c.Sum(nil)
+	}
+
+	hash := "$6$"
+	if rounds != 5000 {
+		hash += fmt.Sprintf("rounds=%d$", rounds)
+	}
+	hash += salt + "$"
+
+	encode := func(b2, b1, b0 byte, n int) {
+		w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+		for ; n > 0; n-- {
+			hash += string(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	for i := 0; i < 21; i++ {
+		// The bytes are shuffled as (0, 21, 42), (22, 43, 1), (44, 2, 23)...
+		idx := [3]int{i, i + 21, i + 42}
+		rot := i % 3
+		encode(sum[idx[rot]], sum[idx[(rot+1)%3]], sum[idx[(rot+2)%3]], 4)
+	}
+	encode(0, 0, sum[63], 2)
+
+	return hash
+}
+
+// hashPassword hashes the password with a random salt
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	for i := range salt {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(cryptAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		salt[i] = cryptAlphabet[n.Int64()]
+	}
+
+	return sha512Crypt(password, string(salt), 5000), nil
+}
+
+func (u *UsersAction) Verify(context *debos.DebosContext) error {
+	if len(u.Users) == 0 {
+		return errors.New("'users' property can't be empty")
+	}
+
+	names := make(map[string]bool)
+	uids := make(map[int]string)
+	for _, user := range u.Users {
+		if user.Name == "" {
+			return errors.New("User without a name")
+		}
+		if !userNameRe.MatchString(user.Name) {
+			return fmt.Errorf("Invalid user name '%s'", user.Name)
+		}
+		if names[user.Name] {
+			return fmt.Errorf("User %s is listed twice", user.Name)
+		}
+		names[user.Name] = true
+
+		if user.Uid != nil {
+			if *user.Uid < 0 {
+				return fmt.Errorf("Invalid uid %d for user %s", *user.Uid, user.Name)
+			}
+			if other, found := uids[*user.Uid]; found {
+				return fmt.Errorf("Users %s and %s have the same uid %d", other, user.Name, *user.Uid)
+			}
+			uids[*user.Uid] = user.Name
+		}
+
+		if user.Password != "" && user.PasswordHash != "" {
+			return fmt.Errorf("User %s: 'password' and 'password-hash' are mutually exclusive", user.Name)
+		}
+		if user.PasswordHash != "" && (!strings.HasPrefix(user.PasswordHash, "$") || strings.Contains(user.PasswordHash, ":")) {
+			return fmt.Errorf("User %s: invalid password hash, expected the crypt(3) format", user.Name)
+		}
+		if user.Lock && user.Unlock {
+			return fmt.Errorf("User %s: 'lock' and 'unlock' are mutually exclusive", user.Name)
+		}
+
+		if user.Shell != "" && !path.IsAbs(user.Shell) {
+			return fmt.Errorf("User %s: the shell must be an absolute path", user.Name)
+		}
+		if user.Home != "" && !path.IsAbs(user.Home) {
+			return fmt.Errorf("User %s: the home directory must be an absolute path", user.Name)
+		}
+		if strings.Contains(user.Comment, ":") {
+			return fmt.Errorf("User %s: the comment can't contain ':'", user.Name)
+		}
+
+		for _, key := range user.SSHKeys {
+			if len(strings.Fields(key)) < 2 || strings.Contains(key, "\n") {
+				return fmt.Errorf("User %s: invalid SSH key '%s'", user.Name, key)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (u *UsersAction) Summary() string {
+	var names []string
+	for _, user := range u.Users {
+		names = append(names, user.Name)
+	}
+	return "Set up users " + strings.Join(names, ", ")
+}
+
+// accountFile is a file of colon separated entries, e.g. /etc/passwd
+type accountFile struct {
+	file    string
+	entries [][]string
+}
+
+func readAccountFile(file string) (*accountFile, error) {
+	f := &accountFile{file: file}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		if line != "" {
+			f.entries = append(f.entries, strings.Split(line, ":"))
+		}
+	}
+
+	return f, nil
+}
+
+// find returns the entry of name, nil if not found
+func (f *accountFile) find(name string) []string {
+	if f == nil {
+		return nil
+	}
+	for _, e := range f.entries {
+		if e[0] == name {
+			return e
+		}
+	}
+	return nil
+}
+
+func (f *accountFile) add(fields ...string) {
+	if f != nil {
+		f.entries = append(f.entries, fields)
+	}
+}
+
+// used tells whether the id is the third field of an entry
+func (f *accountFile) used(id int) bool {
+	for _, e := range f.entries {
+		if len(e) > 2 && e[2] == strconv.Itoa(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrite the file in place, keeping its owner and permissions
+func (f *accountFile) write() error {
+	if f == nil {
+		return nil
+	}
+
+	var lines []string
+	for _, e := range f.entries {
+		lines = append(lines, strings.Join(e, ":"))
+	}
+	return ioutil.WriteFile(f.file, []byte(strings.Join(lines, "\n")+"\n"), 0640)
+}
+
+// addMember adds the user to the comma separated members of the entry
+func addMember(entry []string, field int, user string) {
+	if len(entry) <= field {
+		return
+	}
+
+	var members []string
+	if entry[field] != "" {
+		members = strings.Split(entry[field], ",")
+	}
+	for _, m := range members {
+		if m == user {
+			return
+		}
+	}
+	entry[field] = strings.Join(append(members, user), ",")
+}
+
+type accounts struct {
+	passwd, shadow, group, gshadow *accountFile
+	reserved                       map[int]bool // Uids given to the users still to create
+}
+
+func (a *accounts) createUser(context *debos.DebosContext, user User, days string) ([]string, error) {
+	uid := 1000
+	if user.Uid != nil {
+		uid = *user.Uid
+		if a.passwd.used(uid) {
+			return nil, fmt.Errorf("Can't create user %s, uid %d is already used", user.Name, uid)
+		}
+	} else {
+		for a.passwd.used(uid) || a.reserved[uid] {
+			uid++
+		}
+	}
+
+	gid := uid
+	if g := a.group.find(user.Name); g != nil {
+		gid, _ = strconv.Atoi(g[2])
+	} else {
+		for a.group.used(gid) || (gid != uid && a.reserved[gid]) {
+			gid++
+		}
+		a.group.add(user.Name, "x", strconv.Itoa(gid), "")
+		a.gshadow.add(user.Name, "!", "", "")
+	}
+
+	home := user.Home
+	if home == "" {
+		home = path.Join("/home", user.Name)
+	}
+	shell := user.Shell
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+
+	entry := []string{user.Name, "x", strconv.Itoa(uid), strconv.Itoa(gid), user.Comment, home, shell}
+	a.passwd.add(entry...)
+	if a.shadow.find(user.Name) == nil {
+		a.shadow.add(user.Name, "!", days, "0", "99999", "7", "", "", "")
+	}
+
+	// Populate the home directory like useradd
+	homedir := path.Join(context.Rootdir, home)
+	if _, err := os.Stat(homedir); os.IsNotExist(err) {
+		if err := os.MkdirAll(homedir, 0700); err != nil {
+			return nil, err
+		}
+		skel := path.Join(context.Rootdir, "etc/skel")
+		if _, err := os.Stat(skel); err == nil {
+			options := debos.CopyTreeOptions{ForceOwner: true, Uid: uid, Gid: gid}
+			if err := debos.CopyTreeWithOptions(skel, homedir, options); err != nil {
+				return nil, err
+			}
+		}
+		if err := os.Chown(homedir, uid, gid); err != nil {
+			return nil, err
+		}
+	}
+
+	return entry, nil
+}
+
+func (a *accounts) setupUser(context *debos.DebosContext, user User, days string) error {
+	entry := a.passwd.find(user.Name)
+	if entry == nil {
+		var err error
+		if entry, err = a.createUser(context, user, days); err != nil {
+			return err
+		}
+	} else {
+		if len(entry) < 7 {
+			return fmt.Errorf("Invalid entry for user %s in /etc/passwd", user.Name)
+		}
+		if user.Uid != nil && strconv.Itoa(*user.Uid) != entry[2] {
+			return fmt.Errorf("User %s already exists with uid %s", user.Name, entry[2])
+		}
+		if user.Comment != "" {
+			entry[4] = user.Comment
+		}
+		if user.Home != "" {
+			entry[5] = user.Home
+		}
+		if user.Shell != "" {
+			entry[6] = user.Shell
+		}
+	}
+
+	for _, group := range user.Groups {
+		g := a.group.find(group)
+		if g == nil {
+			return fmt.Errorf("Group %s of user %s not found", group, user.Name)
+		}
+		addMember(g, 3, user.Name)
+		addMember(a.gshadow.find(group), 3, user.Name)
+	}
+
+	shadow := a.shadow.find(user.Name)
+	if shadow == nil {
+		shadow = []string{user.Name, "!", days, "0", "99999", "7", "", "", ""}
+		a.shadow.add(shadow...)
+		shadow = a.shadow.find(user.Name)
+	}
+
+	switch {
+	case user.Password != "":
+		hash, err := hashPassword(user.Password)
+		if err != nil {
+			return err
+		}
+		shadow[1] = hash
+		shadow[2] = days
+	case user.PasswordHash != "":
+		shadow[1] = user.PasswordHash
+		shadow[2] = days
+	}
+
+	switch {
+	case user.Lock && !strings.HasPrefix(shadow[1], "!"):
+		shadow[1] = "!" + shadow[1]
+	case user.Unlock:
+		if strings.TrimLeft(shadow[1], "!") == "" {
+			return fmt.Errorf("Can't unlock user %s which has no password", user.Name)
+		}
+		shadow[1] = strings.TrimLeft(shadow[1], "!")
+	}
+
+	if len(user.SSHKeys) > 0 {
+		uid, _ := strconv.Atoi(entry[2])
+		gid, _ := strconv.Atoi(entry[3])
+		if err := addSSHKeys(path.Join(context.Rootdir, entry[5]), uid, gid, user.SSHKeys); err != nil {
+			return fmt.Errorf("Failed to add the SSH keys of user %s: %v", user.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// addSSHKeys adds the keys missing from the authorized_keys of the home
+func addSSHKeys(home string, uid, gid int, keys []string) error {
+	dir := path.Join(home, ".ssh")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Chown(dir, uid, gid); err != nil {
+		return err
+	}
+
+	file := path.Join(dir, "authorized_keys")
+	content, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for _, line := range strings.Split(string(content), "\n") {
+		existing[strings.TrimSpace(line)] = true
+	}
+	for _, key := range keys {
+		if key = strings.TrimSpace(key); !existing[key] {
+			if len(content) > 0 && content[len(content)-1] != '\n' {
+				content = append(content, '\n')
+			}
+			content = append(content, key+"\n"...)
+			existing[key] = true
+		}
+	}
+
+	if err := ioutil.WriteFile(file, content, 0600); err != nil {
+		return err
+	}
+	return os.Chown(file, uid, gid)
+}
+
+func (u *UsersAction) Run(context *debos.DebosContext) error {
+	u.LogStart()
+
+	var a accounts
+	var err error
+	for _, f := range []struct {
+		file     string
+		target   **accountFile
+		optional bool
+	}{
+		{"etc/passwd", &a.passwd, false},
+		{"etc/group", &a.group, false},
+		{"etc/shadow", &a.shadow, false},
+		{"etc/gshadow", &a.gshadow, true},
+	} {
+		*f.target, err = readAccountFile(path.Join(context.Rootdir, f.file))
+		if os.IsNotExist(err) && f.optional {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Day of the last password change
+	now, reproducible, err := debos.SourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	if !reproducible {
+		now = time.Now()
+	}
+	days := strconv.FormatInt(now.Unix()/86400, 10)
+
+	// The automatic uids must not take the ones given to the following users
+	a.reserved = make(map[int]bool)
+	for _, user := range u.Users {
+		if user.Uid != nil && a.passwd.find(user.Name) == nil {
+			a.reserved[*user.Uid] = true
+		}
+	}
+
+	for _, user := range u.Users {
+		if err := a.setupUser(context, user, days); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range []*accountFile{a.passwd, a.group, a.shadow, a.gshadow} {
+		if err := f.write(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
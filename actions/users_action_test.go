@@ -0,0 +1,17 @@
+package actions
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Known answers from the specification of the SHA-512 based crypt
+func TestSha512Crypt(t *testing.T) {
+	assert.Equal(t,
+		"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		sha512Crypt("Hello world!", "saltstring", 5000))
+	assert.Equal(t,
+		"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+		sha512Crypt("Hello world!", "saltstringsaltstring", 10000))
+}
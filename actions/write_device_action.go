@@ -0,0 +1,168 @@
+/*
+WriteDevice Action
+
+Write an artifact, typically the image created by 'image-partition', to a
+block device such as an SD card or a USB drive, e.g. to flash a board right
+after building its image. The image is written on the host after all other
+actions are done, and synced to the device.
+
+As this overwrites the device, debos must be run with '--allow-device-write'
+for the action to run. Devices with mounted partitions, used as swap or held
+by other devices, e.g. device mapper or RAID, are refused, and so is the disk
+holding the root filesystem of the host.
+
+Yaml syntax:
+ - action: write-device
+   input: image.img
+   device: /dev/sdX
+
+Mandatory properties:
+
+- input -- name of the file to write, relative to the artifact directory.
+
+- device -- path of the block device to write to. It's usually given as a
+template variable, e.g. '{{ .device }}' with '-t device:/dev/sdb', to keep
+the recipe independent of the host.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/go-debos/debos"
+	"github.com/go-debos/fakemachine"
+)
+
+type WriteDeviceAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Input            string
+	Device           string
+}
+
+// blockPartitions returns the partitions of the block device name from sysfs
+func blockPartitions(name string) []string {
+	var partitions []string
+
+	entries, _ := ioutil.ReadDir(path.Join("/sys/class/block", name))
+	for _, e := range entries {
+		if _, err := os.Stat(path.Join("/sys/class/block", name, e.Name(), "partition")); err == nil {
+			partitions = append(partitions, e.Name())
+		}
+	}
+
+	return partitions
+}
+
+// checkDeviceUnused returns an error if the block device or its partitions are in use
+func checkDeviceUnused(device string) error {
+	device, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(device)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		return fmt.Errorf("%s isn't a block device", device)
+	}
+
+	name := path.Base(device)
+
+	// The disk holding the root filesystem of the host
+	var st syscall.Stat_t
+	if err := syscall.Stat("/", &st); err == nil {
+		dev := uint64(st.Dev)
+		major := ((dev >> 8) & 0xfff) | ((dev >> 32) & 0xfffff000)
+		minor := (dev & 0xff) | ((dev >> 12) & 0xffffff00)
+		root, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+		if err == nil && strings.Contains(root+"/", "/"+name+"/") {
+			return fmt.Errorf("Refusing to write to %s which holds the root filesystem", device)
+		}
+	}
+
+	swaps, err := ioutil.ReadFile("/proc/swaps")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, n := range append([]string{name}, blockPartitions(name)...) {
+		dev := path.Join("/dev", n)
+
+		mounted, err := isMounted(dev)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if mounted {
+			return fmt.Errorf("Refusing to write to %s: %s is mounted", device, dev)
+		}
+
+		for _, line := range strings.Split(string(swaps), "\n") {
+			if fields := strings.Fields(line); len(fields) > 0 && fields[0] == dev {
+				return fmt.Errorf("Refusing to write to %s: %s is used as swap", device, dev)
+			}
+		}
+
+		holders, _ := ioutil.ReadDir(path.Join("/sys/class/block", n, "holders"))
+		if len(holders) > 0 {
+			return fmt.Errorf("Refusing to write to %s: %s is used by %s", device, dev, holders[0].Name())
+		}
+	}
+
+	return nil
+}
+
+func (w *WriteDeviceAction) Verify(context *debos.DebosContext) error {
+	if len(w.Input) == 0 {
+		return fmt.Errorf("'input' property can't be empty")
+	}
+	if len(w.Device) == 0 {
+		return fmt.Errorf("'device' property can't be empty")
+	}
+
+	// The device is only written from the host
+	if fakemachine.InMachine() {
+		return nil
+	}
+
+	if !context.AllowDeviceWrite {
+		return fmt.Errorf("Writing to %s requires running debos with --allow-device-write", w.Device)
+	}
+
+	if err := checkDeviceUnused(w.Device); err != nil {
+		return err
+	}
+
+	return debos.CheckBinaries("dd")
+}
+
+func (w *WriteDeviceAction) Summary() string {
+	return fmt.Sprintf("Write %s to %s", w.Input, w.Device)
+}
+
+func (w *WriteDeviceAction) PostMachine(context *debos.DebosContext) error {
+	w.LogStart()
+
+	// Check again as the device might have been mounted in the meantime
+	if err := checkDeviceUnused(w.Device); err != nil {
+		return err
+	}
+
+	input := path.Join(context.Artifactdir, w.Input)
+	debos.Infof("Writing %s to %s\n", input, w.Device)
+
+	err := debos.Command{}.Run("dd", "dd", "if="+input, "of="+w.Device,
+		"bs=4M", "conv=fsync", "status=progress")
+	if err != nil {
+		return err
+	}
+
+	return debos.Command{}.Run("sync", "sync")
+}
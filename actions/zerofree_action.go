@@ -0,0 +1,276 @@
+/*
+Zerofree Action
+
+Zero the free space of the filesystems of the image, so the blocks of deleted
+files don't take space in the compressed image anymore, which can halve its
+size. It's meant to run after the last change to the filesystems of the image,
+i.e. after 'filesystem-deploy' and the actions modifying the deployed root
+filesystem, before the image gets compressed.
+
+Yaml syntax:
+ - action: zerofree
+   partitions:
+     - root
+   method: zerofree
+   fstrim: bool
+
+Optional properties:
+
+- partitions -- names of the partitions or logical volumes of the image to zero,
+all of them by default. Partitions without a supported filesystem are skipped
+unless listed.
+
+- method -- how the free space is zeroed, one of:
+ zerofree -- run zerofree(8), only supported for ext2, ext3 and ext4. The
+ filesystem has to be unmounted or read-only, so a mounted filesystem is
+ remounted read-only while zerofree runs, which fails if files are opened for
+ writing.
+ fill -- fill the free space of the mounted filesystem with a file of zeros,
+ then delete it. Works with any filesystem but writes the whole free space.
+By default zerofree is used for ext filesystems and fill for the other ones.
+
+- fstrim -- if set to `true` fstrim(8) is also run on the mounted filesystems,
+which discards the free blocks, e.g. punching holes in a sparse image file.
+Default 'false'.
+*/
+package actions
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/go-debos/debos"
+)
+
+type ZerofreeAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Partitions       []string
+	Method           string
+	Fstrim           bool
+}
+
+// filesystemMount describes where and how a device is mounted
+type filesystemMount struct {
+	target   string
+	fstype   string
+	readonly bool
+}
+
+// findMount returns the first mount of the device, nil if it isn't mounted
+func findMount(device string) (*filesystemMount, error) {
+	device, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer mounts.Close()
+
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(fields[0]); err != nil || resolved != device {
+			continue
+		}
+		readonly := false
+		for _, option := range strings.Split(fields[3], ",") {
+			if option == "ro" {
+				readonly = true
+			}
+		}
+		return &filesystemMount{fields[1], fields[2], readonly}, nil
+	}
+
+	return nil, scanner.Err()
+}
+
+func isExtFilesystem(fstype string) bool {
+	return fstype == "ext2" || fstype == "ext3" || fstype == "ext4"
+}
+
+func (z *ZerofreeAction) Verify(context *debos.DebosContext) error {
+	switch z.Method {
+	case "", "zerofree", "fill":
+	default:
+		return fmt.Errorf("Unknown zerofree method '%s', either 'zerofree' or 'fill'", z.Method)
+	}
+
+	binaries := []string{"blkid"}
+	if z.Method != "fill" {
+		binaries = append(binaries, "zerofree")
+	}
+	if z.Fstrim {
+		binaries = append(binaries, "fstrim")
+	}
+	return debos.CheckBinaries(binaries...)
+}
+
+func (z *ZerofreeAction) Summary() string {
+	partitions := "all partitions"
+	if len(z.Partitions) > 0 {
+		partitions = strings.Join(z.Partitions, ", ")
+	}
+	return fmt.Sprintf("Zero the free space of %s", partitions)
+}
+
+// fillZeros fills the free space of the filesystem mounted on dir with zeros
+func fillZeros(dir string) error {
+	file := path.Join(dir, ".debos-zerofree")
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file)
+
+	zeros := make([]byte, 1024*1024)
+	for err == nil {
+		_, err = f.Write(zeros)
+	}
+	if !errors.Is(err, syscall.ENOSPC) {
+		f.Close()
+		return err
+	}
+
+	// Make sure the zeros reach the disk before the file gets deleted
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil {
+		return err
+	}
+
+	return debos.SyncFilesystem(dir)
+}
+
+// zerofree runs zerofree on the device, remounting its filesystem read-only if needed
+func (z *ZerofreeAction) zerofree(name, device string, mount *filesystemMount) error {
+	if mount != nil && !mount.readonly {
+		if err := debos.SyncFilesystem(mount.target); err != nil {
+			return err
+		}
+		err := syscall.Mount("", mount.target, "", syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+		if err != nil {
+			return fmt.Errorf("Partition %s must be unmounted or read-only for zerofree: %v", name, err)
+		}
+		defer func() {
+			if err := syscall.Mount("", mount.target, "", syscall.MS_REMOUNT, ""); err != nil {
+				debos.Warnf("Failed to remount %s read-write: %v", mount.target, err)
+			}
+		}()
+	}
+
+	return debos.Command{}.Run("zerofree", "zerofree", "-v", device)
+}
+
+func (z *ZerofreeAction) zeroPartition(p debos.Partition, listed bool) error {
+	mount, err := findMount(p.DevicePath)
+	if err != nil {
+		return err
+	}
+
+	fstype := ""
+	if mount != nil {
+		fstype = mount.fstype
+	} else {
+		out, _ := exec.Command("blkid", "-o", "value", "-s", "TYPE", "-p", "-c", "none", p.DevicePath).Output()
+		fstype = strings.TrimSpace(string(out))
+	}
+
+	method := z.Method
+	if method == "" {
+		switch {
+		case isExtFilesystem(fstype):
+			method = "zerofree"
+		case mount != nil:
+			method = "fill"
+		case listed:
+			return fmt.Errorf("Partition %s must be mounted to zero its free space", p.Name)
+		default:
+			debos.Debugf("Skipping partition %s without mounted filesystem\n", p.Name)
+			return nil
+		}
+	}
+
+	switch method {
+	case "zerofree":
+		if !isExtFilesystem(fstype) {
+			if !listed {
+				debos.Debugf("Skipping partition %s without ext filesystem\n", p.Name)
+				return nil
+			}
+			return fmt.Errorf("zerofree only supports ext2, ext3 and ext4, not '%s' of partition %s", fstype, p.Name)
+		}
+		debos.Infof("Zeroing the free space of %s with zerofree\n", p.Name)
+		err = z.zerofree(p.Name, p.DevicePath, mount)
+	case "fill":
+		if mount == nil {
+			if !listed {
+				debos.Debugf("Skipping unmounted partition %s\n", p.Name)
+				return nil
+			}
+			return fmt.Errorf("Partition %s must be mounted to fill its free space", p.Name)
+		}
+		debos.Infof("Filling the free space of %s with zeros\n", p.Name)
+		err = fillZeros(mount.target)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to zero the free space of %s: %v", p.Name, err)
+	}
+
+	if z.Fstrim && mount != nil {
+		return debos.Command{}.Run("fstrim", "fstrim", "-v", mount.target)
+	}
+
+	return nil
+}
+
+func (z *ZerofreeAction) Run(context *debos.DebosContext) error {
+	z.LogStart()
+
+	if len(context.ImagePartitions) == 0 {
+		return errors.New("No partitions to zero, missing image-partition action?")
+	}
+
+	if len(z.Partitions) == 0 {
+		for _, p := range context.ImagePartitions {
+			if err := z.zeroPartition(p, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, name := range z.Partitions {
+		found := false
+		for _, p := range context.ImagePartitions {
+			if p.Name == name {
+				found = true
+				if err := z.zeroPartition(p, true); err != nil {
+					return err
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("Partition %s not found", name)
+		}
+	}
+
+	return nil
+}
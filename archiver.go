@@ -1,6 +1,7 @@
 package debos
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -70,6 +71,10 @@ func (arc *ArchiveBase) AddOption(key, value interface{}) error {
 
 func (arc *ArchiveBase) Type() ArchiveType { return arc.atype }
 
+/* Options for tar to store and restore the extended attributes of the files,
+ * which hold e.g. file capabilities and SELinux labels */
+var TarXattrsOptions = []string{"--xattrs", "--xattrs-include=*.*"}
+
 // Helper function for unpacking with external tool
 func unpack(command []string, destination string) error {
 	if err := os.MkdirAll(destination, 0755); err != nil {
@@ -85,11 +90,47 @@ func tarOptions(compression string) string {
 		"gz":    "-z",
 		"bzip2": "-j",
 		"xz":    "-J",
+		"zstd":  "--zstd",
 	} // Trying to guess all other supported compression types
 
 	return unpackTarOpts[compression]
 }
 
+// Magic numbers of the compression types supported for tar archives
+var tarCompressionMagic = []struct {
+	compression string
+	magic       []byte
+}{
+	{"gz", []byte{0x1f, 0x8b}},
+	{"bzip2", []byte("BZh")},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+/*
+DetectTarCompression guesses the compression type of a tar archive from its
+first bytes. Returns empty string for uncompressed or unknown archives.
+*/
+func DetectTarCompression(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	header := make([]byte, 6)
+	n, _ := f.Read(header)
+	header = header[:n]
+
+	for _, m := range tarCompressionMagic {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.compression
+		}
+	}
+
+	return ""
+}
+
 func (tar *ArchiveTar) Unpack(destination string) error {
 	command := []string{"tar"}
 	if options, ok := tar.options["taroptions"].([]string); ok {
@@ -99,13 +140,14 @@ func (tar *ArchiveTar) Unpack(destination string) error {
 	}
 	command = append(command, "-C", destination)
 	command = append(command, "-x")
-	command = append(command, "--xattrs")
-	command = append(command, "--xattrs-include=*.*")
+	command = append(command, TarXattrsOptions...)
 
-	if compression, ok := tar.options["tarcompression"]; ok {
-		if unpackTarOpt := tarOptions(compression.(string)); len(unpackTarOpt) > 0 {
-			command = append(command, unpackTarOpt)
-		}
+	compression, ok := tar.options["tarcompression"].(string)
+	if !ok {
+		compression = DetectTarCompression(tar.file)
+	}
+	if unpackTarOpt := tarOptions(compression); len(unpackTarOpt) > 0 {
+		command = append(command, unpackTarOpt)
 	}
 	command = append(command, "-f", tar.file)
 
@@ -4,8 +4,12 @@ import (
 	_ "fmt"
 	"github.com/go-debos/debos"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
 	_ "reflect"
 	_ "strings"
+	"syscall"
 	"testing"
 )
 
@@ -73,6 +77,7 @@ func TestTar_compression(t *testing.T) {
 		"gz":    "tar -C test -x -z -f test.tar.gz",
 		"bzip2": "tar -C test -x -j -f test.tar.gz",
 		"xz":    "tar -C test -x -J -f test.tar.gz",
+		"zstd":  "tar -C test -x --zstd -f test.tar.gz",
 	}
 
 	// Force type
@@ -100,6 +105,33 @@ func TestTar_compression(t *testing.T) {
 	assert.EqualError(t, err, "Wrong type for value")
 }
 
+// Check detection of compression types
+func TestTar_detectCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debos-archiver")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	headers := map[string][]byte{
+		"gz":    {0x1f, 0x8b, 0x08, 0x00},
+		"bzip2": []byte("BZh91AY"),
+		"xz":    {0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00},
+		"zstd":  {0x28, 0xb5, 0x2f, 0xfd, 0x04},
+		"":      []byte("./etc/"),
+	}
+
+	for compression, header := range headers {
+		file := path.Join(dir, "archive-"+compression)
+		assert.Empty(t, ioutil.WriteFile(file, header, 0644))
+		assert.Equal(t, compression, debos.DetectTarCompression(file))
+	}
+
+	// Short and missing files are not compressed
+	file := path.Join(dir, "short")
+	assert.Empty(t, ioutil.WriteFile(file, []byte{0x1f}, 0644))
+	assert.Equal(t, "", debos.DetectTarCompression(file))
+	assert.Equal(t, "", debos.DetectTarCompression(path.Join(dir, "missing")))
+}
+
 func TestDeb(t *testing.T) {
 
 	// Guess Deb
@@ -155,3 +187,42 @@ func TestZip(t *testing.T) {
 	err = archive.RelaxedUnpack("/tmp/test")
 	assert.EqualError(t, err, "exit status 9")
 }
+
+// Check extended attributes, e.g. file capabilities, survive a pack/unpack round trip
+func TestTar_xattrs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debos-archiver")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	src := path.Join(dir, "src")
+	dst := path.Join(dir, "dst")
+	assert.Empty(t, os.Mkdir(src, 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(src, "ping"), []byte("ping"), 0755))
+
+	// cap_net_raw+ep, falling back to a user attribute when not privileged
+	name := "security.capability"
+	value := []byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x20, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	if syscall.Setxattr(path.Join(src, "ping"), name, value, 0) != nil {
+		name = "user.debos"
+		value = []byte("test")
+		if err := syscall.Setxattr(path.Join(src, "ping"), name, value, 0); err != nil {
+			t.Skipf("Extended attributes not supported: %v", err)
+		}
+	}
+
+	// Same options as the pack action
+	archive := path.Join(dir, "rootfs.tar.gz")
+	command := append([]string{"tar", "-c", "-z", "-f", archive}, debos.TarXattrsOptions...)
+	err = debos.Command{}.Run("pack", append(command, "-C", src, ".")...)
+	assert.Empty(t, err)
+
+	a, err := debos.NewArchive(archive)
+	assert.Empty(t, err)
+	assert.Empty(t, a.Unpack(dst))
+
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(path.Join(dst, "ping"), name, buf)
+	assert.Empty(t, err)
+	assert.Equal(t, value, buf[:n])
+}
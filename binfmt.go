@@ -0,0 +1,116 @@
+package debos
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Where the binfmt_misc filesystem configuring the interpreters gets mounted
+const binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+/* Track the binfmt_misc entries registered by debos, which are shared by the
+ * commands running at the same time, e.g. by the actions of a parallel group */
+var binfmt = struct {
+	sync.Mutex
+	users map[string]int
+}{users: make(map[string]int)}
+
+/*
+binfmtRule returns the magic and mask matching the ELF executables of the
+architecture, the same way as the binfmt configuration of qemu does.
+*/
+func (a qemuArch) binfmtRule() ([]byte, []byte) {
+	class, data := byte(1), byte(1)
+	if a.bits64 {
+		class = 2
+	}
+	if a.bigEndian {
+		data = 2
+	}
+
+	// Any OS ABI is accepted
+	magic := []byte{0x7f, 'E', 'L', 'F', class, data, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	mask := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	// The type matches both the executables (2) and shared objects (3)
+	if a.bigEndian {
+		magic = append(magic, 0, 2, byte(a.machine>>8), byte(a.machine))
+		mask = append(mask, 0xff, 0xfe, 0xff, 0xff)
+	} else {
+		magic = append(magic, 2, 0, byte(a.machine), byte(a.machine>>8))
+		mask = append(mask, 0xfe, 0xff, 0xff, 0xff)
+	}
+
+	return magic, mask
+}
+
+// escapeBinfmt escapes all the bytes for the binfmt_misc register file
+func escapeBinfmt(data []byte) string {
+	var out strings.Builder
+	for _, b := range data {
+		fmt.Fprintf(&out, "\\x%02x", b)
+	}
+	return out.String()
+}
+
+// binfmtEnabled tells whether the binfmt_misc entry exists and is enabled
+func binfmtEnabled(name string) bool {
+	f, err := os.Open(path.Join(binfmtDir, name))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	return scanner.Scan() && scanner.Text() == "enabled"
+}
+
+/*
+registerBinfmt registers the qemu binary as the interpreter of the binaries of
+the architecture, unless the host already has a handler for them, returning a
+function to unregister it. The binary is opened right away (the F flag), so it
+is found in chroots as well.
+*/
+func registerBinfmt(arch qemuArch, interpreter string) (func(), error) {
+	if _, err := os.Stat(path.Join(binfmtDir, "register")); os.IsNotExist(err) {
+		if err := syscall.Mount("binfmt_misc", binfmtDir, "binfmt_misc", 0, ""); err != nil {
+			return nil, fmt.Errorf("Failed to mount binfmt_misc: %v", err)
+		}
+	}
+
+	// The name used by the binfmt configuration of qemu
+	if binfmtEnabled("qemu-" + arch.name) {
+		return func() {}, nil
+	}
+
+	binfmt.Lock()
+	defer binfmt.Unlock()
+
+	name := fmt.Sprintf("debos-%d-qemu-%s", os.Getpid(), arch.name)
+	if binfmt.users[name] == 0 {
+		magic, mask := arch.binfmtRule()
+		rule := fmt.Sprintf(":%s:M::%s:%s:%s:F", name, escapeBinfmt(magic), escapeBinfmt(mask), interpreter)
+		if err := ioutil.WriteFile(path.Join(binfmtDir, "register"), []byte(rule), 0644); err != nil {
+			return nil, fmt.Errorf("Failed to register %s with binfmt_misc: %v", interpreter, err)
+		}
+		Debugf("Registered %s as interpreter of the %s binaries\n", interpreter, arch.name)
+	}
+	binfmt.users[name]++
+
+	return func() {
+		binfmt.Lock()
+		defer binfmt.Unlock()
+
+		if binfmt.users[name]--; binfmt.users[name] == 0 {
+			if err := ioutil.WriteFile(path.Join(binfmtDir, name), []byte("-1"), 0644); err != nil {
+				Warnf("Failed to unregister %s from binfmt_misc: %v", interpreter, err)
+			}
+		}
+	}, nil
+}
@@ -0,0 +1,66 @@
+package debos
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinfmtRule(t *testing.T) {
+	// As in the binfmt configuration of qemu
+	magic, mask := qemuArchitectures["arm64"].binfmtRule()
+	assert.Equal(t, `\x7f\x45\x4c\x46\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00`, escapeBinfmt(magic))
+	assert.Equal(t, `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`, escapeBinfmt(mask))
+
+	magic, mask = qemuArchitectures["s390x"].binfmtRule()
+	assert.Equal(t, `\x7f\x45\x4c\x46\x02\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x16`, escapeBinfmt(magic))
+	assert.Equal(t, `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff`, escapeBinfmt(mask))
+}
+
+func TestForeignArchitecture(t *testing.T) {
+	host := HostArchitecture()
+	assert.False(t, ForeignArchitecture(host))
+	if host == "amd64" {
+		assert.False(t, ForeignArchitecture("i386"))
+	}
+
+	foreign := "arm64"
+	if host == foreign {
+		foreign = "amd64"
+	}
+	assert.True(t, ForeignArchitecture(foreign))
+}
+
+func TestRegisterBinfmt(t *testing.T) {
+	arch := qemuArchitectures["sh4"]
+	if binfmtEnabled("qemu-" + arch.name) {
+		t.Skip("sh4 binaries already handled by the host")
+	}
+
+	unregister, err := registerBinfmt(arch, "/bin/echo")
+	if err != nil {
+		t.Skipf("binfmt_misc not usable: %v", err)
+	}
+	name := fmt.Sprintf("debos-%d-qemu-sh4", os.Getpid())
+	assert.True(t, binfmtEnabled(name))
+
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	// The binaries of the architecture are run by the interpreter
+	binary := path.Join(dir, "binary")
+	magic, _ := arch.binfmtRule()
+	assert.Empty(t, ioutil.WriteFile(binary, append(magic, make([]byte, 64)...), 0755))
+	out, err := exec.Command(binary).Output()
+	assert.Empty(t, err)
+	assert.Equal(t, binary+"\n", string(out))
+
+	unregister()
+	assert.False(t, binfmtEnabled(name))
+}
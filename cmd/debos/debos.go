@@ -1,46 +1,367 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/docker/go-units"
 	"github.com/go-debos/debos"
 	"github.com/go-debos/debos/actions"
 	"github.com/go-debos/fakemachine"
 	"github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v2"
 )
 
-func checkError(context *debos.DebosContext, err error, a debos.Action, stage string) int {
+func checkError(context *debos.DebosContext, err error, a debos.Action, stage string) error {
 	if err == nil {
-		return 0
+		return nil
 	}
 
 	context.State = debos.Failed
-	log.Printf("Action `%s` failed at stage %s, error: %s", a, stage, err)
-	debos.DebugShell(*context)
-	return 1
+	err = fmt.Errorf("Action `%s` failed at stage %s, error: %s", a, stage, err)
+	if debos.Interrupted() {
+		return err
+	}
+
+	// Show the failure before dropping into the shell
+	if stage == "Run" && len(context.ShellOnError) > 0 {
+		log.Println(err)
+		debos.RootfsShell(*context)
+	} else if len(context.DebugShell) > 0 {
+		log.Println(err)
+		debos.DebugShell(*context)
+	}
+	return err
 }
 
-func do_run(r actions.Recipe, context *debos.DebosContext) int {
+/* runStage runs a stage of the action at index in the recipe, attributing its
+ * messages to it, recording how long it took and reporting it as events */
+func runStage(t *timings, e *events, index int, a debos.Action, stage string, f func() error) error {
+	debos.SetLogContext(a.String(), stage)
+	e.started(index, a.String(), stage)
+	start := time.Now()
+	err := f()
+	duration := time.Since(start)
+	t.add(a.String(), stage, duration)
+	e.finished(index, a.String(), stage, duration, err)
+	debos.SetLogContext("", "")
+
+	return err
+}
+
+/* checkRecipe verifies all the actions of the recipe, collecting all the
+ * errors rather than stopping at the first one */
+func checkRecipe(context *debos.DebosContext, r actions.Recipe) []error {
+	var errs []error
+
 	for _, a := range r.Actions {
-		err := a.Run(context)
+		debos.SetLogContext(a.String(), "Verify")
+		err := a.Verify(context)
+		debos.SetLogContext("", "")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Action `%s` is invalid: %v", a, err))
+		}
+	}
+
+	return errs
+}
+
+/* Variables are passed to the debos instance running in fakemachine as a
+ * single base64 encoded JSON argument, as its command line is interpreted by a
+ * shell which would otherwise mangle quotes, spaces and the like. */
+func encodeVars(vars map[string]string) (string, error) {
+	data, err := json.Marshal(vars)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func decodeVars(encoded string, vars map[string]string) error {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &vars)
+}
+
+/* readTemplateVarsFile adds the template variables of a YAML or JSON file not
+ * already set in vars. The values keep their type by being converted to the
+ * typed form of the command line, e.g. 'int=4', strings starting with such a
+ * prefix being passed as 'string=' so they are left unchanged */
+func readTemplateVarsFile(file string, vars map[string]string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	// JSON is a subset of YAML
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("Invalid template variables file %s: %v", file, err)
+	}
+
+	for k, v := range values {
+		if _, found := vars[k]; found {
+			continue
+		}
+
+		switch value := v.(type) {
+		case nil:
+			vars[k] = ""
+		case string:
+			vars[k] = value
+			for _, prefix := range []string{"int=", "float=", "bool=", "string="} {
+				if strings.HasPrefix(value, prefix) {
+					vars[k] = "string=" + value
+				}
+			}
+		case int, int64, uint64:
+			vars[k] = fmt.Sprintf("int=%d", value)
+		case float64:
+			vars[k] = "float=" + strconv.FormatFloat(value, 'g', -1, 64)
+		case bool:
+			vars[k] = fmt.Sprintf("bool=%t", value)
+		default:
+			return fmt.Errorf("Template variable %s of %s must be a string, a number or a boolean", k, file)
+		}
+	}
+
+	return nil
+}
+
+/* filterActions keeps the actions having one of the only labels if any, then
+ * drops the ones having one of the skip labels. Labels are comma separated */
+func filterActions(list []actions.YamlAction, only, skip []string) []actions.YamlAction {
+	split := func(labels []string) map[string]bool {
+		set := make(map[string]bool)
+		for _, l := range labels {
+			for _, label := range strings.Split(l, ",") {
+				if label = strings.TrimSpace(label); label != "" {
+					set[label] = true
+				}
+			}
+		}
+		return set
+	}
+	onlySet := split(only)
+	skipSet := split(skip)
+
+	var filtered []actions.YamlAction
+	for _, a := range list {
+		if len(onlySet) > 0 && !onlySet[a.Label()] {
+			continue
+		}
+		if skipSet[a.Label()] {
+			continue
+		}
+		filtered = append(filtered, a)
+	}
 
-		// This does not stop the call of stacked Cleanup methods for other Actions
-		// Stack Cleanup methods
-		defer a.Cleanup(context)
+	return filtered
+}
+
+/* cleanupActions calls cleanup for the actions in reverse order, commands
+ * being allowed to run even once interrupted so the actions can tear down what
+ * they set up */
+func cleanupActions(list []actions.YamlAction, cleanup func(a actions.YamlAction) error) {
+	defer debos.StartCleanup()()
+
+	for i := len(list) - 1; i >= 0; i-- {
+		cleanup(list[i])
+	}
+}
+
+func do_run(r actions.Recipe, context *debos.DebosContext, t *timings, e *events) error {
+	// The actions whose Run started get cleaned up, even if another one fails
+	var started []actions.YamlAction
+	defer func() {
+		cleanupActions(started, func(a actions.YamlAction) error {
+			return a.Cleanup(context)
+		})
+	}()
+
+	for i, a := range r.Actions {
+		err := runStage(t, e, i, a, "Run", func() error {
+			return a.Run(context)
+		})
+
+		// Do not start any further action once interrupted
+		if err == nil && debos.Interrupted() {
+			err = errors.New("Interrupted")
+		}
+
+		started = append(started, a)
 
 		// Check the state of Run method
-		if exitcode := checkError(context, err, a, "Run"); exitcode != 0 {
-			return exitcode
+		if err = checkError(context, err, a, "Run"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+runRecipe executes all the stages of the recipe and returns the first error
+encountered instead of terminating the process.
+
+If m is not nil the Run stage is executed inside the fake machine, args being
+the command line passed to the debos instance running inside of it. Otherwise
+the stages are run directly on the host (or in the current fake machine).
+
+The duration of the stages is recorded in t when it is not nil.
+*/
+func runRecipe(context *debos.DebosContext, r actions.Recipe, m *fakemachine.Machine, args []string, t *timings, e *events) error {
+	for i, a := range r.Actions {
+		err := runStage(t, e, i, a, "Verify", func() error {
+			return a.Verify(context)
+		})
+		if err = checkError(context, err, a, "Verify"); err != nil {
+			return err
+		}
+	}
+
+	if context.DryRun {
+		for _, a := range r.Actions {
+			log.Printf("==== %s ====\n", a)
+			if summary := a.Summary(); summary != "" {
+				log.Printf("%s\n", summary)
+			}
+		}
+		log.Printf("==== Recipe done (Dry run) ====")
+		return nil
+	}
+
+	if m == nil && !fakemachine.InMachine() {
+		// Release the loop devices the actions failed to, once they are all cleaned up
+		defer debos.DetachLoopDevices(context)
+	}
+
+	// The actions whose Pre*Machine stage started get cleaned up on the host
+	var prepared []actions.YamlAction
+	defer func() {
+		cleanupActions(prepared, func(a actions.YamlAction) error {
+			return a.PostMachineCleanup(context)
+		})
+	}()
+
+	if m != nil {
+		for i, a := range r.Actions {
+			prepared = append(prepared, a)
+
+			err := runStage(t, e, i, a, "PreMachine", func() error {
+				return a.PreMachine(context, m, &args)
+			})
+			if err = checkError(context, err, a, "PreMachine"); err != nil {
+				return err
+			}
+		}
+
+		start := time.Now()
+		exitcode, err := m.RunInMachineWithArgs(args)
+		t.add("fakemachine", "Run", time.Since(start))
+		if err != nil {
+			context.State = debos.Failed
+			return err
+		}
+
+		if exitcode != 0 {
+			context.State = debos.Failed
+			return fmt.Errorf("Recipe failed inside fakemachine with exit code %d", exitcode)
+		}
+
+		for i, a := range r.Actions {
+			err = runStage(t, e, i, a, "PostMachine", func() error {
+				return a.PostMachine(context)
+			})
+			if err = checkError(context, err, a, "Postmachine"); err != nil {
+				return err
+			}
+		}
+
+		log.Printf("==== Recipe done ====")
+		return nil
+	}
+
+	if !fakemachine.InMachine() {
+		for i, a := range r.Actions {
+			prepared = append(prepared, a)
+
+			err := runStage(t, e, i, a, "PreNoMachine", func() error {
+				return a.PreNoMachine(context)
+			})
+			if err = checkError(context, err, a, "PreNoMachine"); err != nil {
+				return err
+			}
 		}
 	}
 
-	return 0
+	// Create Rootdir
+	if _, err := os.Stat(context.Rootdir); os.IsNotExist(err) {
+		err = os.Mkdir(context.Rootdir, 0755)
+		if err != nil && os.IsNotExist(err) {
+			context.State = debos.Failed
+			return err
+		}
+	}
+
+	if err := do_run(r, context, t, e); err != nil {
+		return err
+	}
+
+	if !fakemachine.InMachine() {
+		for i, a := range r.Actions {
+			err := runStage(t, e, i, a, "PostMachine", func() error {
+				return a.PostMachine(context)
+			})
+			if err = checkError(context, err, a, "PostMachine"); err != nil {
+				return err
+			}
+		}
+		log.Printf("==== Recipe done ====")
+	}
+
+	return nil
+}
+
+/* checkScratchdir makes sure the scratch space can be created in dir, before
+ * running out of space or permissions in the middle of the build */
+func checkScratchdir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	tmp, err := ioutil.TempDir(dir, ".debos-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", dir, err)
+	}
+	return os.Remove(tmp)
+}
+
+// freeSpace returns the space available to unprivileged users in dir
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
 }
 
 func warnLocalhost(variable string, value string) {
@@ -57,23 +378,47 @@ func warnLocalhost(variable string, value string) {
 
 
 func main() {
-	context := debos.DebosContext { &debos.CommonContext{}, "", "" }
 	var options struct {
 		Backend       string            `short:"b" long:"fakemachine-backend" description:"Fakemachine backend to use" default:"auto"`
 		ArtifactDir   string            `long:"artifactdir" description:"Directory for packed archives and ostree repositories (default: current directory)"`
 		InternalImage string            `long:"internal-image" hidden:"true"`
+		InternalTemplateVars string     `long:"internal-template-vars" hidden:"true"`
+		InternalEnvironVars string      `long:"internal-environ-vars" hidden:"true"`
 		TemplateVars  map[string]string `short:"t" long:"template-var" description:"Template variables (use -t VARIABLE:VALUE syntax)"`
+		TemplateVarsFiles []string      `long:"template-vars-file" description:"YAML or JSON file mapping template variables to their values, overridden by the following files and -t"`
 		DebugShell    bool              `long:"debug-shell" description:"Fall into interactive shell on error"`
+		ShellOnError  bool              `long:"shell-on-error" description:"Fall into interactive shell in the rootfs when an action fails to run"`
+		KeepScratch   bool              `long:"keep-scratch" description:"Keep the scratch directory when the build fails (implied by --shell-on-error)"`
 		Shell         string            `short:"s" long:"shell" description:"Redefine interactive shell binary (default: bash)" optionsl:"" default:"/bin/bash"`
 		ScratchSize   string            `long:"scratchsize" description:"Size of disk backed scratch space"`
-		CPUs          int               `short:"c" long:"cpus" description:"Number of CPUs to use for build VM (default: 2)"`
+		ScratchDir    string            `long:"scratchdir" description:"Directory for the scratch space (default: $DEBOS_TMP, $TMPDIR or the current directory)"`
+		CPUs          int               `short:"c" long:"cpus" description:"Number of CPUs to use for build VM" default:"2"`
 		Memory        string            `short:"m" long:"memory" description:"Amount of memory for build VM (default: 2048MB)"`
 		ShowBoot      bool              `long:"show-boot" description:"Show boot/console messages from the fake machine"`
 		EnvironVars   map[string]string `short:"e" long:"environ-var" description:"Environment variables (use -e VARIABLE:VALUE syntax)"`
 		Verbose       bool              `short:"v" long:"verbose" description:"Verbose output"`
+		Quiet         bool              `short:"q" long:"quiet" description:"Only log warnings and errors, without progress"`
+		NoProgress    bool              `long:"no-progress" description:"Do not show the progress of long copies and downloads"`
+		LogLevel      string            `long:"log-level" description:"Minimum level of the messages to log" choice:"debug" choice:"info" choice:"warn" choice:"error" default:"info"`
+		NoTimestamps  bool              `long:"no-timestamps" description:"Do not prefix the messages with timestamps"`
+		Timing        bool              `long:"timing" description:"Report how long each action took"`
+		TimingJSON    string            `long:"timing-json" description:"Write how long each action took to the given JSON file, by recipe"`
+		EventsJSON    string            `long:"events-json" description:"Write the start and end of the stages of the actions as JSON lines to the given file, - for the standard output"`
 		PrintRecipe   bool              `long:"print-recipe" description:"Print final recipe"`
 		DryRun        bool              `long:"dry-run" description:"Compose final recipe to build but without any real work started"`
+		Check         bool              `long:"check" description:"Only check the recipe is valid, without running it"`
 		DisableFakeMachine bool         `long:"disable-fakemachine" description:"Do not use fakemachine."`
+		ForceFakeMachine bool           `long:"fakemachine" description:"Fail rather than running on the host if fakemachine can't be used"`
+		Only          []string          `long:"only" description:"Only run the actions with the given labels (comma separated)"`
+		Skip          []string          `long:"skip" description:"Skip the actions with the given labels (comma separated)"`
+		Volumes       []string          `long:"volume" description:"Host directory to make available in the build VM (use --volume HOSTPATH[:GUESTPATH] syntax)"`
+		AptCache      string            `long:"apt-cache" description:"Directory to cache the packages downloaded by apt across builds"`
+		AllowDeviceWrite bool           `long:"allow-device-write" description:"Allow the write-device action to overwrite block devices"`
+		StrictTemplates bool            `long:"strict-templates" description:"Fail on references to undefined template variables"`
+		FileManifest  string            `long:"file-manifest" description:"Record the files placed in the image by the actions to the given JSON lines file, relative to the artifact directory"`
+		KeepGoing     bool              `long:"keep-going" description:"Build the following recipes when one fails"`
+		CopyJobs      int               `long:"copy-jobs" description:"Number of files copied concurrently by the overlays (default: 1)"`
+		Version       bool              `long:"version" description:"Print the version of debos"`
 	}
 
 	// These are the environment variables that will be detected on the
@@ -86,6 +431,7 @@ func main() {
 		"rsync_proxy",
 		"all_proxy",
 		"no_proxy",
+		"source_date_epoch",
 	}
 
 	var exitcode int = 0
@@ -94,6 +440,18 @@ func main() {
 		os.Exit(exitcode)
 	}()
 
+	/* On SIGINT/SIGTERM stop the running commands rather than exiting right
+	 * away, so the failing action unwinds through the Cleanup stages and the
+	 * deferred removal of the scratchdir. */
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received signal %s, cleaning up. Repeat to terminate immediately", sig)
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		debos.Interrupt(sig)
+	}()
+
 	parser := flags.NewParser(&options, flags.Default)
 	fakemachineBackends := parser.FindOptionByLongName("fakemachine-backend")
 	fakemachineBackends.Choices = fakemachine.BackendNames()
@@ -109,267 +467,511 @@ func main() {
 		}
 	}
 
-	if len(args) != 1 {
+	if options.Version {
+		fmt.Printf("debos %s\n", debos.Version)
+		return
+	}
+
+	if len(args) == 0 {
 		log.Println("No recipe given!")
 		exitcode = 1
 		return
 	}
 
-	if options.DisableFakeMachine && options.Backend != "auto" {
-		log.Println("--disable-fakemachine and --fakemachine-backend are mutually exclusive")
+	if len(args) > 1 && fakemachine.InMachine() {
+		log.Println("Only one recipe can be built in fakemachine")
 		exitcode = 1
 		return
 	}
 
-	// Set interactive shell binary only if '--debug-shell' options passed
-	if options.DebugShell {
-		context.DebugShell = options.Shell
+	// The -t variables take precedence, then the last files given
+	for i := len(options.TemplateVarsFiles) - 1; i >= 0; i-- {
+		if options.TemplateVars == nil {
+			options.TemplateVars = make(map[string]string)
+		}
+		if err := readTemplateVarsFile(options.TemplateVarsFiles[i], options.TemplateVars); err != nil {
+			log.Printf("Couldn't read template variables: %v", err)
+			exitcode = 1
+			return
+		}
 	}
 
-	if options.PrintRecipe {
-		context.PrintRecipe = options.PrintRecipe
+	if options.InternalTemplateVars != "" {
+		if options.TemplateVars == nil {
+			options.TemplateVars = make(map[string]string)
+		}
+		if err := decodeVars(options.InternalTemplateVars, options.TemplateVars); err != nil {
+			log.Printf("Couldn't decode template variables: %v", err)
+			exitcode = 1
+			return
+		}
 	}
 
-	if options.Verbose {
-		context.Verbose = options.Verbose
+	if options.InternalEnvironVars != "" {
+		if options.EnvironVars == nil {
+			options.EnvironVars = make(map[string]string)
+		}
+		if err := decodeVars(options.InternalEnvironVars, options.EnvironVars); err != nil {
+			log.Printf("Couldn't decode environment variables: %v", err)
+			exitcode = 1
+			return
+		}
 	}
 
-	file := args[0]
-	file = debos.CleanPath(file)
-
-	r := actions.Recipe{}
-	if _, err := os.Stat(file); os.IsNotExist(err) {
-		log.Println(err)
+	if options.DisableFakeMachine && options.Backend != "auto" {
+		log.Println("--disable-fakemachine and --fakemachine-backend are mutually exclusive")
 		exitcode = 1
 		return
 	}
-	if err := r.Parse(file, options.PrintRecipe, options.Verbose, options.TemplateVars); err != nil {
-		log.Println(err)
+
+	if options.DisableFakeMachine && options.ForceFakeMachine {
+		log.Println("--disable-fakemachine and --fakemachine are mutually exclusive")
 		exitcode = 1
 		return
 	}
 
-	/* If fakemachine is used the outer fake machine will never use the
-	 * scratchdir, so just set it to /scratch as a dummy to prevent the
-	 * outer debos creating a temporary directory */
-	context.Scratchdir = "/scratch"
-
-	var runInFakeMachine = true
-	var m *fakemachine.Machine
-	if options.DisableFakeMachine || fakemachine.InMachine() {
-		runInFakeMachine = false
-	} else {
-		// attempt to create a fakemachine
-		m, err = fakemachine.NewMachineWithBackend(options.Backend)
-		if err != nil {
-			log.Printf("error creating fakemachine: %v", err)
+	if options.CPUs < 1 {
+		log.Println("--cpus must be a positive number")
+		exitcode = 1
+		return
+	}
 
-			/* fallback to running on the host unless the user has chosen
-			 * a specific backend */
-			if options.Backend == "auto" {
-				runInFakeMachine = false
-			} else {
-				exitcode = 1
-				return
-			}
+	volumes := make(map[string]string)
+	for _, v := range options.Volumes {
+		hostpath, guestpath := v, v
+		if i := strings.Index(v, ":"); i >= 0 {
+			hostpath, guestpath = v[:i], v[i+1:]
 		}
+		if !path.IsAbs(guestpath) {
+			log.Printf("Volume path in the build VM must be absolute: %s", guestpath)
+			exitcode = 1
+			return
+		}
+		if _, err := os.Stat(hostpath); err != nil {
+			log.Printf("Invalid volume: %v", err)
+			exitcode = 1
+			return
+		}
+		volumes[debos.CleanPath(hostpath)] = path.Clean(guestpath)
 	}
 
-	// if running on the host create a scratchdir
-	if !runInFakeMachine && !fakemachine.InMachine() {
-		log.Printf("fakemachine not supported, running on the host!")
-		cwd, _ := os.Getwd()
-		context.Scratchdir, err = ioutil.TempDir(cwd, ".debos-")
-		defer os.RemoveAll(context.Scratchdir)
+	if options.Verbose {
+		options.LogLevel = "debug"
+	} else if options.Quiet {
+		options.LogLevel = "warn"
 	}
 
-	context.Rootdir = path.Join(context.Scratchdir, "root")
-	context.Image = options.InternalImage
-	context.RecipeDir = path.Dir(file)
-
-	context.Artifactdir = options.ArtifactDir
-	if context.Artifactdir == "" {
-		context.Artifactdir, _ = os.Getwd()
+	level, err := debos.ParseLogLevel(options.LogLevel)
+	if err != nil {
+		log.Println(err)
+		exitcode = 1
+		return
 	}
-	context.Artifactdir = debos.CleanPath(context.Artifactdir)
-
-	// Initialise origins map
-	context.Origins = make(map[string]string)
-	context.Origins["artifacts"] = context.Artifactdir
-	context.Origins["filesystem"] = context.Rootdir
-	context.Origins["recipe"] = context.RecipeDir
-
-	context.Architecture = r.Architecture
-
-	context.State = debos.Success
+	debos.SetLogLevel(level)
+	debos.SetLogTimestamps(!options.NoTimestamps)
+	// The progress goes along with the info messages, on a terminal only
+	progress := !options.NoProgress && level <= debos.LogInfo && debos.IsTerminal(os.Stderr)
+	debos.SetProgress(progress)
+	debos.SetCopyJobs(options.CopyJobs)
+
+	artifactdir := options.ArtifactDir
+	if artifactdir == "" {
+		artifactdir, _ = os.Getwd()
+	}
+	artifactdir = debos.CleanPath(artifactdir)
 
-	// Initialize environment variables map
-	context.EnvironVars = make(map[string]string)
+	var aptCacheDir string
+	if options.AptCache != "" {
+		aptCacheDir = debos.CleanPath(options.AptCache)
+		if err := os.MkdirAll(aptCacheDir, 0755); err != nil {
+			log.Printf("Invalid apt cache: %v", err)
+			exitcode = 1
+			return
+		}
+	}
 
-	// First add variables from host
-	for _, e := range environ_vars {
-		lowerVar := strings.ToLower(e) // lowercase not really needed
-		lowerVal := os.Getenv(lowerVar)
-		if lowerVal != "" {
-			context.EnvironVars[lowerVar] = lowerVal
+	scratchdir := options.ScratchDir
+	if scratchdir == "" {
+		scratchdir = os.Getenv("DEBOS_TMP")
+	}
+	if scratchdir == "" {
+		scratchdir = os.Getenv("TMPDIR")
+	}
+	if scratchdir != "" && !fakemachine.InMachine() {
+		scratchdir = debos.CleanPath(scratchdir)
+		if err := checkScratchdir(scratchdir); err != nil {
+			log.Printf("Invalid scratch directory: %v", err)
+			exitcode = 1
+			return
 		}
+	}
 
-		upperVar := strings.ToUpper(e)
-		upperVal := os.Getenv(upperVar)
-		if upperVal != "" {
-			context.EnvironVars[upperVar] = upperVal
+	if options.FileManifest != "" {
+		manifest := debos.CleanPathAt(options.FileManifest, artifactdir)
+		truncate := !fakemachine.InMachine() && !options.Check && !options.DryRun
+		if err := debos.SetFileManifest(manifest, truncate); err != nil {
+			log.Printf("Invalid file manifest: %v", err)
+			exitcode = 1
+			return
 		}
+		options.FileManifest = manifest
 	}
 
-	// Then add/overwrite with variables from command line
-	for k, v := range options.EnvironVars {
-		// Allows the user to unset environ variables with -e
-		if v == "" {
-			delete(context.EnvironVars, k)
-		} else {
-			context.EnvironVars[k] = v
+	if options.TimingJSON != "" {
+		options.TimingJSON = debos.CleanPath(options.TimingJSON)
+		// The recipes add their timings to the file as they get built
+		if !fakemachine.InMachine() && !options.Check && !options.DryRun {
+			if err := os.Remove(options.TimingJSON); err != nil && !os.IsNotExist(err) {
+				log.Printf("Invalid timings file: %v", err)
+				exitcode = 1
+				return
+			}
 		}
 	}
 
-	for _, a := range r.Actions {
-		err = a.Verify(&context)
-		if exitcode = checkError(&context, err, a, "Verify"); exitcode != 0 {
+	var e *events
+	if options.EventsJSON != "" && !options.Check && !options.DryRun {
+		if options.EventsJSON != "-" {
+			options.EventsJSON = debos.CleanPath(options.EventsJSON)
+		}
+		var closer io.Closer
+		e, closer, err = openEvents(options.EventsJSON, !fakemachine.InMachine())
+		if err != nil {
+			log.Printf("Invalid events file: %v", err)
+			exitcode = 1
 			return
 		}
+		defer closer.Close()
 	}
 
-	if options.DryRun {
-		log.Printf("==== Recipe done (Dry run) ====")
-		return
-	}
+	/* Recipes are built one after the other, each with its own scratchdir,
+	 * sharing the artifact directory */
+	build := func(file string) {
+		file = debos.CleanPath(file)
+		context := debos.DebosContext{&debos.CommonContext{}, "", ""}
 
-	if runInFakeMachine {
-		var args []string
+		// Set interactive shell binary only if '--debug-shell' options passed
+		if options.DebugShell {
+			context.DebugShell = options.Shell
+		}
+		if options.ShellOnError {
+			context.ShellOnError = options.Shell
+		}
+		context.PrintRecipe = options.PrintRecipe
+		context.Verbose = options.Verbose
 
-		if options.Memory == "" {
-			// Set default memory size for fakemachine
-			options.Memory = "2Gb"
+		r := actions.Recipe{StrictTemplates: options.StrictTemplates}
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			log.Println(err)
+			exitcode = 1
+			return
 		}
-		memsize, err := units.RAMInBytes(options.Memory)
-		if err != nil {
-			fmt.Printf("Couldn't parse memory size: %v\n", err)
+		if err := r.Parse(file, options.PrintRecipe, options.Verbose, options.TemplateVars); err != nil {
+			log.Println(err)
 			exitcode = 1
 			return
 		}
-		m.SetMemory(int(memsize / 1024 / 1024))
 
-		if options.CPUs == 0 {
-			// Set default CPU count for fakemachine
-			options.CPUs = 2
+		if len(options.Only) > 0 || len(options.Skip) > 0 {
+			r.Actions = filterActions(r.Actions, options.Only, options.Skip)
+			if len(r.Actions) == 0 {
+				log.Println("No action left to run after applying --only and --skip")
+				exitcode = 1
+				return
+			}
 		}
-		m.SetNumCPUs(options.CPUs)
 
-		if options.ScratchSize != "" {
-			size, err := units.FromHumanSize(options.ScratchSize)
+		/* If fakemachine is used the outer fake machine will never use the
+		 * scratchdir, so just set it to /scratch as a dummy to prevent the
+		 * outer debos creating a temporary directory */
+		context.Scratchdir = "/scratch"
+
+		var runInFakeMachine = true
+		var m *fakemachine.Machine
+		if options.DisableFakeMachine || options.Check || fakemachine.InMachine() {
+			runInFakeMachine = false
+		} else {
+			// attempt to create a fakemachine
+			m, err = fakemachine.NewMachineWithBackend(options.Backend)
 			if err != nil {
-				fmt.Printf("Couldn't parse scratch size: %v\n", err)
+				log.Printf("error creating fakemachine: %v", err)
+
+				/* fallback to running on the host unless the user has chosen
+				 * a specific backend or asked for fakemachine explicitly */
+				if options.Backend == "auto" && !options.ForceFakeMachine {
+					runInFakeMachine = false
+				} else {
+					exitcode = 1
+					return
+				}
+			}
+		}
+
+		// if running on the host create a scratchdir
+		if !runInFakeMachine && !options.Check && !fakemachine.InMachine() {
+			log.Printf("fakemachine not supported, running on the host!")
+			dir := scratchdir
+			if dir == "" {
+				dir, _ = os.Getwd()
+			}
+			context.Scratchdir, err = ioutil.TempDir(dir, ".debos-")
+			if err != nil {
+				log.Printf("Couldn't create the scratch directory: %v", err)
 				exitcode = 1
 				return
 			}
-			m.SetScratch(size, "")
+			defer func() {
+				// Leave the half-built rootfs around for inspection
+				if context.State == debos.Failed && (options.KeepScratch || options.ShellOnError) {
+					log.Printf("Keeping the scratch directory %s", context.Scratchdir)
+					return
+				}
+				os.RemoveAll(context.Scratchdir)
+			}()
 		}
 
-		m.SetShowBoot(options.ShowBoot)
+		context.Rootdir = path.Join(context.Scratchdir, "root")
+		context.Image = options.InternalImage
+		context.RecipeDir = path.Dir(file)
 
-		// Puts in a format that is compatible with output of os.Environ()
-		if context.EnvironVars != nil {
-			EnvironString := []string{}
-			for k, v := range context.EnvironVars {
-				warnLocalhost(k, v)
-				EnvironString = append(EnvironString, fmt.Sprintf("%s=%s", k, v))
-			}
-			m.SetEnviron(EnvironString) // And save the resulting environ vars on m
-		}
+		context.Artifactdir = artifactdir
+		context.AptCacheDir = aptCacheDir
+		context.AllowDeviceWrite = options.AllowDeviceWrite
+		context.StrictTemplates = options.StrictTemplates
 
-		m.AddVolume(context.Artifactdir)
-		args = append(args, "--artifactdir", context.Artifactdir)
+		// Initialise origins map
+		context.Origins = make(map[string]string)
+		context.Origins["artifacts"] = context.Artifactdir
+		context.Origins["filesystem"] = context.Rootdir
+		context.Origins["recipe"] = context.RecipeDir
 
-		for k, v := range options.TemplateVars {
-			args = append(args, "--template-var", fmt.Sprintf("%s:\"%s\"", k, v))
-		}
+		context.Architecture = r.Architecture
 
-		for k, v := range options.EnvironVars {
-			args = append(args, "--environ-var", fmt.Sprintf("%s:\"%s\"", k, v))
-		}
+		context.State = debos.Success
 
-		m.AddVolume(context.RecipeDir)
-		args = append(args, file)
+		// Initialize environment variables map
+		context.EnvironVars = make(map[string]string)
 
-		if options.DebugShell {
-			args = append(args, "--debug-shell")
-			args = append(args, "--shell", fmt.Sprintf("%s", options.Shell))
-		}
+		// First add variables from host
+		for _, e := range environ_vars {
+			lowerVar := strings.ToLower(e) // lowercase not really needed
+			lowerVal := os.Getenv(lowerVar)
+			if lowerVal != "" {
+				context.EnvironVars[lowerVar] = lowerVal
+			}
 
-		for _, a := range r.Actions {
-			// Stack PostMachineCleanup methods
-			defer a.PostMachineCleanup(&context)
+			upperVar := strings.ToUpper(e)
+			upperVal := os.Getenv(upperVar)
+			if upperVal != "" {
+				context.EnvironVars[upperVar] = upperVal
+			}
+		}
 
-			err = a.PreMachine(&context, m, &args)
-			if exitcode = checkError(&context, err, a, "PreMachine"); exitcode != 0 {
-				return
+		// Then add/overwrite with variables from command line
+		for k, v := range options.EnvironVars {
+			// Allows the user to unset environ variables with -e
+			if v == "" {
+				delete(context.EnvironVars, k)
+			} else {
+				context.EnvironVars[k] = v
 			}
 		}
 
-		exitcode, err = m.RunInMachineWithArgs(args)
-		if err != nil {
-			fmt.Println(err)
-			return
+		if options.DryRun {
+			context.DryRun = options.DryRun
 		}
 
-		if exitcode != 0 {
-			context.State = debos.Failed
+		if options.Check {
+			errs := checkRecipe(&context, r)
+			for _, err := range errs {
+				log.Println(err)
+			}
+			if len(errs) > 0 {
+				log.Printf("==== Recipe invalid: %d error(s) ====", len(errs))
+				exitcode = 1
+				return
+			}
+			log.Printf("==== Recipe valid ====")
 			return
 		}
 
-		for _, a := range r.Actions {
-			err = a.PostMachine(&context)
-			if exitcode = checkError(&context, err, a, "Postmachine"); exitcode != 0 {
+		var machineArgs []string
+		if runInFakeMachine {
+			if options.Memory == "" {
+				// Set default memory size for fakemachine
+				options.Memory = "2Gb"
+			}
+			memsize, err := units.RAMInBytes(options.Memory)
+			if err != nil {
+				fmt.Printf("Couldn't parse memory size: %v\n", err)
+				exitcode = 1
+				return
+			}
+			if memsize < 1024*1024 {
+				fmt.Printf("Memory size must be at least 1MB: %s\n", options.Memory)
+				exitcode = 1
 				return
 			}
+			m.SetMemory(int(memsize / 1024 / 1024))
+
+			m.SetNumCPUs(options.CPUs)
+
+			if options.ScratchSize != "" {
+				size, err := units.FromHumanSize(options.ScratchSize)
+				if err != nil {
+					fmt.Printf("Couldn't parse scratch size: %v\n", err)
+					exitcode = 1
+					return
+				}
+				m.SetScratch(size, scratchdir)
+			} else if scratchdir != "" {
+				/* The scratch space is in memory unless given a size, so
+				 * use the space left in the directory for the sparse disk */
+				size, err := freeSpace(scratchdir)
+				if err != nil {
+					log.Printf("Couldn't get the free space of %s: %v", scratchdir, err)
+					exitcode = 1
+					return
+				}
+				debos.Debugf("Using a scratch disk of %s in %s\n", units.BytesSize(float64(size)), scratchdir)
+				m.SetScratch(size, scratchdir)
+			}
+
+			m.SetShowBoot(options.ShowBoot)
+
+			// Puts in a format that is compatible with output of os.Environ()
+			if context.EnvironVars != nil {
+				EnvironString := []string{}
+				for k, v := range context.EnvironVars {
+					warnLocalhost(k, v)
+					EnvironString = append(EnvironString, fmt.Sprintf("%s=%s", k, v))
+				}
+				m.SetEnviron(EnvironString) // And save the resulting environ vars on m
+			}
+
+			m.AddVolume(context.Artifactdir)
+			machineArgs = append(machineArgs, "--artifactdir", context.Artifactdir)
+
+			if len(options.TemplateVars) > 0 {
+				vars, err := encodeVars(options.TemplateVars)
+				if err != nil {
+					log.Printf("Couldn't encode template variables: %v", err)
+					exitcode = 1
+					return
+				}
+				machineArgs = append(machineArgs, "--internal-template-vars", vars)
+			}
+
+			if len(options.EnvironVars) > 0 {
+				vars, err := encodeVars(options.EnvironVars)
+				if err != nil {
+					log.Printf("Couldn't encode environment variables: %v", err)
+					exitcode = 1
+					return
+				}
+				machineArgs = append(machineArgs, "--internal-environ-vars", vars)
+			}
+
+			m.AddVolume(context.RecipeDir)
+			machineArgs = append(machineArgs, file)
+
+			machineArgs = append(machineArgs, "--log-level", options.LogLevel)
+			if options.Timing {
+				machineArgs = append(machineArgs, "--timing")
+			}
+			if options.TimingJSON != "" {
+				m.AddVolume(path.Dir(options.TimingJSON))
+				machineArgs = append(machineArgs, "--timing-json", options.TimingJSON)
+			}
+			if options.NoTimestamps {
+				machineArgs = append(machineArgs, "--no-timestamps")
+			}
+			if !progress {
+				machineArgs = append(machineArgs, "--no-progress")
+			}
+			if context.AptCacheDir != "" {
+				m.AddVolume(context.AptCacheDir)
+				machineArgs = append(machineArgs, "--apt-cache", context.AptCacheDir)
+			}
+			if options.FileManifest != "" {
+				m.AddVolume(path.Dir(options.FileManifest))
+				machineArgs = append(machineArgs, "--file-manifest", options.FileManifest)
+			}
+			if options.EventsJSON != "" {
+				if options.EventsJSON != "-" {
+					m.AddVolume(path.Dir(options.EventsJSON))
+				}
+				machineArgs = append(machineArgs, "--events-json", options.EventsJSON)
+			}
+			if options.StrictTemplates {
+				machineArgs = append(machineArgs, "--strict-templates")
+			}
+			if options.CopyJobs > 1 {
+				machineArgs = append(machineArgs, "--copy-jobs", strconv.Itoa(options.CopyJobs))
+			}
+			for _, only := range options.Only {
+				machineArgs = append(machineArgs, "--only", only)
+			}
+			for _, skip := range options.Skip {
+				machineArgs = append(machineArgs, "--skip", skip)
+			}
+
+			for hostpath, guestpath := range volumes {
+				m.AddVolumeAt(hostpath, guestpath)
+			}
+
+			if options.DebugShell {
+				machineArgs = append(machineArgs, "--debug-shell")
+			}
+			if options.ShellOnError {
+				machineArgs = append(machineArgs, "--shell-on-error")
+			}
+			if options.DebugShell || options.ShellOnError {
+				machineArgs = append(machineArgs, "--shell", fmt.Sprintf("%s", options.Shell))
+			}
+			if options.KeepScratch {
+				log.Printf("Warning: the scratch directory of fakemachine can't be kept, use --disable-fakemachine")
+			}
+		} else {
+			m = nil
+
+			// Volumes are only remapped by fakemachine
+			for hostpath, guestpath := range volumes {
+				if hostpath != guestpath && !fakemachine.InMachine() {
+					log.Printf("Warning: not using fakemachine, volume %s isn't available at %s", hostpath, guestpath)
+				}
+			}
 		}
 
-		log.Printf("==== Recipe done ====")
-		return
-	}
+		var t *timings
+		if options.Timing || options.TimingJSON != "" {
+			t = &timings{}
+		}
 
-	if !fakemachine.InMachine() {
-		for _, a := range r.Actions {
-			// Stack PostMachineCleanup methods
-			defer a.PostMachineCleanup(&context)
+		err = runRecipe(&context, r, m, machineArgs, t, e)
 
-			err = a.PreNoMachine(&context)
-			if exitcode = checkError(&context, err, a, "PreNoMachine"); exitcode != 0 {
-				return
+		// Report the timings even on failure, to see what was slow up to there
+		if options.Timing {
+			t.Print()
+		}
+		if options.TimingJSON != "" {
+			if jerr := t.WriteJSON(options.TimingJSON, file, m != nil); jerr != nil {
+				log.Printf("Couldn't write timings: %v", jerr)
+				exitcode = 1
 			}
 		}
-	}
 
-	// Create Rootdir
-	if _, err = os.Stat(context.Rootdir); os.IsNotExist(err) {
-		err = os.Mkdir(context.Rootdir, 0755)
-		if err != nil && os.IsNotExist(err) {
+		if err != nil {
+			log.Println(err)
 			exitcode = 1
 			return
 		}
 	}
 
-	exitcode = do_run(r, &context)
-	if exitcode != 0 {
-		return
-	}
-
-	if !fakemachine.InMachine() {
-		for _, a := range r.Actions {
-			err = a.PostMachine(&context)
-			if exitcode = checkError(&context, err, a, "PostMachine"); exitcode != 0 {
-				return
-			}
+	for _, file := range args {
+		build(file)
+		if exitcode != 0 && !options.KeepGoing {
+			return
 		}
-		log.Printf("==== Recipe done ====")
 	}
 }
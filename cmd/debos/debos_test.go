@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-debos/debos/actions"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVarsRoundTrip(t *testing.T) {
+	vars := map[string]string{
+		"plain":  "value",
+		"spaces": "a value with spaces",
+		"colons": "key:value:more",
+		"quotes": `"double" and 'single' quotes`,
+		"shell":  "$HOME `id` ; \\ \n",
+		"empty":  "",
+	}
+
+	encoded, err := encodeVars(vars)
+	assert.Empty(t, err)
+	assert.Regexp(t, "^[A-Za-z0-9+/=]*$", encoded)
+
+	decoded := make(map[string]string)
+	err = decodeVars(encoded, decoded)
+	assert.Empty(t, err)
+	assert.Equal(t, vars, decoded)
+}
+
+func TestVarsDecodeMerge(t *testing.T) {
+	encoded, err := encodeVars(map[string]string{"new": "1", "both": "inner"})
+	assert.Empty(t, err)
+
+	vars := map[string]string{"old": "0", "both": "outer"}
+	err = decodeVars(encoded, vars)
+	assert.Empty(t, err)
+	assert.Equal(t, map[string]string{"old": "0", "new": "1", "both": "inner"}, vars)
+
+	err = decodeVars("not base64!", vars)
+	assert.NotEmpty(t, err)
+}
+
+func TestFilterActions(t *testing.T) {
+	file, err := ioutil.TempFile("", "recipe")
+	assert.Empty(t, err)
+	defer os.Remove(file.Name())
+
+	file.WriteString(`
+architecture: arm64
+actions:
+  - action: run
+    description: base
+    label: base
+  - action: run
+    description: overlay
+    label: overlay
+  - action: run
+    description: unlabelled
+  - action: run
+    description: image
+    label: image
+`)
+	file.Close()
+
+	r := actions.Recipe{}
+	assert.Empty(t, r.Parse(file.Name(), false, false))
+
+	names := func(list []actions.YamlAction) []string {
+		var n []string
+		for _, a := range list {
+			n = append(n, a.String())
+		}
+		return n
+	}
+
+	assert.Equal(t, []string{"base", "overlay", "unlabelled", "image"},
+		names(filterActions(r.Actions, nil, nil)))
+	assert.Equal(t, []string{"overlay", "image"},
+		names(filterActions(r.Actions, []string{"image,overlay"}, nil)))
+	assert.Equal(t, []string{"overlay", "unlabelled"},
+		names(filterActions(r.Actions, nil, []string{"base", "image"})))
+	assert.Equal(t, []string{"image"},
+		names(filterActions(r.Actions, []string{"overlay", "image"}, []string{"overlay"})))
+}
+
+func TestTimings(t *testing.T) {
+	var nilTimings *timings
+	// Recording without a collector is a no-op
+	nilTimings.add("action", "Run", time.Second)
+
+	collected := &timings{}
+	collected.add("apt", "Run", 1500*time.Millisecond)
+	collected.add("pack", "PostMachine", 500*time.Millisecond)
+	assert.Equal(t, 2*time.Second, collected.total())
+
+	report := collected.Report()
+	assert.Contains(t, report, "apt")
+	assert.Contains(t, report, "1.5s")
+	assert.Contains(t, report, "Total")
+
+	dir, err := ioutil.TempDir("", "debos-timings")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "timings.json")
+	assert.Empty(t, collected.WriteJSON(file, "/inner.yaml", false))
+	data, err := ioutil.ReadFile(file)
+	assert.Empty(t, err)
+	assert.JSONEq(t, `{"recipes": {"/inner.yaml": {"actions": [
+		{"action": "apt", "stage": "Run", "seconds": 1.5},
+		{"action": "pack", "stage": "PostMachine", "seconds": 0.5}
+	], "total": 2}}}`, string(data))
+
+	// The timings written in fakemachine are merged into its Run stage
+	outer := &timings{}
+	outer.add("fakemachine", "Run", 3*time.Second)
+	outer.add("pack", "PostMachine", time.Second)
+	assert.Empty(t, outer.WriteJSON(file, "/inner.yaml", true))
+	assert.Empty(t, outer.WriteJSON(file, "/other.yaml", false))
+	data, err = ioutil.ReadFile(file)
+	assert.Empty(t, err)
+	assert.JSONEq(t, `{"recipes": {"/inner.yaml": {"actions": [
+		{"action": "fakemachine", "stage": "Run", "seconds": 3},
+		{"action": "apt", "stage": "Run", "seconds": 1.5, "fakemachine": true},
+		{"action": "pack", "stage": "PostMachine", "seconds": 0.5, "fakemachine": true},
+		{"action": "pack", "stage": "PostMachine", "seconds": 1}
+	], "total": 4}, "/other.yaml": {"actions": [
+		{"action": "fakemachine", "stage": "Run", "seconds": 3},
+		{"action": "pack", "stage": "PostMachine", "seconds": 1}
+	], "total": 4}}}`, string(data))
+}
+
+func TestEvents(t *testing.T) {
+	var nilEvents *events
+	// Reporting without a file is a no-op
+	nilEvents.started(0, "action", "Run")
+
+	dir, err := ioutil.TempDir("", "debos-events")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "events.json")
+	e, closer, err := openEvents(file, true)
+	assert.Empty(t, err)
+	e.started(0, "apt", "Run")
+	e.finished(0, "apt", "Run", 1500*time.Millisecond, nil)
+	e.finished(1, "pack", "PostMachine", 0, errors.New("No space left"))
+	assert.Empty(t, closer.Close())
+
+	data, err := ioutil.ReadFile(file)
+	assert.Empty(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, 3, len(lines))
+
+	expected := []string{
+		`{"index": 0, "action": "apt", "stage": "Run", "status": "started"}`,
+		`{"index": 0, "action": "apt", "stage": "Run", "status": "succeeded", "seconds": 1.5}`,
+		`{"index": 1, "action": "pack", "stage": "PostMachine", "status": "failed", "seconds": 0, "error": "No space left"}`,
+	}
+	for i, line := range lines {
+		var ev map[string]interface{}
+		assert.Empty(t, json.Unmarshal([]byte(line), &ev))
+		assert.NotEmpty(t, ev["time"])
+		delete(ev, "time")
+		data, _ := json.Marshal(ev)
+		assert.JSONEq(t, expected[i], string(data))
+	}
+}
+
+func TestReadTemplateVarsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debos-vars")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "vars.yaml")
+	err = ioutil.WriteFile(file, []byte(`
+suite: bookworm
+count: 4
+ratio: 0.5
+debug: true
+prefixed: "int=4"
+image: from-file
+`), 0644)
+	assert.Empty(t, err)
+
+	// The variables already set, e.g. with -t, take precedence
+	vars := map[string]string{"image": "from-command-line"}
+	assert.Empty(t, readTemplateVarsFile(file, vars))
+	assert.Equal(t, map[string]string{
+		"suite":    "bookworm",
+		"count":    "int=4",
+		"ratio":    "float=0.5",
+		"debug":    "bool=true",
+		"prefixed": "string=int=4",
+		"image":    "from-command-line",
+	}, vars)
+
+	jsonFile := path.Join(dir, "vars.json")
+	assert.Empty(t, ioutil.WriteFile(jsonFile, []byte(`{"count": 2, "list": [1, 2]}`), 0644))
+	err = readTemplateVarsFile(jsonFile, map[string]string{})
+	assert.EqualError(t, err, "Template variable list of "+jsonFile+" must be a string, a number or a boolean")
+
+	assert.NotEmpty(t, readTemplateVarsFile(path.Join(dir, "missing.yaml"), map[string]string{}))
+}
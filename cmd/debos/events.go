@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type event struct {
+	Time    string   `json:"time"`
+	Index   int      `json:"index"`
+	Action  string   `json:"action"`
+	Stage   string   `json:"stage"`
+	Status  string   `json:"status"`
+	Seconds *float64 `json:"seconds,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+/* events writes the start and the end of the stages of the actions as JSON
+ * lines, for CI systems to follow the progress of the build without parsing
+ * the logs */
+type events struct {
+	sync.Mutex
+	w io.Writer
+}
+
+/* openEvents opens the file receiving the events, '-' being the standard
+ * output. The file is emptied unless truncate is false, e.g. for the debos
+ * instance running in fakemachine which adds the events of the Run stage */
+func openEvents(filename string, truncate bool) (*events, io.Closer, error) {
+	if filename == "-" {
+		return &events{w: os.Stdout}, nopCloser{}, nil
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(filename, flags, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &events{w: f}, f, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+func (e *events) emit(ev event) {
+	if e == nil {
+		return
+	}
+
+	ev.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	e.w.Write(append(line, '\n'))
+}
+
+func (e *events) started(index int, action, stage string) {
+	e.emit(event{Index: index, Action: action, Stage: stage, Status: "started"})
+}
+
+func (e *events) finished(index int, action, stage string, duration time.Duration, err error) {
+	seconds := duration.Seconds()
+	ev := event{Index: index, Action: action, Stage: stage, Status: "succeeded", Seconds: &seconds}
+	if err != nil {
+		ev.Status = "failed"
+		ev.Error = err.Error()
+	}
+	e.emit(ev)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type timing struct {
+	Action   string        `json:"action"`
+	Stage    string        `json:"stage"`
+	Duration time.Duration `json:"-"`
+	Seconds  float64       `json:"seconds"`
+	// Stage run inside fakemachine, already part of its Run stage
+	Fakemachine bool `json:"fakemachine,omitempty"`
+}
+
+/* timings collects how long each stage of each action took, to be reported
+ * once the recipe is done */
+type timings struct {
+	entries []timing
+}
+
+func (t *timings) add(action, stage string, duration time.Duration) {
+	if t == nil {
+		return
+	}
+	t.entries = append(t.entries, timing{
+		Action:   action,
+		Stage:    stage,
+		Duration: duration,
+		Seconds:  duration.Seconds(),
+	})
+}
+
+func (t *timings) total() time.Duration {
+	var total time.Duration
+	for _, e := range t.entries {
+		if !e.Fakemachine {
+			total += e.Duration
+		}
+	}
+	return total
+}
+
+func (t *timings) Report() string {
+	var b strings.Builder
+
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tSTAGE\tDURATION")
+	for _, e := range t.entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", e.Action, e.Stage, e.Duration.Round(time.Millisecond))
+	}
+	fmt.Fprintf(w, "Total\t\t%s\n", t.total().Round(time.Millisecond))
+	w.Flush()
+
+	return b.String()
+}
+
+// Timings of the recipes built, by recipe file
+type timingsReport struct {
+	Recipes map[string]recipeTimings `json:"recipes"`
+}
+
+type recipeTimings struct {
+	Entries []timing `json:"actions"`
+	Total   float64  `json:"total"`
+}
+
+/*
+WriteJSON adds the timings of the recipe to the JSON file, keeping the ones of
+the other recipes already built. With merge, the timings written for the recipe
+by the debos instance running in fakemachine are inserted after the Run stage
+of fakemachine, which they are part of.
+*/
+func (t *timings) WriteJSON(filename, recipe string, merge bool) error {
+	report := timingsReport{}
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		if err := json.Unmarshal(data, &report); err != nil {
+			return fmt.Errorf("Invalid timings file %s: %v", filename, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if report.Recipes == nil {
+		report.Recipes = make(map[string]recipeTimings)
+	}
+
+	entries := []timing{}
+	for _, e := range t.entries {
+		entries = append(entries, e)
+		if merge && e.Action == "fakemachine" && e.Stage == "Run" {
+			for _, inner := range report.Recipes[recipe].Entries {
+				inner.Fakemachine = true
+				entries = append(entries, inner)
+			}
+		}
+	}
+	report.Recipes[recipe] = recipeTimings{entries, t.total().Seconds()}
+
+	data, err = json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+func (t *timings) Print() {
+	log.Printf("==== Timings ====")
+	for _, line := range strings.Split(strings.TrimRight(t.Report(), "\n"), "\n") {
+		log.Println(line)
+	}
+}
@@ -6,10 +6,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 )
 
 type ChrootEnterMethod int
@@ -25,9 +29,88 @@ type Command struct {
 	Dir          string            // Working dir to run command in
 	Chroot       string            // Run in the chroot at path
 	ChrootMethod ChrootEnterMethod // Method to enter the chroot
+	QemuStatic   string            // Qemu user binary for the chroot, guessed from Architecture if empty
+	Stdout       io.Writer         // Receives the standard output instead of the log if set
+	Interactive  bool              // Attach the command to the terminal instead of logging its output
 
 	bindMounts []string /// Items to bind mount
 	extraEnv   []string // Extra environment variables to set
+	apiMounts  bool     // Mount /proc, /sys and /dev in the chroot
+}
+
+/* Track running commands so they can be stopped when debos gets interrupted */
+var running = struct {
+	sync.Mutex
+	interrupted os.Signal
+	cleaning    int // Number of cleanups in progress, which may start commands
+	procs       map[*os.Process]bool
+}{procs: make(map[*os.Process]bool)}
+
+/*
+Interrupt forwards the signal to all commands currently running and prevents
+new commands from being started, except by the cleanups (see StartCleanup).
+The failing commands make the running action return an error, so the usual
+Cleanup path of the actions is taken.
+*/
+func Interrupt(sig os.Signal) {
+	running.Lock()
+	defer running.Unlock()
+
+	running.interrupted = sig
+	for p := range running.procs {
+		p.Signal(sig)
+	}
+}
+
+// Interrupted returns true once Interrupt has been called
+func Interrupted() bool {
+	running.Lock()
+	defer running.Unlock()
+
+	return running.interrupted != nil
+}
+
+/*
+StartCleanup allows starting commands again once interrupted, until the
+returned function gets called, so the Cleanup and PostMachineCleanup stages of
+the actions can still tear down what they set up, e.g. close encrypted devices.
+*/
+func StartCleanup() func() {
+	running.Lock()
+	defer running.Unlock()
+
+	running.cleaning++
+	return func() {
+		running.Lock()
+		defer running.Unlock()
+		running.cleaning--
+	}
+}
+
+func startCommand(exe *exec.Cmd) error {
+	running.Lock()
+	defer running.Unlock()
+
+	if running.interrupted != nil && running.cleaning == 0 {
+		return fmt.Errorf("Not starting %s: interrupted by %s", exe.Path, running.interrupted)
+	}
+
+	if err := exe.Start(); err != nil {
+		return err
+	}
+	running.procs[exe.Process] = true
+
+	return nil
+}
+
+func waitCommand(exe *exec.Cmd) error {
+	err := exe.Wait()
+
+	running.Lock()
+	delete(running.procs, exe.Process)
+	running.Unlock()
+
+	return err
 }
 
 type commandWrapper struct {
@@ -44,11 +127,11 @@ func (w commandWrapper) out(atEOF bool) {
 	for {
 		s, err := w.buffer.ReadString('\n')
 		if err == nil {
-			log.Printf("%s | %v", w.label, s)
+			Infof("%s | %v", w.label, s)
 		} else {
 			if len(s) > 0 {
 				if atEOF && err == io.EOF {
-					log.Printf("%s | %v\n", w.label, s)
+					Infof("%s | %v\n", w.label, s)
 				} else {
 					w.buffer.WriteString(s)
 				}
@@ -68,9 +151,21 @@ func (w *commandWrapper) flush() {
 	w.out(true)
 }
 
+var nspawnMissing sync.Once
+
 func NewChrootCommandForContext(context DebosContext) Command {
 	c := Command{Architecture: context.Architecture, Chroot: context.Rootdir, ChrootMethod: CHROOT_METHOD_NSPAWN}
 
+	/* Fall back to a plain chroot, setting up the API filesystems and the
+	 * bind mounts nspawn would otherwise provide */
+	if _, err := exec.LookPath("systemd-nspawn"); err != nil {
+		nspawnMissing.Do(func() {
+			Warnf("systemd-nspawn not found, falling back to chroot")
+		})
+		c.ChrootMethod = CHROOT_METHOD_CHROOT
+		c.apiMounts = true
+	}
+
 	if context.EnvironVars != nil {
 		for k, v := range context.EnvironVars {
 			c.AddEnv(fmt.Sprintf("%s=%s", k, v))
@@ -82,12 +177,12 @@ func NewChrootCommandForContext(context DebosContext) Command {
 		if err == nil {
 			c.AddBindMount(path, "")
 		} else {
-			log.Printf("Failed to get realpath for %s, %v", context.Image, err)
+			Warnf("Failed to get realpath for %s, %v", context.Image, err)
 		}
 		for _, p := range context.ImagePartitions {
 			path, err := RealPath(p.DevicePath)
 			if err != nil {
-				log.Printf("Failed to get realpath for %s, %v", p.DevicePath, err)
+				Warnf("Failed to get realpath for %s, %v", p.DevicePath, err)
 				continue
 			}
 			c.AddBindMount(path, "")
@@ -98,6 +193,42 @@ func NewChrootCommandForContext(context DebosContext) Command {
 	return c
 }
 
+// Directories holding system binaries, not always in the PATH of the user
+var sbinDirs = []string{"/usr/local/sbin", "/usr/sbin", "/sbin"}
+
+/*
+CheckBinaries makes sure the given commands are available on the host before
+anything gets done, listing the missing ones. Besides the PATH, the sbin
+directories are searched as well since the commands are run as root in the
+fake machine.
+*/
+func CheckBinaries(names ...string) error {
+	var missing []string
+
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err == nil {
+			continue
+		}
+
+		found := false
+		for _, dir := range sbinDirs {
+			if fi, err := os.Stat(path.Join(dir, name)); err == nil && fi.Mode()&0111 != 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%s not found in PATH", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
 func (cmd *Command) AddEnv(env string) {
 	cmd.extraEnv = append(cmd.extraEnv, env)
 }
@@ -202,17 +333,89 @@ func (cmd *Command) restoreResolvConf(sum *[sha256.Size]byte) error {
 	default:
 		// File is not regular or symlink
 		// Let's get out here with verbose message
-		log.Printf("Warning: /etc/resolv.conf inside the chroot is not a regular file")
+		Warnf("/etc/resolv.conf inside the chroot is not a regular file")
 	}
 
 	return nil
 }
 
+/* mountChroot mounts the API filesystems and the bind mounts in the chroot,
+ * returning a function to unmount them */
+func (cmd *Command) mountChroot() (func(), error) {
+	var mounted []string
+	unmount := func() {
+		for i := len(mounted) - 1; i >= 0; i-- {
+			if err := syscall.Unmount(mounted[i], syscall.MNT_DETACH); err != nil {
+				Warnf("Failed to unmount %s: %v", mounted[i], err)
+			}
+		}
+	}
+
+	mount := func(source, target, fstype string, flags uintptr) error {
+		target = path.Join(cmd.Chroot, target)
+		if fi, err := os.Stat(source); err == nil && !fi.IsDir() {
+			if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+				return err
+			}
+			if f, err := os.OpenFile(target, os.O_CREATE, 0644); err == nil {
+				f.Close()
+			}
+		} else if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+
+		if err := syscall.Mount(source, target, fstype, flags, ""); err != nil {
+			return fmt.Errorf("Failed to mount %s on %s: %v", source, target, err)
+		}
+		mounted = append(mounted, target)
+		return nil
+	}
+
+	var err error
+	if cmd.apiMounts {
+		if err = mount("proc", "/proc", "proc", 0); err == nil {
+			if err = mount("sysfs", "/sys", "sysfs", 0); err == nil {
+				err = mount("/dev", "/dev", "", syscall.MS_BIND|syscall.MS_REC)
+			}
+		}
+	}
+
+	for _, b := range cmd.bindMounts {
+		if err != nil {
+			break
+		}
+		parts := strings.SplitN(b, ":", 2)
+		source, target := parts[0], parts[0]
+		if len(parts) == 2 {
+			target = parts[1]
+		}
+		err = mount(source, target, "", syscall.MS_BIND|syscall.MS_REC)
+	}
+
+	if err != nil {
+		unmount()
+		return nil, err
+	}
+
+	return unmount, nil
+}
+
 func (cmd Command) Run(label string, cmdline ...string) error {
-	q := newQemuHelper(cmd)
+	q, err := newQemuHelper(cmd)
+	if err != nil {
+		return err
+	}
 	q.Setup()
 	defer q.Cleanup()
 
+	// The handlers of the host may still work, e.g. when registered differently
+	unregister, err := q.Register()
+	if err != nil {
+		Warnf("%v, the foreign binaries may fail to run", err)
+	} else {
+		defer unregister()
+	}
+
 	var options []string
 	switch cmd.ChrootMethod {
 	case CHROOT_METHOD_NONE:
@@ -245,6 +448,14 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 	exe.Stdin = nil
 	exe.Stdout = w
 	exe.Stderr = w
+	if cmd.Stdout != nil {
+		exe.Stdout = cmd.Stdout
+	}
+	if cmd.Interactive {
+		exe.Stdin = os.Stdin
+		exe.Stdout = os.Stdout
+		exe.Stderr = os.Stderr
+	}
 
 	defer w.flush()
 
@@ -252,6 +463,16 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 		exe.Env = append(os.Environ(), cmd.extraEnv...)
 	}
 
+	/* Unlike nspawn, chroot doesn't take care of the mounts. Only done when
+	 * needed as e.g. debootstrap sets up the API filesystems itself */
+	if cmd.ChrootMethod == CHROOT_METHOD_CHROOT && (cmd.apiMounts || len(cmd.bindMounts) > 0) {
+		unmount, err := cmd.mountChroot()
+		if err != nil {
+			return err
+		}
+		defer unmount()
+	}
+
 	// Disable services start/stop for commands running in chroot
 	if cmd.ChrootMethod != CHROOT_METHOD_NONE {
 		services := ServiceHelper{cmd.Chroot}
@@ -265,7 +486,11 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 		return err
 	}
 
-	if err = exe.Run(); err != nil {
+	if err = startCommand(exe); err != nil {
+		return err
+	}
+
+	if err = waitCommand(exe); err != nil {
 		return err
 	}
 
@@ -277,42 +502,132 @@ func (cmd Command) Run(label string, cmdline ...string) error {
 	return nil
 }
 
+/*
+HostArchitecture returns the Debian name of the architecture debos is running on.
+*/
+func HostArchitecture() string {
+	switch runtime.GOARCH {
+	case "386":
+		return "i386"
+	case "arm":
+		return "armhf"
+	case "ppc64le":
+		return "ppc64el"
+	case "mipsle":
+		return "mipsel"
+	case "mips64le":
+		return "mips64el"
+	default:
+		return runtime.GOARCH
+	}
+}
+
 type qemuHelper struct {
+	arch       qemuArch
 	qemusrc    string
 	qemutarget string
 }
 
-func newQemuHelper(c Command) qemuHelper {
+/* qemuArch describes the qemu user emulator of an architecture and the ELF
+ * binaries it runs */
+type qemuArch struct {
+	name      string // Name of the emulator, e.g. 'aarch64' for qemu-aarch64
+	bits64    bool
+	bigEndian bool
+	machine   uint16 // ELF machine
+}
+
+// Qemu user emulators by Debian architecture
+var qemuArchitectures = map[string]qemuArch{
+	"alpha":    {"alpha", true, false, 0x9026},
+	"amd64":    {"x86_64", true, false, 62},
+	"arm":      {"arm", false, false, 40},
+	"arm64":    {"aarch64", true, false, 183},
+	"armel":    {"arm", false, false, 40},
+	"armhf":    {"arm", false, false, 40},
+	"hppa":     {"hppa", false, true, 15},
+	"i386":     {"i386", false, false, 3},
+	"loong64":  {"loongarch64", true, false, 258},
+	"m68k":     {"m68k", false, true, 4},
+	"mips":     {"mips", false, true, 8},
+	"mips64el": {"mips64el", true, false, 8},
+	"mipsel":   {"mipsel", false, false, 8},
+	"powerpc":  {"ppc", false, true, 20},
+	"ppc64":    {"ppc64", true, true, 21},
+	"ppc64el":  {"ppc64le", true, false, 21},
+	"riscv64":  {"riscv64", true, false, 243},
+	"s390x":    {"s390x", true, true, 22},
+	"sh4":      {"sh4", false, false, 42},
+	"sparc64":  {"sparc64", true, true, 43},
+}
+
+// Architectures the host runs natively besides its own, by host architecture
+var compatibleArchitectures = map[string][]string{
+	"amd64": {"i386"},
+}
+
+// Architectures returns the sorted list of the architectures commands can be run for
+func Architectures() []string {
+	var architectures []string
+	for a := range qemuArchitectures {
+		architectures = append(architectures, a)
+	}
+	sort.Strings(architectures)
+	return architectures
+}
+
+// CheckArchitecture makes sure commands can be run in a chroot of the architecture
+func CheckArchitecture(architecture string) error {
+	if _, found := qemuArchitectures[architecture]; !found {
+		return fmt.Errorf("Unknown architecture '%s', expected one of: %s",
+			architecture, strings.Join(Architectures(), ", "))
+	}
+	return nil
+}
+
+/*
+ForeignArchitecture tells whether the binaries of the architecture need to be
+emulated by qemu to run on the host.
+*/
+func ForeignArchitecture(architecture string) bool {
+	host := HostArchitecture()
+	if architecture == host {
+		return false
+	}
+	for _, a := range compatibleArchitectures[host] {
+		if architecture == a {
+			return false
+		}
+	}
+	return true
+}
+
+func newQemuHelper(c Command) (qemuHelper, error) {
 	q := qemuHelper{}
 
 	if c.Chroot == "" || c.Architecture == "" {
-		return q
-	}
-
-	switch c.Architecture {
-	case "armhf", "armel", "arm":
-		q.qemusrc = "/usr/bin/qemu-arm-static"
-	case "arm64":
-		q.qemusrc = "/usr/bin/qemu-aarch64-static"
-	case "mips":
-		q.qemusrc = "/usr/bin/qemu-mips-static"
-	case "mipsel":
-		q.qemusrc = "/usr/bin/qemu-mipsel-static"
-	case "mips64el":
-		q.qemusrc = "/usr/bin/qemu-mips64el-static"
-	case "riscv64":
-		q.qemusrc = "/usr/bin/qemu-riscv64-static"
-	case "amd64", "i386":
-		/* Dummy, no qemu */
-	default:
-		log.Panicf("Don't know qemu for Architecture %s", c.Architecture)
+		return q, nil
 	}
 
-	if q.qemusrc != "" {
-		q.qemutarget = path.Join(c.Chroot, q.qemusrc)
+	arch, found := qemuArchitectures[c.Architecture]
+	if !found {
+		return q, fmt.Errorf("Don't know qemu for architecture %s", c.Architecture)
+	}
+	if !ForeignArchitecture(c.Architecture) {
+		return q, nil
 	}
 
-	return q
+	q.arch = arch
+	q.qemusrc = fmt.Sprintf("/usr/bin/qemu-%s-static", arch.name)
+	q.qemutarget = path.Join(c.Chroot, q.qemusrc)
+
+	/* A custom binary is installed at the canonical path of the chroot, which
+	 * is where binfmt looks for the interpreter */
+	if c.QemuStatic != "" {
+		q.qemusrc = c.QemuStatic
+	}
+
+	return q, nil
 }
 
 func (q qemuHelper) Setup() error {
@@ -322,6 +637,18 @@ func (q qemuHelper) Setup() error {
 	return CopyFile(q.qemusrc, q.qemutarget, 0755)
 }
 
+/*
+Register makes sure the kernel runs the binaries of the chroot through qemu,
+registering the binary with binfmt_misc if the host doesn't, until the returned
+function gets called.
+*/
+func (q qemuHelper) Register() (func(), error) {
+	if q.qemusrc == "" {
+		return func() {}, nil
+	}
+	return registerBinfmt(q.arch, q.qemusrc)
+}
+
 func (q qemuHelper) Cleanup() {
 	if q.qemusrc != "" {
 		os.Remove(q.qemutarget)
@@ -1,9 +1,25 @@
 package debos
 
 import (
+	"github.com/stretchr/testify/assert"
 	"testing"
 )
 
 func TestBasicCommand(t *testing.T) {
 	Command{}.Run("out", "ls", "-l")
 }
+
+func TestCheckBinaries(t *testing.T) {
+	assert.Empty(t, CheckBinaries("sh", "tar"))
+	assert.EqualError(t, CheckBinaries("sh", "debos-missing-tool", "debos-other-tool"),
+		"debos-missing-tool, debos-other-tool not found in PATH")
+}
+
+func TestCheckArchitecture(t *testing.T) {
+	for _, arch := range Architectures() {
+		assert.Empty(t, CheckArchitecture(arch))
+	}
+	assert.Contains(t, Architectures(), "ppc64el")
+	err := CheckArchitecture("x32")
+	assert.Contains(t, err.Error(), "Unknown architecture 'x32', expected one of: alpha, amd64,")
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
+	"path"
 )
 
 /*
@@ -29,3 +31,32 @@ func DebugShell(context DebosContext) {
 		proc.Wait()
 	}
 }
+
+/*
+RootfsShell launches an interactive shell in the root filesystem being built,
+e.g. to inspect it after an action failed. It falls back to /bin/sh if the
+shell isn't installed in the rootfs, and to a debug shell in the scratchdir if
+the rootfs has no shell at all yet.
+*/
+func RootfsShell(context DebosContext) {
+	shell := context.ShellOnError
+	if _, err := os.Stat(path.Join(context.Rootdir, shell)); err != nil {
+		shell = "/bin/sh"
+	}
+	if _, err := os.Stat(path.Join(context.Rootdir, shell)); err != nil {
+		log.Printf("No shell in %s yet", context.Rootdir)
+		context.DebugShell = context.ShellOnError
+		DebugShell(context)
+		return
+	}
+
+	log.Printf(">>> Starting a shell in %s, the build is cleaned up once it exits", context.Rootdir)
+	cmd := NewChrootCommandForContext(context)
+	cmd.Interactive = true
+	if err := cmd.Run("shell", shell); err != nil {
+		// The exit status of the shell is of no interest
+		if _, ok := err.(*exec.ExitError); !ok {
+			fmt.Printf("Failed: %s\n", err)
+		}
+	}
+}
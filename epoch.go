@@ -0,0 +1,28 @@
+package debos
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+/*
+SourceDateEpoch returns the time given by the SOURCE_DATE_EPOCH environment
+variable, which actions use as the timestamp of what they produce for builds to
+be reproducible, see https://reproducible-builds.org/specs/source-date-epoch/.
+The boolean is false if the variable isn't set.
+*/
+func SourceDateEpoch() (time.Time, bool, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, false, fmt.Errorf("Invalid SOURCE_DATE_EPOCH '%s'", value)
+	}
+
+	return time.Unix(seconds, 0).UTC(), true, nil
+}
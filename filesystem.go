@@ -1,14 +1,18 @@
 package debos
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 func CleanPathAt(path, at string) string {
@@ -24,7 +28,73 @@ func CleanPath(path string) string {
 	return CleanPathAt(path, cwd)
 }
 
+// Whence values of lseek(2) to find the data and holes of sparse files
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+/*
+copySparse copies the content of in to out, leaving holes in out where in has
+some. Filesystems not reporting holes get the whole content copied. The bytes
+copied are counted by progress, which may be nil.
+*/
+func copySparse(in, out *os.File, progress *Progress) error {
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	for offset := int64(0); offset < size; {
+		data, err := in.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// Only a hole is left up to the end of the file
+			break
+		} else if errors.Is(err, syscall.EINVAL) && offset == 0 {
+			if _, err := in.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			n, err := io.Copy(out, in)
+			progress.Add(n)
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		hole, err := in.Seek(data, seekHole)
+		if err != nil {
+			return err
+		}
+
+		if _, err := in.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := out.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		n, err := io.CopyN(out, in, hole-data)
+		progress.Add(n)
+		if err != nil {
+			return err
+		}
+		offset = hole
+	}
+
+	// Extend the file up to the trailing hole, if any
+	return out.Truncate(size)
+}
+
+/*
+CopyFile copies src to dst with the given mode, replacing dst atomically.
+Holes of sparse files are preserved.
+*/
 func CopyFile(src, dst string, mode os.FileMode) error {
+	return CopyFileWithProgress(src, dst, mode, nil)
+}
+
+// CopyFileWithProgress is CopyFile counting the bytes copied in progress
+func CopyFileWithProgress(src, dst string, mode os.FileMode, progress *Progress) error {
 	in, err := os.Open(src)
 	if err != nil {
 		return err
@@ -34,7 +104,7 @@ func CopyFile(src, dst string, mode os.FileMode) error {
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(tmp, in)
+	err = copySparse(in, tmp, progress)
 	if err != nil {
 		tmp.Close()
 		os.Remove(tmp.Name())
@@ -49,7 +119,13 @@ func CopyFile(src, dst string, mode os.FileMode) error {
 		return err
 	}
 
-	if err = os.Rename(tmp.Name(), dst); err != nil {
+	err = os.Rename(tmp.Name(), dst)
+	if errors.Is(err, syscall.EXDEV) {
+		// The temporary file ended up on another filesystem, e.g. when dst
+		// is a mount point, so copy over dst directly instead
+		os.Remove(tmp.Name())
+		return copyFileInPlace(in, dst, mode, progress)
+	} else if err != nil {
 		os.Remove(tmp.Name())
 		return err
 	}
@@ -57,38 +133,262 @@ func CopyFile(src, dst string, mode os.FileMode) error {
 	return nil
 }
 
+// copyFileInPlace overwrites dst with the content of in
+func copyFileInPlace(in *os.File, dst string, mode os.FileMode, progress *Progress) error {
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if err := copySparse(in, out, progress); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Chmod(dst, mode)
+}
+
+// Options altering the behaviour of CopyTreeWithOptions
+type CopyTreeOptions struct {
+	PreserveOwner bool // Set the owner of the copies to the owner of the source
+	ForceOwner    bool // Set the owner of the copies to Uid:Gid
+	Uid           int
+	Gid           int
+	Jobs          int // Number of files copied concurrently, 0 for the default
+
+	// Function copying the regular files, CopyFile if nil
+	Copy func(src, dst string, mode os.FileMode) error
+	// Function selecting the entries to copy by their path relative to the
+	// source tree, all of them if nil. Skipped directories aren't descended.
+	Filter func(relpath string, info os.FileInfo) bool
+	// Function called for every entry created in the destination tree
+	Record func(src, dst string, info os.FileInfo) error
+	// Function returning the target of the copy of the symlink src to dst,
+	// given the target of src, which is kept as is if nil
+	Symlink func(src, dst, link string) string
+}
+
+var copyJobs = 1
+
+// SetCopyJobs sets the default number of files copied concurrently by CopyTree
+func SetCopyJobs(jobs int) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	copyJobs = jobs
+}
+
 func CopyTree(sourcetree, desttree string) error {
-	fmt.Printf("Overlaying %s on %s\n", sourcetree, desttree)
+	return CopyTreeWithOptions(sourcetree, desttree, CopyTreeOptions{})
+}
+
+/*
+CopyTreeWithOptions recursively copies sourcetree to desttree.
+
+By default the copies are owned by the user running debos. Directories already
+existing in desttree are never modified. Files hardlinked together in
+sourcetree are hardlinked in desttree as well.
+
+Regular files are copied by a pool of workers, while directories are created
+in order before their content. The first error aborts the whole copy. The
+progress of the copy is shown if enabled, see SetProgress.
+*/
+func CopyTreeWithOptions(sourcetree, desttree string, options CopyTreeOptions) error {
+	Debugf("Overlaying %s on %s\n", sourcetree, desttree)
+
+	progress := StartProgress("Copying "+sourcetree, 0)
+	defer progress.Stop()
+
+	chown := func(target string, info os.FileInfo) error {
+		if options.ForceOwner {
+			return os.Lchown(target, options.Uid, options.Gid)
+		}
+		if options.PreserveOwner {
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				return os.Lchown(target, int(st.Uid), int(st.Gid))
+			}
+		}
+		return nil
+	}
+
+	// Copies of the files with several links, by source device and inode
+	type inode struct {
+		dev uint64
+		ino uint64
+	}
+	links := make(map[inode]string)
+
+	jobs := options.Jobs
+	if jobs < 1 {
+		jobs = copyJobs
+	}
+
+	copy := options.Copy
+	if copy == nil {
+		copy = func(src, dst string, mode os.FileMode) error {
+			return CopyFileWithProgress(src, dst, mode, progress)
+		}
+	}
+
+	record := func(p, target string, info os.FileInfo) error {
+		if options.Record == nil {
+			return nil
+		}
+		if err := options.Record(p, target, info); err != nil {
+			return fmt.Errorf("Failed to record %s: %v", target, err)
+		}
+		return nil
+	}
+
+	copyFile := func(p, target string, info os.FileInfo) error {
+		if err := copy(p, target, info.Mode()); err != nil {
+			return fmt.Errorf("Failed to copy file %s: %v", p, err)
+		}
+		progress.AddFile()
+		if err := chown(target, info); err != nil {
+			return fmt.Errorf("Failed to set owner of %s: %v", target, err)
+		}
+		return record(p, target, info)
+	}
+
+	// Files without other links are handed over to the workers
+	type copyJob struct {
+		p      string
+		target string
+		info   os.FileInfo
+	}
+	queue := make(chan copyJob)
+	failed := make(chan struct{})
+	var failure error
+	var failOnce sync.Once
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failure = err
+			close(failed)
+		})
+	}
+
+	var workers sync.WaitGroup
+	for i := 0; jobs > 1 && i < jobs; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range queue {
+				select {
+				case <-failed:
+					continue
+				default:
+				}
+				if err := copyFile(job.p, job.target, job.info); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
 	walker := func(p string, info os.FileInfo, err error) error {
 
 		if err != nil {
 			return err
 		}
 
+		select {
+		case <-failed:
+			return failure
+		default:
+		}
+
 		suffix, _ := filepath.Rel(sourcetree, p)
+		if options.Filter != nil && suffix != "." && !options.Filter(suffix, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		target := path.Join(desttree, suffix)
+		created := true
 		switch info.Mode() & os.ModeType {
 		case 0:
-			err := CopyFile(p, target, info.Mode())
-			if err != nil {
-				log.Panicf("Failed to copy file %s: %v", p, err)
+			st, ok := info.Sys().(*syscall.Stat_t)
+			if ok && st.Nlink > 1 {
+				id := inode{uint64(st.Dev), uint64(st.Ino)}
+				if first, found := links[id]; found {
+					if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+						return fmt.Errorf("Failed to replace %s: %v", target, err)
+					}
+					if err := os.Link(first, target); err != nil {
+						return fmt.Errorf("Failed to link %s: %v", target, err)
+					}
+					break
+				}
+				links[id] = target
+			} else if jobs > 1 {
+				select {
+				case queue <- copyJob{p, target, info}:
+				case <-failed:
+					return failure
+				}
+				return nil
+			}
+
+			if err := copyFile(p, target, info); err != nil {
+				return err
 			}
+			return nil
 		case os.ModeDir:
-			os.Mkdir(target, info.Mode())
+			err := os.Mkdir(target, info.Mode())
+			if os.IsExist(err) {
+				// Might be a symlink to a directory, e.g. with merged /usr
+				created = false
+			} else if err != nil {
+				return fmt.Errorf("Failed to create directory %s: %v", target, err)
+			}
 		case os.ModeSymlink:
 			link, err := os.Readlink(p)
 			if err != nil {
-				log.Panicf("Failed to read symlink %s: %v", suffix, err)
+				return fmt.Errorf("Failed to read symlink %s: %v", p, err)
+			}
+			if options.Symlink != nil {
+				link = options.Symlink(p, target, link)
+			}
+			// Overwrite existing files like for regular files
+			if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+				if err := os.Remove(target); err != nil {
+					return fmt.Errorf("Failed to replace %s: %v", target, err)
+				}
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return fmt.Errorf("Failed to create symlink %s: %v", target, err)
 			}
-			os.Symlink(link, target)
 		default:
-			log.Panicf("Not handled /%s %v", suffix, info.Mode())
+			return fmt.Errorf("Not handled /%s %v", suffix, info.Mode())
+		}
+
+		if created {
+			if err := chown(target, info); err != nil {
+				return fmt.Errorf("Failed to set owner of %s: %v", target, err)
+			}
+			return record(p, target, info)
 		}
 
 		return nil
 	}
 
-	return filepath.Walk(sourcetree, walker)
+	err := filepath.Walk(sourcetree, walker)
+	close(queue)
+	workers.Wait()
+	if err != nil {
+		return err
+	}
+
+	return failure
 }
 
 func RealPath(path string) (string, error) {
@@ -112,3 +412,31 @@ func RestrictedPath(prefix, dest string) (string, error) {
 	}
 	return destination, nil
 }
+
+// SyncFilesystem flushes the data of the filesystem holding path to its device
+func SyncFilesystem(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := unix.Syncfs(int(f.Fd())); err != nil {
+		return fmt.Errorf("Failed to sync filesystem of %s: %v", path, err)
+	}
+	return nil
+}
+
+// SyncFile flushes the data of a file or block device to disk
+func SyncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("Failed to sync %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package debos_test
+
+import (
+	"fmt"
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestCopyTree_hardlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	src := path.Join(dir, "src")
+	dst := path.Join(dir, "dst")
+	assert.Empty(t, os.MkdirAll(path.Join(src, "bin"), 0755))
+	assert.Empty(t, os.Mkdir(dst, 0755))
+
+	assert.Empty(t, ioutil.WriteFile(path.Join(src, "bin/busybox"), []byte("busybox"), 0755))
+	assert.Empty(t, os.Link(path.Join(src, "bin/busybox"), path.Join(src, "bin/sh")))
+	assert.Empty(t, os.Link(path.Join(src, "bin/busybox"), path.Join(src, "bin/ls")))
+
+	assert.Empty(t, debos.CopyTree(src, dst))
+
+	var inodes []uint64
+	for _, name := range []string{"busybox", "sh", "ls"} {
+		fi, err := os.Stat(path.Join(dst, "bin", name))
+		assert.Empty(t, err)
+		st := fi.Sys().(*syscall.Stat_t)
+		assert.Equal(t, uint64(3), uint64(st.Nlink))
+		inodes = append(inodes, uint64(st.Ino))
+	}
+	assert.Equal(t, inodes[0], inodes[1])
+	assert.Equal(t, inodes[0], inodes[2])
+}
+
+func TestCopyTree_jobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	src := path.Join(dir, "src")
+	dst := path.Join(dir, "dst")
+	for i := 0; i < 10; i++ {
+		sub := path.Join(src, fmt.Sprintf("dir%d", i))
+		assert.Empty(t, os.MkdirAll(sub, 0755))
+		for j := 0; j < 10; j++ {
+			name := path.Join(sub, fmt.Sprintf("file%d", j))
+			assert.Empty(t, ioutil.WriteFile(name, []byte(name), 0644))
+		}
+	}
+	assert.Empty(t, os.Mkdir(dst, 0755))
+
+	options := debos.CopyTreeOptions{Jobs: 4}
+	assert.Empty(t, debos.CopyTreeWithOptions(src, dst, options))
+
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			name := path.Join(src, fmt.Sprintf("dir%d", i), fmt.Sprintf("file%d", j))
+			content, err := ioutil.ReadFile(path.Join(dst, fmt.Sprintf("dir%d", i), fmt.Sprintf("file%d", j)))
+			assert.Empty(t, err)
+			assert.Equal(t, name, string(content))
+		}
+	}
+
+	// A failing copy aborts the whole tree
+	assert.Empty(t, os.Chmod(path.Join(dst, "dir5"), 0555))
+	defer os.Chmod(path.Join(dst, "dir5"), 0755)
+	if os.Geteuid() != 0 {
+		assert.NotEmpty(t, debos.CopyTreeWithOptions(src, dst, options))
+	}
+}
+
+func TestCopyTree_danglingSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	src := path.Join(dir, "src")
+	dst := path.Join(dir, "dst")
+	assert.Empty(t, os.MkdirAll(path.Join(src, "etc"), 0755))
+	assert.Empty(t, os.Mkdir(dst, 0755))
+	assert.Empty(t, os.Symlink("/run/missing", path.Join(src, "etc/dangling")))
+
+	assert.Empty(t, debos.CopyTree(src, dst))
+
+	link, err := os.Readlink(path.Join(dst, "etc/dangling"))
+	assert.Empty(t, err)
+	assert.Equal(t, "/run/missing", link)
+
+	// Failing to create the symlink is an error rather than a panic, e.g.
+	// when a directory is in the way, which isn't replaced
+	assert.Empty(t, os.Remove(path.Join(dst, "etc/dangling")))
+	assert.Empty(t, os.MkdirAll(path.Join(dst, "etc/dangling/keep"), 0755))
+	err = debos.CopyTree(src, dst)
+	assert.EqualError(t, err, "Failed to create symlink "+path.Join(dst, "etc/dangling")+
+		": symlink /run/missing "+path.Join(dst, "etc/dangling")+": file exists")
+}
+
+func TestCopyFile_sparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	src := path.Join(dir, "src.img")
+	dst := path.Join(dir, "dst.img")
+
+	// 64MB image with data at the beginning and in the middle only
+	f, err := os.Create(src)
+	assert.Empty(t, err)
+	assert.Empty(t, f.Truncate(64*1024*1024))
+	_, err = f.WriteAt([]byte("header"), 0)
+	assert.Empty(t, err)
+	_, err = f.WriteAt([]byte("middle"), 32*1024*1024)
+	assert.Empty(t, err)
+	assert.Empty(t, f.Close())
+
+	assert.Empty(t, debos.CopyFile(src, dst, 0644))
+
+	srcContent, err := ioutil.ReadFile(src)
+	assert.Empty(t, err)
+	dstContent, err := ioutil.ReadFile(dst)
+	assert.Empty(t, err)
+	assert.Equal(t, srcContent, dstContent)
+
+	var srcStat, dstStat syscall.Stat_t
+	assert.Empty(t, syscall.Stat(src, &srcStat))
+	assert.Empty(t, syscall.Stat(dst, &dstStat))
+	if srcStat.Blocks*512 >= srcStat.Size {
+		t.Skip("Filesystem doesn't support sparse files")
+	}
+	assert.Equal(t, srcStat.Size, dstStat.Size)
+	assert.True(t, dstStat.Blocks*512 < dstStat.Size, "destination isn't sparse")
+}
+
+func TestCopyFileWithProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	src := path.Join(dir, "src")
+	assert.Empty(t, ioutil.WriteFile(src, make([]byte, 1024), 0644))
+
+	debos.SetProgress(true)
+	defer debos.SetProgress(false)
+	p := debos.StartProgress("Copying", 0)
+	defer p.Stop()
+
+	// Copies without a progress aren't counted on the one shown
+	assert.Empty(t, debos.CopyFile(src, path.Join(dir, "dst1"), 0644))
+	assert.Equal(t, int64(0), p.Bytes())
+
+	assert.Empty(t, debos.CopyFileWithProgress(src, path.Join(dir, "dst2"), 0644, p))
+	assert.Equal(t, int64(1024), p.Bytes())
+}
+
+func TestSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "image.img")
+	assert.Empty(t, ioutil.WriteFile(file, []byte("image"), 0644))
+
+	assert.Empty(t, debos.SyncFilesystem(dir))
+	assert.Empty(t, debos.SyncFile(file))
+	assert.Error(t, debos.SyncFile(path.Join(dir, "missing.img")))
+}
@@ -0,0 +1,96 @@
+package debos
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Severity of the log messages
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = map[string]LogLevel{
+	"debug": LogDebug,
+	"info":  LogInfo,
+	"warn":  LogWarn,
+	"error": LogError,
+}
+
+var logging = struct {
+	sync.Mutex
+	level LogLevel
+}{level: LogInfo}
+
+// ParseLogLevel converts the name of a log level, e.g. "debug"
+func ParseLogLevel(name string) (LogLevel, error) {
+	level, found := logLevelNames[strings.ToLower(name)]
+	if !found {
+		return LogInfo, fmt.Errorf("Unknown log level '%s'", name)
+	}
+	return level, nil
+}
+
+// SetLogLevel sets the minimum level of the messages to log
+func SetLogLevel(level LogLevel) {
+	logging.Lock()
+	defer logging.Unlock()
+	logging.level = level
+}
+
+// SetLogTimestamps enables or disables the timestamps in front of the messages
+func SetLogTimestamps(enabled bool) {
+	flags := log.Lmsgprefix
+	if enabled {
+		flags |= log.LstdFlags
+	}
+	log.SetFlags(flags)
+}
+
+/*
+SetLogContext attributes the following messages to the stage of the action
+being executed. Empty strings reset the attribution.
+*/
+func SetLogContext(action, stage string) {
+	log.SetFlags(log.Flags() | log.Lmsgprefix)
+	switch {
+	case action == "":
+		log.SetPrefix("")
+	case stage == "":
+		log.SetPrefix(fmt.Sprintf("[%s] ", action))
+	default:
+		log.SetPrefix(fmt.Sprintf("[%s/%s] ", action, stage))
+	}
+}
+
+func logf(level LogLevel, prefix string, format string, args ...interface{}) {
+	logging.Lock()
+	enabled := level >= logging.level
+	logging.Unlock()
+
+	if enabled {
+		log.Printf(prefix+format, args...)
+	}
+}
+
+// Debugf logs details only useful when investigating issues
+func Debugf(format string, args ...interface{}) {
+	logf(LogDebug, "", format, args...)
+}
+
+// Infof logs the progress of the build
+func Infof(format string, args ...interface{}) {
+	logf(LogInfo, "", format, args...)
+}
+
+// Warnf logs issues which don't make the build fail
+func Warnf(format string, args ...interface{}) {
+	logf(LogWarn, "Warning: ", format, args...)
+}
@@ -0,0 +1,153 @@
+package debos
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+AttachLoopDevice attaches the image file to a free loop device, with partition
+scanning so the device nodes of its partitions get created. The device is
+tracked in the context to be detached by DetachLoopDevices if its user fails to
+detach it. An image still attached to a loop device, e.g. by a build which
+crashed, is refused as writing to it from two devices would corrupt it.
+*/
+func AttachLoopDevice(context *DebosContext, image string) (string, error) {
+	out, err := exec.Command("losetup", "--noheadings", "--output", "NAME", "--associated", image).Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed to list the loop devices of %s: %v", image, err)
+	}
+	if devices := strings.Fields(string(out)); len(devices) > 0 {
+		return "", fmt.Errorf("Image %s is still attached to %s, detach it first with 'losetup -d'",
+			image, strings.Join(devices, ", "))
+	}
+
+	out, err = exec.Command("losetup", "--find", "--show", "--partscan", image).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Failed to set up loop device for %s: %v: %s", image, err, strings.TrimSpace(string(out)))
+	}
+	device := strings.TrimSpace(string(out))
+
+	context.LoopDevices = append(context.LoopDevices, device)
+	Debugf("Attached %s to %s\n", image, device)
+
+	return device, nil
+}
+
+// unescapeMount decodes the octal escapes of /proc/self/mounts, e.g. '\040'
+func unescapeMount(field string) string {
+	var out strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				out.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		out.WriteByte(field[i])
+	}
+	return out.String()
+}
+
+// loopMounts returns the mountpoints of the loop device and its partitions
+func loopMounts(device string) ([]string, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		source := unescapeMount(fields[0])
+		partition := strings.TrimPrefix(source, device+"p")
+		if _, err := strconv.Atoi(partition); source == device || (partition != source && err == nil) {
+			mounts = append(mounts, unescapeMount(fields[1]))
+		}
+	}
+
+	return mounts, scanner.Err()
+}
+
+/*
+DetachLoopDevice detaches a loop device attached by AttachLoopDevice. The
+filesystems of the device still mounted, which would keep it busy, are
+lazily unmounted first.
+*/
+func DetachLoopDevice(context *DebosContext, device string) error {
+	mounts, err := loopMounts(device)
+	if err != nil {
+		Warnf("Failed to list the mounts of %s: %v", device, err)
+	}
+	// Nested mounts come after their parents
+	for i := len(mounts) - 1; i >= 0; i-- {
+		Warnf("%s is still mounted on %s, unmounting it lazily", device, mounts[i])
+		if err := syscall.Unmount(mounts[i], syscall.MNT_DETACH); err != nil {
+			Warnf("Failed to unmount %s: %v", mounts[i], err)
+		}
+	}
+
+	// The device can stay busy for a while, e.g. while udev probes it
+	for t := 0; t < 60; t++ {
+		var out []byte
+		out, err = exec.Command("losetup", "--detach", device).CombinedOutput()
+		if err == nil {
+			break
+		}
+		err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		Debugf("Loop device %s couldn't be detached (%s), waiting", device, err)
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to detach loop device %s: %v", device, err)
+	}
+
+	untrackLoopDevice(context, device)
+	Debugf("Detached %s\n", device)
+
+	return nil
+}
+
+// untrackLoopDevice stops tracking the device in the context
+func untrackLoopDevice(context *DebosContext, device string) {
+	for i, d := range context.LoopDevices {
+		if d == device {
+			context.LoopDevices = append(context.LoopDevices[:i], context.LoopDevices[i+1:]...)
+			break
+		}
+	}
+}
+
+/*
+KeepLoopDevice leaves a loop device attached by AttachLoopDevice alone, so
+DetachLoopDevices doesn't detach it either, e.g. when its content couldn't be
+flushed and detaching it would drop the data not written back yet.
+*/
+func KeepLoopDevice(context *DebosContext, device string) {
+	untrackLoopDevice(context, device)
+	Warnf("Leaving loop device %s attached, detach it with 'losetup -d' once done", device)
+}
+
+// DetachLoopDevices detaches the loop devices left attached, e.g. after a failure
+func DetachLoopDevices(context *DebosContext) {
+	for len(context.LoopDevices) > 0 {
+		device := context.LoopDevices[len(context.LoopDevices)-1]
+		Warnf("Loop device %s is still attached, detaching it", device)
+		if err := DetachLoopDevice(context, device); err != nil {
+			Warnf("%v", err)
+			context.LoopDevices = context.LoopDevices[:len(context.LoopDevices)-1]
+		}
+	}
+}
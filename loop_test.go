@@ -0,0 +1,63 @@
+package debos_test
+
+import (
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+func TestLoopDevice(t *testing.T) {
+	if _, err := exec.LookPath("losetup"); err != nil || os.Getuid() != 0 {
+		t.Skip("losetup not usable")
+	}
+
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	image := path.Join(dir, "image.img")
+	f, err := os.Create(image)
+	assert.Empty(t, err)
+	assert.Empty(t, f.Truncate(16*1024*1024))
+	assert.Empty(t, f.Close())
+
+	context := debos.DebosContext{&debos.CommonContext{}, "", "arm64"}
+	device, err := debos.AttachLoopDevice(&context, image)
+	if err != nil {
+		t.Skipf("Loop devices not available: %v", err)
+	}
+	defer debos.DetachLoopDevices(&context)
+	assert.Equal(t, []string{device}, context.LoopDevices)
+
+	// The image can't be attached twice
+	_, err = debos.AttachLoopDevice(&context, image)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is still attached to "+device)
+
+	assert.Empty(t, debos.DetachLoopDevice(&context, device))
+	assert.Empty(t, context.LoopDevices)
+
+	// Left over devices get detached as well
+	_, err = debos.AttachLoopDevice(&context, image)
+	assert.Empty(t, err)
+	debos.DetachLoopDevices(&context)
+	assert.Empty(t, context.LoopDevices)
+	out, err := exec.Command("losetup", "--associated", image).Output()
+	assert.Empty(t, err)
+	assert.Empty(t, string(out))
+
+	// Devices kept by their user aren't detached
+	device, err = debos.AttachLoopDevice(&context, image)
+	assert.Empty(t, err)
+	debos.KeepLoopDevice(&context, device)
+	assert.Empty(t, context.LoopDevices)
+	debos.DetachLoopDevices(&context)
+	out, err = exec.Command("losetup", "--associated", image).Output()
+	assert.Empty(t, err)
+	assert.Contains(t, string(out), device)
+	assert.Empty(t, debos.DetachLoopDevice(&context, device))
+}
@@ -0,0 +1,67 @@
+package debos
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// Operation placing a file into the image, as recorded in the file manifest
+type FileRecord struct {
+	Action      string `json:"action"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Type        string `json:"type"` // file, directory, symlink or archive
+}
+
+var fileManifest = struct {
+	sync.Mutex
+	path string
+}{}
+
+/*
+SetFileManifest makes RecordFile append the file operations as JSON lines to
+the file at path. The file is truncated first when truncate is set, otherwise
+records are added to the existing ones, e.g. from the host before running the
+build in fakemachine. An empty path disables the manifest.
+*/
+func SetFileManifest(path string, truncate bool) error {
+	fileManifest.Lock()
+	defer fileManifest.Unlock()
+
+	fileManifest.path = path
+	if path == "" || !truncate {
+		return nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// RecordFile adds an entry to the file manifest, if enabled
+func RecordFile(record FileRecord) error {
+	fileManifest.Lock()
+	defer fileManifest.Unlock()
+
+	if fileManifest.path == "" {
+		return nil
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(fileManifest.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,40 @@
+package debos_test
+
+import (
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRecordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-debos")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	manifest := path.Join(dir, "manifest.jsonl")
+	assert.Empty(t, ioutil.WriteFile(manifest, []byte("stale\n"), 0644))
+	assert.Empty(t, debos.SetFileManifest(manifest, true))
+	defer debos.SetFileManifest("", false)
+
+	src := path.Join(dir, "src")
+	dst := path.Join(dir, "dst")
+	assert.Empty(t, os.MkdirAll(path.Join(src, "etc"), 0755))
+	assert.Empty(t, os.Mkdir(dst, 0755))
+	assert.Empty(t, ioutil.WriteFile(path.Join(src, "etc/hostname"), []byte("debos"), 0644))
+
+	options := debos.CopyTreeOptions{
+		Record: func(s, d string, info os.FileInfo) error {
+			return debos.RecordFile(debos.FileRecord{Action: "test", Source: s, Destination: d, Type: "file"})
+		},
+	}
+	assert.Empty(t, debos.CopyTreeWithOptions(src, dst, options))
+
+	content, err := ioutil.ReadFile(manifest)
+	assert.Empty(t, err)
+	assert.Equal(t, `{"action":"test","source":"`+src+`/etc","destination":"`+dst+`/etc","type":"file"}
+{"action":"test","source":"`+src+`/etc/hostname","destination":"`+dst+`/etc/hostname","type":"file"}
+`, string(content))
+}
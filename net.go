@@ -3,14 +3,13 @@ package debos
 import (
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 )
 
 // Function for downloading single file object with http(s) protocol
 func DownloadHttpUrl(url, filename string) error {
-	log.Printf("Download started: '%s' -> '%s'\n", url, filename)
+	Infof("Download started: '%s' -> '%s'\n", url, filename)
 
 	// TODO: Proxy support?
 
@@ -30,16 +29,21 @@ func DownloadHttpUrl(url, filename string) error {
 		return fmt.Errorf("Url '%s' returned status code %d (%s)\n", url, resp.StatusCode, http.StatusText(resp.StatusCode))
 	}
 
-	// Output file
-	output, err := os.Create(filename)
+	// Stream into a temporary file so no partial download is left behind
+	tmpname := filename + ".part"
+	output, err := os.Create(tmpname)
 	if err != nil {
 		return err
 	}
-	defer output.Close()
+	defer os.Remove(tmpname)
 
-	if _, err := io.Copy(output, resp.Body); err != nil {
+	progress := StartProgress("Downloading "+url, resp.ContentLength)
+	_, err = io.Copy(progress.Writer(output), resp.Body)
+	progress.Stop()
+	output.Close()
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return os.Rename(tmpname, filename)
 }
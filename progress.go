@@ -0,0 +1,221 @@
+package debos
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Interval between the updates of the progress line
+const progressInterval = time.Second
+
+/*
+Progress reports the bytes and files processed by a long operation, e.g. a
+copy or a download, on a single line of the terminal redrawn every second.
+Only one progress is shown at a time. A nil Progress, as returned by
+StartProgress when progress reporting is disabled, ignores all the calls.
+*/
+type Progress struct {
+	label string
+	total int64
+	bytes int64
+	files int64
+	start time.Time
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+var progressState = struct {
+	sync.Mutex
+	enabled bool
+	shown   *Progress
+	drawn   bool // Whether the progress line is on the terminal
+	output  io.Writer
+}{output: os.Stderr}
+
+// progressLog clears the progress line before the log messages
+type progressLog struct{}
+
+func (progressLog) Write(data []byte) (int, error) {
+	progressState.Lock()
+	defer progressState.Unlock()
+
+	if progressState.drawn {
+		fmt.Fprint(progressState.output, "\r\033[K")
+		progressState.drawn = false
+	}
+	return progressState.output.Write(data)
+}
+
+// IsTerminal tells whether the file is a terminal
+func IsTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+/*
+SetProgress enables or disables the progress reporting, which should only be
+enabled when the standard error is a terminal, see IsTerminal.
+*/
+func SetProgress(enabled bool) {
+	progressState.Lock()
+	defer progressState.Unlock()
+
+	progressState.enabled = enabled
+	if enabled {
+		log.SetOutput(progressLog{})
+	} else {
+		log.SetOutput(progressState.output)
+	}
+}
+
+/*
+StartProgress starts reporting the progress of an operation, total being the
+number of bytes expected or 0 if unknown. It returns nil if progress reporting
+is disabled or if the progress of another operation is already shown, e.g. by
+another action of a parallel group.
+*/
+func StartProgress(label string, total int64) *Progress {
+	progressState.Lock()
+	defer progressState.Unlock()
+
+	if !progressState.enabled || progressState.shown != nil {
+		return nil
+	}
+
+	p := &Progress{
+		label: label,
+		total: total,
+		start: time.Now(),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	progressState.shown = p
+
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.draw()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+// formatBytes formats a number of bytes with a binary unit, e.g. '1.5 GiB'
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for ; n >= 1024 && i < len(units)-1; i++ {
+		n /= 1024
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+func (p *Progress) String() string {
+	bytes := atomic.LoadInt64(&p.bytes)
+	files := atomic.LoadInt64(&p.files)
+
+	s := fmt.Sprintf("%s: %s", p.label, formatBytes(float64(bytes)))
+	if p.total > 0 {
+		s += fmt.Sprintf(" of %s (%d%%)", formatBytes(float64(p.total)), bytes*100/p.total)
+	}
+	if files > 0 {
+		s += fmt.Sprintf(", %d files", files)
+	}
+	if elapsed := time.Since(p.start).Seconds(); elapsed > 0 {
+		s += fmt.Sprintf(", %s/s", formatBytes(float64(bytes)/elapsed))
+	}
+	return s
+}
+
+func (p *Progress) draw() {
+	progressState.Lock()
+	defer progressState.Unlock()
+
+	fmt.Fprintf(progressState.output, "\r\033[K%s", p)
+	progressState.drawn = true
+}
+
+// Add counts bytes processed
+func (p *Progress) Add(n int64) {
+	if p != nil {
+		atomic.AddInt64(&p.bytes, n)
+	}
+}
+
+// AddFile counts a file processed
+func (p *Progress) AddFile() {
+	if p != nil {
+		atomic.AddInt64(&p.files, 1)
+	}
+}
+
+// Bytes returns the number of bytes processed so far
+func (p *Progress) Bytes() int64 {
+	if p == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&p.bytes)
+}
+
+// Files returns the number of files processed so far
+func (p *Progress) Files() int64 {
+	if p == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&p.files)
+}
+
+type progressWriter struct {
+	io.Writer
+	p *Progress
+}
+
+func (w progressWriter) Write(data []byte) (int, error) {
+	n, err := w.Writer.Write(data)
+	w.p.Add(int64(n))
+	return n, err
+}
+
+// Writer returns a writer to w counting the bytes written
+func (p *Progress) Writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return progressWriter{w, p}
+}
+
+// Stop stops reporting the progress and clears the progress line
+func (p *Progress) Stop() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+
+	progressState.Lock()
+	defer progressState.Unlock()
+
+	if progressState.drawn {
+		fmt.Fprint(progressState.output, "\r\033[K")
+		progressState.drawn = false
+	}
+	progressState.shown = nil
+}
@@ -0,0 +1,41 @@
+package debos_test
+
+import (
+	"bytes"
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	var out bytes.Buffer
+
+	// Disabled progress ignores the calls
+	p := debos.StartProgress("Disabled", 0)
+	assert.Nil(t, p)
+	p.Writer(&out).Write([]byte("data"))
+	p.AddFile()
+	p.Stop()
+	assert.Equal(t, "data", out.String())
+	assert.Equal(t, int64(0), p.Bytes())
+
+	debos.SetProgress(true)
+	defer debos.SetProgress(false)
+
+	p = debos.StartProgress("Downloading", 2048)
+	assert.NotNil(t, p)
+	// Only one progress is shown at a time
+	assert.Nil(t, debos.StartProgress("Nested", 0))
+
+	p.Writer(&out).Write(make([]byte, 1024))
+	p.AddFile()
+	assert.Equal(t, int64(1024), p.Bytes())
+	assert.Equal(t, int64(1), p.Files())
+	assert.True(t, strings.HasPrefix(p.String(), "Downloading: 1.0 KiB of 2.0 KiB (50%), 1 files"), p.String())
+	p.Stop()
+
+	p = debos.StartProgress("Again", 0)
+	assert.NotNil(t, p)
+	p.Stop()
+}
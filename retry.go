@@ -0,0 +1,36 @@
+package debos
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+Retry calls f until it succeeds, at most retries times more after the first
+attempt. The delay between the attempts doubles after each failure. The error
+of the last attempt is returned.
+*/
+func Retry(label string, retries int, delay time.Duration, f func() error) error {
+	err := f()
+	for attempt := 1; err != nil && attempt <= retries; attempt++ {
+		Warnf("%s failed, retrying in %s (%d/%d): %v\n", label, delay, attempt, retries, err)
+		time.Sleep(delay)
+		delay *= 2
+		err = f()
+	}
+
+	return err
+}
+
+// ParseRetryDelay parses the delay before retrying, defaulting to 5 seconds
+func ParseRetryDelay(delay string) (time.Duration, error) {
+	if delay == "" {
+		return 5 * time.Second, nil
+	}
+
+	d, err := time.ParseDuration(delay)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid retry delay '%s'", delay)
+	}
+	return d, nil
+}
@@ -0,0 +1,43 @@
+package debos_test
+
+import (
+	"errors"
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	attempts := 0
+	err := debos.Retry("test", 3, time.Millisecond, func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	assert.Empty(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = debos.Retry("test", 2, time.Millisecond, func() error {
+		attempts++
+		return errors.New("permanent")
+	})
+	assert.EqualError(t, err, "permanent")
+	assert.Equal(t, 3, attempts)
+}
+
+func TestParseRetryDelay(t *testing.T) {
+	delay, err := debos.ParseRetryDelay("")
+	assert.Empty(t, err)
+	assert.Equal(t, 5*time.Second, delay)
+
+	delay, err = debos.ParseRetryDelay("1m")
+	assert.Empty(t, err)
+	assert.Equal(t, time.Minute, delay)
+
+	_, err = debos.ParseRetryDelay("soon")
+	assert.EqualError(t, err, "Invalid retry delay 'soon'")
+}
@@ -0,0 +1,76 @@
+package debos
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version of debos, set when building releases with
+// -ldflags "-X github.com/go-debos/debos.Version=<version>"
+var Version = "1.1.0"
+
+// parseVersion splits a version into its numbers, ignoring any suffix such as
+// '-rc1', '+git20200101' or '~bpo10'
+func parseVersion(version string) ([]int, error) {
+	if idx := strings.IndexAny(version, "-+~"); idx >= 0 {
+		version = version[:idx]
+	}
+
+	var numbers []int
+	for _, field := range strings.Split(strings.TrimPrefix(version, "v"), ".") {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid version '%s'", version)
+		}
+		numbers = append(numbers, n)
+	}
+
+	return numbers, nil
+}
+
+/*
+CompareVersions compares two dotted versions, e.g. '1.0' and '1.0.2', returning
+-1, 0 or 1 when a is older, the same or newer than b. Missing numbers count as
+0, so '1.0' and '1.0.0' are the same.
+*/
+func CompareVersions(a, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		var na, nb int
+		if i < len(va) {
+			na = va[i]
+		}
+		if i < len(vb) {
+			nb = vb[i]
+		}
+		switch {
+		case na < nb:
+			return -1, nil
+		case na > nb:
+			return 1, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// CheckVersion returns an error if this debos is older than version
+func CheckVersion(version string) error {
+	cmp, err := CompareVersions(Version, version)
+	if err != nil {
+		return err
+	}
+	if cmp < 0 {
+		return fmt.Errorf("debos %s or newer is required, this is debos %s", version, Version)
+	}
+	return nil
+}
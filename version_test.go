@@ -0,0 +1,29 @@
+package debos_test
+
+import (
+	"github.com/go-debos/debos"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, v := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.0.0", 0},
+		{"1.0.1", "1.0", 1},
+		{"1.2", "1.10", -1},
+		{"v2.0", "1.9.9", 1},
+		{"1.1.0-rc1", "1.1", 0},
+		{"1.1+git20200101", "1.2", -1},
+	} {
+		cmp, err := debos.CompareVersions(v.a, v.b)
+		assert.Empty(t, err)
+		assert.Equal(t, v.expected, cmp, v.a+" vs "+v.b)
+	}
+
+	_, err := debos.CompareVersions("1.0", "latest")
+	assert.EqualError(t, err, "Invalid version 'latest'")
+}